@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/chann44/ikyk/pkg/logger"
+	"github.com/chann44/ikyk/pkg/types"
+	"github.com/chann44/ikyk/pkg/utils"
+)
+
+// purgeBatchSize bounds the keys deleted per DEL command
+const purgeBatchSize = 500
+
+// CacheInvalidationsChannel is watched by the gateways to drop the
+// in-process copies of purged entries
+const CacheInvalidationsChannel = "cache:invalidations"
+
+type CacheHandler struct {
+	storage *redis.Client
+	log     *logger.Logger
+}
+
+func NewCacheHandler(storage *redis.Client, log *logger.Logger) *CacheHandler {
+	return &CacheHandler{
+		storage: storage,
+		log:     log,
+	}
+}
+
+// PurgeCacheRequest selects the cached responses to drop; entries matching
+// any of the criteria are purged
+type PurgeCacheRequest struct {
+	URLs     []string `json:"urls,omitempty"`     // Path and query, e.g. /products/1?lang=en; the host of full URLs is ignored
+	Prefixes []string `json:"prefixes,omitempty"` // Path prefixes, e.g. /products/
+	Routes   []string `json:"routes,omitempty"`   // Registry paths of routes
+	Tags     []string `json:"tags,omitempty"`     // Surrogate keys the services sent in Surrogate-Key headers
+}
+
+// PurgeCache drops cached responses from the gateways' shared cache
+func (ch *CacheHandler) PurgeCache(w http.ResponseWriter, r *http.Request) {
+	var req PurgeCacheRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.ErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.URLs)+len(req.Prefixes)+len(req.Routes)+len(req.Tags) == 0 {
+		utils.ErrorResponse(w, "Nothing to purge: give urls, prefixes, routes or tags", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	var indexes []string
+
+	for _, raw := range req.URLs {
+		target, err := url.Parse(raw)
+		if err != nil || !strings.HasPrefix(target.Path, "/") {
+			utils.ErrorResponse(w, "Invalid url: "+raw, http.StatusBadRequest)
+			return
+		}
+		uri := target.Path
+		if target.RawQuery != "" {
+			uri += "?" + target.RawQuery
+		}
+		indexes = append(indexes, "cache:index:url:"+uri)
+	}
+
+	for _, path := range req.Routes {
+		if err := utils.ValidatePath(path); err != nil {
+			utils.ErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		indexes = append(indexes, "cache:index:route:"+path)
+	}
+
+	for _, tag := range req.Tags {
+		if tag == "" || strings.ContainsAny(tag, " \t\r\n") {
+			utils.ErrorResponse(w, "Invalid tag: "+tag, http.StatusBadRequest)
+			return
+		}
+		indexes = append(indexes, "cache:index:tag:"+tag)
+	}
+
+	for _, prefix := range req.Prefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			utils.ErrorResponse(w, "Prefixes must start with /", http.StatusBadRequest)
+			return
+		}
+		matched, err := ch.scanIndexes(ctx, "cache:index:path:"+globEscape(prefix)+"*")
+		if err != nil {
+			utils.ErrorResponse(w, "Failed to purge cache", http.StatusInternalServerError)
+			return
+		}
+		indexes = append(indexes, matched...)
+	}
+
+	purged, err := ch.purge(ctx, indexes)
+	if err != nil {
+		ch.log.Error("failed to purge cache", "error", err)
+		utils.ErrorResponse(w, "Failed to purge cache", http.StatusInternalServerError)
+		return
+	}
+
+	ch.log.Info("cache purged", "urls", len(req.URLs), "prefixes", len(req.Prefixes),
+		"routes", len(req.Routes), "tags", len(req.Tags), "entries", purged)
+	utils.SuccessResponse(w, "Cache purged successfully", map[string]int64{
+		"purged": purged,
+	})
+}
+
+// purge deletes the cached responses listed in the indexes, and the indexes
+func (ch *CacheHandler) purge(ctx context.Context, indexes []string) (int64, error) {
+	seen := make(map[string]bool)
+	var entries []string
+	for _, index := range indexes {
+		keys, err := ch.storage.SMembers(ctx, index).Result()
+		if err != nil {
+			return 0, err
+		}
+		for _, key := range keys {
+			if !seen[key] {
+				seen[key] = true
+				entries = append(entries, key)
+			}
+		}
+	}
+
+	var purged int64
+	for start := 0; start < len(entries); start += purgeBatchSize {
+		end := min(start+purgeBatchSize, len(entries))
+		deleted, err := ch.storage.Del(ctx, entries[start:end]...).Result()
+		if err != nil {
+			return purged, err
+		}
+		purged += deleted
+
+		message, _ := json.Marshal(types.CacheInvalidation{Keys: entries[start:end]})
+		if err := ch.storage.Publish(ctx, CacheInvalidationsChannel, message).Err(); err != nil {
+			ch.log.Error("failed to publish cache invalidation", "error", err)
+		}
+	}
+
+	if len(indexes) > 0 {
+		if err := ch.storage.Del(ctx, indexes...).Err(); err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+func (ch *CacheHandler) scanIndexes(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+	iter := ch.storage.Scan(ctx, 0, pattern, purgeBatchSize).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// globEscape quotes the characters SCAN MATCH treats as wildcards
+func globEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`).Replace(s)
+}
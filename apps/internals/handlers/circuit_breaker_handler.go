@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/redis/go-redis/v9"
+	"github.com/chann44/ikyk/pkg/logger"
+	"github.com/chann44/ikyk/pkg/types"
+	"github.com/chann44/ikyk/pkg/utils"
+)
+
+// CircuitEventsChannel is watched by the gateways to update their breaker
+// state gauges
+const CircuitEventsChannel = "circuit:events"
+
+// defaultWindowSize mirrors the gateway's breaker default, used when a
+// service's stored policy doesn't set one
+const defaultWindowSize = 100
+
+type CircuitBreakerHandler struct {
+	storage *redis.Client
+	log     *logger.Logger
+}
+
+func NewCircuitBreakerHandler(storage *redis.Client, log *logger.Logger) *CircuitBreakerHandler {
+	return &CircuitBreakerHandler{
+		storage: storage,
+		log:     log,
+	}
+}
+
+// CircuitBreakerStatus is a service's breaker as the gateways last left it
+type CircuitBreakerStatus struct {
+	Service        string     `json:"service"`
+	State          string     `json:"state"` // "closed", "open", "half-open", "forced-open" or "forced-closed"
+	Calls          int64      `json:"calls"` // In the current sliding window
+	Failures       int64      `json:"failures"`
+	SlowCalls      int64      `json:"slow_calls"`
+	HalfOpenProbes int64      `json:"half_open_probes,omitempty"`
+	LastTransition *time.Time `json:"last_transition,omitempty"`
+}
+
+// ListCircuitBreakers returns the breaker of every registered service
+func (ch *CircuitBreakerHandler) ListCircuitBreakers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	names, err := serviceNames(ctx, ch.storage)
+	if err != nil {
+		utils.ErrorResponse(w, "Failed to list circuit breakers", http.StatusInternalServerError)
+		return
+	}
+
+	statuses := make([]CircuitBreakerStatus, 0, len(names))
+	for _, name := range names {
+		statuses = append(statuses, ch.status(ctx, name))
+	}
+
+	utils.JSONResponse(w, statuses, http.StatusOK)
+}
+
+func (ch *CircuitBreakerHandler) GetCircuitBreaker(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	ctx := r.Context()
+
+	if !serviceExists(ctx, ch.storage, name) {
+		utils.ErrorResponse(w, "Service not found", http.StatusNotFound)
+		return
+	}
+
+	utils.JSONResponse(w, ch.status(ctx, name), http.StatusOK)
+}
+
+// ForceOpen rejects every call to the service until the breaker is reset
+func (ch *CircuitBreakerHandler) ForceOpen(w http.ResponseWriter, r *http.Request) {
+	ch.force(w, r, "forced-open")
+}
+
+// ForceClose lets every call to the service through, whatever its failure
+// rate, until the breaker is reset
+func (ch *CircuitBreakerHandler) ForceClose(w http.ResponseWriter, r *http.Request) {
+	ch.force(w, r, "forced-closed")
+}
+
+func (ch *CircuitBreakerHandler) force(w http.ResponseWriter, r *http.Request, state string) {
+	name := chi.URLParam(r, "name")
+	ctx := r.Context()
+
+	if !serviceExists(ctx, ch.storage, name) {
+		utils.ErrorResponse(w, "Service not found", http.StatusNotFound)
+		return
+	}
+
+	from := ch.state(ctx, name)
+	key := breakerKey(name)
+	pipe := ch.storage.TxPipeline()
+	pipe.HSet(ctx, key,
+		"state", state,
+		"changed_at", time.Now().UnixMilli(),
+		"probes", 0,
+		"successes", 0)
+	// Forced states hold until an operator resets them
+	pipe.Persist(ctx, key)
+	pipe.Del(ctx, windowKeys(name)...)
+	if _, err := pipe.Exec(ctx); err != nil {
+		utils.ErrorResponse(w, "Failed to update circuit breaker", http.StatusInternalServerError)
+		return
+	}
+
+	ch.log.Warn("circuit breaker "+state, "service", name, "from", from)
+	ch.publish(ctx, name, from, state, "forced by operator")
+	utils.SuccessResponse(w, "Circuit breaker "+state, ch.status(ctx, name))
+}
+
+// ResetCircuitBreaker closes the breaker and clears its sliding window,
+// lifting a forced state
+func (ch *CircuitBreakerHandler) ResetCircuitBreaker(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	ctx := r.Context()
+
+	if !serviceExists(ctx, ch.storage, name) {
+		utils.ErrorResponse(w, "Service not found", http.StatusNotFound)
+		return
+	}
+
+	from := ch.state(ctx, name)
+	keys := append([]string{breakerKey(name)}, windowKeys(name)...)
+	if err := ch.storage.Del(ctx, keys...).Err(); err != nil {
+		utils.ErrorResponse(w, "Failed to reset circuit breaker", http.StatusInternalServerError)
+		return
+	}
+
+	ch.log.Info("circuit breaker reset", "service", name, "from", from)
+	ch.publish(ctx, name, from, "closed", "reset by operator")
+	utils.SuccessResponse(w, "Circuit breaker reset", ch.status(ctx, name))
+}
+
+func (ch *CircuitBreakerHandler) state(ctx context.Context, name string) string {
+	state, err := ch.storage.HGet(ctx, breakerKey(name), "state").Result()
+	if err != nil {
+		return "closed"
+	}
+	return state
+}
+
+// status reads a breaker and its window. Count windows keep running totals;
+// time windows are summed from the per-second buckets still inside the
+// window, since the gateways only drop expired buckets when they record a call.
+func (ch *CircuitBreakerHandler) status(ctx context.Context, name string) CircuitBreakerStatus {
+	keys := windowKeys(name)
+
+	pipe := ch.storage.Pipeline()
+	breakerCmd := pipe.HGetAll(ctx, breakerKey(name))
+	totalsCmd := pipe.HMGet(ctx, keys[1], "calls", "failures", "slow")
+	bucketsCmd := pipe.HGetAll(ctx, keys[2])
+	policyCmd := pipe.Get(ctx, redisKey("registry:service", name, "circuit"))
+	pipe.Exec(ctx)
+
+	breaker := breakerCmd.Val()
+	status := CircuitBreakerStatus{Service: name, State: breaker["state"]}
+	if status.State == "" {
+		status.State = "closed"
+	}
+	if status.State == "half-open" {
+		status.HalfOpenProbes, _ = strconv.ParseInt(breaker["probes"], 10, 64)
+	}
+	if changedAt, err := strconv.ParseInt(breaker["changed_at"], 10, 64); err == nil {
+		at := time.UnixMilli(changedAt)
+		status.LastTransition = &at
+	}
+
+	totals := totalsCmd.Val()
+	if len(totals) == 3 && totals[0] != nil {
+		status.Calls = parseCount(totals[0])
+		status.Failures = parseCount(totals[1])
+		status.SlowCalls = parseCount(totals[2])
+		return status
+	}
+
+	windowSize := defaultWindowSize
+	var policy types.CircuitBreakerConfig
+	if err := json.Unmarshal([]byte(policyCmd.Val()), &policy); err == nil && policy.WindowSize > 0 {
+		windowSize = policy.WindowSize
+	}
+	oldest := time.Now().Unix() - int64(windowSize)
+
+	for field, value := range bucketsCmd.Val() {
+		bucket, kind, _ := strings.Cut(field, ":")
+		if second, err := strconv.ParseInt(bucket, 10, 64); err != nil || second <= oldest {
+			continue
+		}
+		n, _ := strconv.ParseInt(value, 10, 64)
+		switch kind {
+		case "c":
+			status.Calls += n
+		case "f":
+			status.Failures += n
+		case "s":
+			status.SlowCalls += n
+		}
+	}
+	return status
+}
+
+func (ch *CircuitBreakerHandler) publish(ctx context.Context, name, from, to, reason string) {
+	event, _ := json.Marshal(types.CircuitEvent{
+		Service: name,
+		From:    from,
+		To:      to,
+		Reason:  reason,
+		At:      time.Now(),
+	})
+
+	if err := ch.storage.Publish(ctx, CircuitEventsChannel, event).Err(); err != nil {
+		ch.log.Error("failed to publish circuit event", "error", err)
+	}
+}
+
+func parseCount(value interface{}) int64 {
+	s, _ := value.(string)
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
+
+// breakerKey and windowKeys mirror the gateway's circuit breaker keys
+func breakerKey(name string) string {
+	return redisKey("circuit", name, "breaker")
+}
+
+func windowKeys(name string) []string {
+	return []string{
+		redisKey("circuit", name, "calls"),
+		redisKey("circuit", name, "calls", "totals"),
+		redisKey("circuit", name, "buckets"),
+	}
+}
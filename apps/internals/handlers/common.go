@@ -1,8 +1,96 @@
 package handlers
 
-import "strings"
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/redis/go-redis/v9"
+	"github.com/chann44/ikyk/pkg/logger"
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+// RegistryEventsChannel is watched by the gateways to refresh their route tables
+const RegistryEventsChannel = "registry:events"
 
 // redisKey creates a Redis key from multiple parts
 func redisKey(parts ...string) string {
 	return strings.Join(parts, ":")
 }
+
+// pathParam returns the URL-escaped route path captured by a {path} segment,
+// e.g. /api/routes/%2Fusers%2Fv1 -> /users/v1
+func pathParam(r *http.Request) string {
+	raw := chi.URLParam(r, "path")
+	path, err := url.PathUnescape(raw)
+	if err != nil {
+		return raw
+	}
+	return path
+}
+
+// publishRegistryEvent tells the gateways that path changed so they reload
+// their in-memory route tables
+func publishRegistryEvent(ctx context.Context, storage *redis.Client, log *logger.Logger, eventType, path string) {
+	event, _ := json.Marshal(types.RegistryEvent{
+		Type: eventType,
+		Path: path,
+		At:   time.Now(),
+	})
+
+	if err := storage.Publish(ctx, RegistryEventsChannel, event).Err(); err != nil {
+		log.Error("failed to publish registry event", "error", err)
+	}
+}
+
+// publishServiceEvent tells the gateways that a service-wide setting, such
+// as its circuit breaker policy, changed
+func publishServiceEvent(ctx context.Context, storage *redis.Client, log *logger.Logger, eventType, service string) {
+	event, _ := json.Marshal(types.RegistryEvent{
+		Type:    eventType,
+		Service: service,
+		At:      time.Now(),
+	})
+
+	if err := storage.Publish(ctx, RegistryEventsChannel, event).Err(); err != nil {
+		log.Error("failed to publish registry event", "error", err)
+	}
+}
+
+// serviceNames lists every service registered under any path, sorted
+func serviceNames(ctx context.Context, storage *redis.Client) ([]string, error) {
+	paths, err := storage.SMembers(ctx, "registry:paths").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, path := range paths {
+		members, _ := storage.SMembers(ctx, redisKey("registry:path", path, "services")).Result()
+		for _, name := range members {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// serviceExists reports whether name is registered under any path
+func serviceExists(ctx context.Context, storage *redis.Client, name string) bool {
+	paths, _ := storage.SMembers(ctx, "registry:paths").Result()
+	for _, path := range paths {
+		if storage.SIsMember(ctx, redisKey("registry:path", path, "services"), name).Val() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+const maxDescriptorSetSize = 4 << 20
+
+// describeDescriptorSet checks that data is a complete FileDescriptorSet and
+// lists the unary gRPC methods it defines
+func describeDescriptorSet(data []byte) ([]string, error) {
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid descriptor set: %v", err)
+	}
+
+	// Fails on missing imports, so sets must be built with --include_imports
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set: %v", err)
+	}
+
+	methods := []string{}
+	files.RangeFiles(func(file protoreflect.FileDescriptor) bool {
+		services := file.Services()
+		for i := 0; i < services.Len(); i++ {
+			list := services.Get(i).Methods()
+			for j := 0; j < list.Len(); j++ {
+				method := list.Get(j)
+				if method.IsStreamingClient() || method.IsStreamingServer() {
+					continue
+				}
+				methods = append(methods, string(method.FullName()))
+			}
+		}
+		return true
+	})
+
+	if len(methods) == 0 {
+		return nil, errors.New("descriptor set defines no unary gRPC methods")
+	}
+	return methods, nil
+}
@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/redis/go-redis/v9"
+	"github.com/chann44/ikyk/pkg/logger"
+	"github.com/chann44/ikyk/pkg/types"
+	"github.com/chann44/ikyk/pkg/utils"
+)
+
+type RouteHandler struct {
+	storage *redis.Client
+	log     *logger.Logger
+}
+
+func NewRouteHandler(storage *redis.Client, log *logger.Logger) *RouteHandler {
+	return &RouteHandler{
+		storage: storage,
+		log:     log,
+	}
+}
+
+func (rh *RouteHandler) ListRoutes(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	paths, err := rh.storage.SMembers(ctx, "registry:routes").Result()
+	if err != nil {
+		utils.ErrorResponse(w, "Failed to list routes", http.StatusInternalServerError)
+		return
+	}
+
+	routes := []types.RouteConfig{}
+	for _, path := range paths {
+		config, err := rh.loadRouteConfig(ctx, path)
+		if err != nil {
+			rh.log.Error("failed to load route config", "path", path, "error", err)
+			continue
+		}
+		routes = append(routes, *config)
+	}
+
+	utils.JSONResponse(w, routes, http.StatusOK)
+}
+
+func (rh *RouteHandler) GetRoute(w http.ResponseWriter, r *http.Request) {
+	path := pathParam(r)
+	ctx := r.Context()
+
+	exists := rh.storage.SIsMember(ctx, "registry:routes", path)
+	if !exists.Val() {
+		utils.ErrorResponse(w, "Route config not found", http.StatusNotFound)
+		return
+	}
+
+	config, err := rh.loadRouteConfig(ctx, path)
+	if err != nil {
+		utils.ErrorResponse(w, "Failed to get route config", http.StatusInternalServerError)
+		return
+	}
+
+	utils.JSONResponse(w, config, http.StatusOK)
+}
+
+// PutRoute replaces every policy of a route
+func (rh *RouteHandler) PutRoute(w http.ResponseWriter, r *http.Request) {
+	var config types.RouteConfig
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		utils.ErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	config.Path = pathParam(r)
+	if err := utils.ValidateRouteConfig(&config); err != nil {
+		utils.ErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fields, err := utils.ToHashFields(&config, "path")
+	if err != nil {
+		utils.ErrorResponse(w, "Invalid route config", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	configKey := redisKey("registry:path", config.Path, "config")
+
+	pipe := rh.storage.TxPipeline()
+	pipe.Del(ctx, configKey)
+	if len(fields) > 0 {
+		pipe.HSet(ctx, configKey, fields)
+	}
+	pipe.SAdd(ctx, "registry:routes", config.Path)
+	if _, err := pipe.Exec(ctx); err != nil {
+		utils.ErrorResponse(w, "Failed to save route config", http.StatusInternalServerError)
+		return
+	}
+
+	rh.log.Info("route config saved", "path", config.Path)
+	publishRegistryEvent(ctx, rh.storage, rh.log, "route_updated", config.Path)
+	utils.SuccessResponse(w, "Route config saved successfully", config)
+}
+
+func (rh *RouteHandler) DeleteRoute(w http.ResponseWriter, r *http.Request) {
+	path := pathParam(r)
+	ctx := r.Context()
+
+	pipe := rh.storage.TxPipeline()
+	removed := pipe.SRem(ctx, "registry:routes", path)
+	pipe.Del(ctx, redisKey("registry:path", path, "config"))
+	if _, err := pipe.Exec(ctx); err != nil {
+		utils.ErrorResponse(w, "Failed to delete route config", http.StatusInternalServerError)
+		return
+	}
+
+	if removed.Val() == 0 {
+		utils.ErrorResponse(w, "Route config not found", http.StatusNotFound)
+		return
+	}
+
+	rh.log.Info("route config deleted", "path", path)
+	publishRegistryEvent(ctx, rh.storage, rh.log, "route_deleted", path)
+	utils.SuccessResponse(w, "Route config deleted successfully", nil)
+}
+
+// PutRoutePolicy sets a single policy (e.g. "balancer") on a route, leaving
+// the others untouched
+func (rh *RouteHandler) PutRoutePolicy(w http.ResponseWriter, r *http.Request) {
+	path := pathParam(r)
+	policy := chi.URLParam(r, "policy")
+	ctx := r.Context()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil || !json.Valid(body) {
+		utils.ErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	config, err := rh.mergePolicy(ctx, path, policy, body)
+	if err != nil {
+		utils.ErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pipe := rh.storage.TxPipeline()
+	pipe.HSet(ctx, redisKey("registry:path", path, "config"), policy, string(body))
+	pipe.SAdd(ctx, "registry:routes", path)
+	if _, err := pipe.Exec(ctx); err != nil {
+		utils.ErrorResponse(w, "Failed to save route policy", http.StatusInternalServerError)
+		return
+	}
+
+	rh.log.Info("route policy saved", "path", path, "policy", policy)
+	publishRegistryEvent(ctx, rh.storage, rh.log, "route_updated", path)
+	utils.SuccessResponse(w, "Route policy saved successfully", config)
+}
+
+func (rh *RouteHandler) DeleteRoutePolicy(w http.ResponseWriter, r *http.Request) {
+	path := pathParam(r)
+	policy := chi.URLParam(r, "policy")
+	ctx := r.Context()
+
+	result := rh.storage.HDel(ctx, redisKey("registry:path", path, "config"), policy)
+	if result.Val() == 0 {
+		utils.ErrorResponse(w, "Route policy not found", http.StatusNotFound)
+		return
+	}
+
+	rh.log.Info("route policy deleted", "path", path, "policy", policy)
+	publishRegistryEvent(ctx, rh.storage, rh.log, "route_updated", path)
+	utils.SuccessResponse(w, "Route policy deleted successfully", nil)
+}
+
+// PutRouteDescriptors stores a compiled FileDescriptorSet (protoc
+// --include_imports --descriptor_set_out) whose google.api.http annotations
+// the gateway transcodes to gRPC calls
+func (rh *RouteHandler) PutRouteDescriptors(w http.ResponseWriter, r *http.Request) {
+	path := pathParam(r)
+	ctx := r.Context()
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxDescriptorSetSize))
+	if err != nil || len(body) == 0 {
+		utils.ErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	methods, err := describeDescriptorSet(body)
+	if err != nil {
+		utils.ErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := rh.storage.Set(ctx, redisKey("registry:path", path, "descriptors"), body, 0).Err(); err != nil {
+		utils.ErrorResponse(w, "Failed to save descriptor set", http.StatusInternalServerError)
+		return
+	}
+
+	rh.log.Info("route descriptor set saved", "path", path, "methods", len(methods))
+	publishRegistryEvent(ctx, rh.storage, rh.log, "route_updated", path)
+	utils.SuccessResponse(w, "Descriptor set saved successfully", map[string]interface{}{
+		"path":    path,
+		"methods": methods,
+	})
+}
+
+// GetRouteDescriptors returns the stored descriptor set as uploaded
+func (rh *RouteHandler) GetRouteDescriptors(w http.ResponseWriter, r *http.Request) {
+	path := pathParam(r)
+
+	data, err := rh.storage.Get(r.Context(), redisKey("registry:path", path, "descriptors")).Bytes()
+	if err == redis.Nil {
+		utils.ErrorResponse(w, "Descriptor set not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.ErrorResponse(w, "Failed to get descriptor set", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (rh *RouteHandler) DeleteRouteDescriptors(w http.ResponseWriter, r *http.Request) {
+	path := pathParam(r)
+	ctx := r.Context()
+
+	result := rh.storage.Del(ctx, redisKey("registry:path", path, "descriptors"))
+	if result.Val() == 0 {
+		utils.ErrorResponse(w, "Descriptor set not found", http.StatusNotFound)
+		return
+	}
+
+	rh.log.Info("route descriptor set deleted", "path", path)
+	publishRegistryEvent(ctx, rh.storage, rh.log, "route_updated", path)
+	utils.SuccessResponse(w, "Descriptor set deleted successfully", nil)
+}
+
+// mergePolicy applies policy on top of the stored config and validates the result
+func (rh *RouteHandler) mergePolicy(ctx context.Context, path, policy string, value []byte) (*types.RouteConfig, error) {
+	if policy == "path" {
+		return nil, fmt.Errorf("unknown route policy: %s", policy)
+	}
+
+	fields, err := rh.storage.HGetAll(ctx, redisKey("registry:path", path, "config")).Result()
+	if err != nil {
+		return nil, err
+	}
+	fields[policy] = string(value)
+
+	raw := make(map[string]json.RawMessage, len(fields))
+	for key, field := range fields {
+		raw[key] = json.RawMessage(field)
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &types.RouteConfig{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("invalid route policy %s: %v", policy, err)
+	}
+	config.Path = path
+
+	if err := utils.ValidateRouteConfig(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (rh *RouteHandler) loadRouteConfig(ctx context.Context, path string) (*types.RouteConfig, error) {
+	fields, err := rh.storage.HGetAll(ctx, redisKey("registry:path", path, "config")).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &types.RouteConfig{}
+	if err := utils.FromHashFields(fields, config); err != nil {
+		return nil, err
+	}
+	config.Path = path
+	return config, nil
+}
@@ -81,6 +81,7 @@ func (sh *ServiceHandler) CreateService(w http.ResponseWriter, r *http.Request)
 	}
 
 	sh.log.Info("service created", "name", req.Name, "path", req.Path)
+	publishRegistryEvent(ctx, sh.storage, sh.log, "service_added", req.Path)
 	utils.SuccessResponse(w, "Service created successfully", map[string]string{
 		"name": req.Name,
 		"path": req.Path,
@@ -182,6 +183,7 @@ func (sh *ServiceHandler) DeleteService(w http.ResponseWriter, r *http.Request)
 			}
 
 			sh.log.Info("service deleted", "name", name, "path", path)
+			publishRegistryEvent(ctx, sh.storage, sh.log, "service_removed", path)
 			utils.SuccessResponse(w, "Service deleted successfully", nil)
 			return
 		}
@@ -189,3 +191,77 @@ func (sh *ServiceHandler) DeleteService(w http.ResponseWriter, r *http.Request)
 
 	utils.ErrorResponse(w, "Service not found", http.StatusNotFound)
 }
+
+// GetCircuitBreaker returns the breaker policy stored for a service
+func (sh *ServiceHandler) GetCircuitBreaker(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	data, err := sh.storage.Get(r.Context(), redisKey("registry:service", name, "circuit")).Result()
+	if err == redis.Nil {
+		utils.ErrorResponse(w, "Circuit breaker config not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.ErrorResponse(w, "Failed to get circuit breaker config", http.StatusInternalServerError)
+		return
+	}
+
+	var config types.CircuitBreakerConfig
+	if err := json.Unmarshal([]byte(data), &config); err != nil {
+		utils.ErrorResponse(w, "Failed to get circuit breaker config", http.StatusInternalServerError)
+		return
+	}
+
+	utils.JSONResponse(w, config, http.StatusOK)
+}
+
+// PutCircuitBreaker replaces the breaker policy of a service; set enabled to
+// false to turn its breaker off
+func (sh *ServiceHandler) PutCircuitBreaker(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	ctx := r.Context()
+
+	var config types.CircuitBreakerConfig
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		utils.ErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.ValidateCircuitBreakerConfig(&config); err != nil {
+		utils.ErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !serviceExists(ctx, sh.storage, name) {
+		utils.ErrorResponse(w, "Service not found", http.StatusNotFound)
+		return
+	}
+
+	data, _ := json.Marshal(config)
+	if err := sh.storage.Set(ctx, redisKey("registry:service", name, "circuit"), data, 0).Err(); err != nil {
+		utils.ErrorResponse(w, "Failed to save circuit breaker config", http.StatusInternalServerError)
+		return
+	}
+
+	sh.log.Info("circuit breaker config saved", "service", name, "enabled", config.Enabled == nil || *config.Enabled)
+	publishServiceEvent(ctx, sh.storage, sh.log, "circuit_breaker_updated", name)
+	utils.SuccessResponse(w, "Circuit breaker config saved successfully", config)
+}
+
+// DeleteCircuitBreaker puts a service back on the gateway's default breaker
+func (sh *ServiceHandler) DeleteCircuitBreaker(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	ctx := r.Context()
+
+	result := sh.storage.Del(ctx, redisKey("registry:service", name, "circuit"))
+	if result.Val() == 0 {
+		utils.ErrorResponse(w, "Circuit breaker config not found", http.StatusNotFound)
+		return
+	}
+
+	sh.log.Info("circuit breaker config deleted", "service", name)
+	publishServiceEvent(ctx, sh.storage, sh.log, "circuit_breaker_updated", name)
+	utils.SuccessResponse(w, "Circuit breaker config deleted successfully", nil)
+}
@@ -33,7 +33,7 @@ func SetupManagementAPI(log *logger.Logger) http.Handler {
 	// Initialize storage
 	redisClient, err := NewRedisClient(redisAddr, RegistryPassword, RegistryDB)
 	if err != nil {
-		log.Error("failed to create redis client: %v", err)
+		log.Error("failed to create redis client", "error", err)
 		panic(fmt.Sprintf("Cannot start without Redis connection: %v", err))
 	}
 
@@ -42,6 +42,9 @@ func SetupManagementAPI(log *logger.Logger) http.Handler {
 	authHandler := handlers.NewAuthHandler(redisClient.Client, log)
 	metricsHandler := handlers.NewMetricsHandler(redisClient.Client, log)
 	healthHandler := handlers.NewHealthHandler(redisClient.Client, log)
+	routeHandler := handlers.NewRouteHandler(redisClient.Client, log)
+	cacheHandler := handlers.NewCacheHandler(redisClient.Client, log)
+	circuitBreakerHandler := handlers.NewCircuitBreakerHandler(redisClient.Client, log)
 
 	// Service management
 	r.Route("/api/services", func(r chi.Router) {
@@ -49,6 +52,34 @@ func SetupManagementAPI(log *logger.Logger) http.Handler {
 		r.Post("/", serviceHandler.CreateService)
 		r.Get("/{name}", serviceHandler.GetService)
 		r.Delete("/{name}", serviceHandler.DeleteService)
+		r.Get("/{name}/circuit-breaker", serviceHandler.GetCircuitBreaker)
+		r.Put("/{name}/circuit-breaker", serviceHandler.PutCircuitBreaker)
+		r.Delete("/{name}/circuit-breaker", serviceHandler.DeleteCircuitBreaker)
+	})
+
+	// Route policies; {path} is the URL-escaped registry path, e.g. %2Fusers
+	r.Route("/api/routes", func(r chi.Router) {
+		r.Get("/", routeHandler.ListRoutes)
+		r.Get("/{path}", routeHandler.GetRoute)
+		r.Put("/{path}", routeHandler.PutRoute)
+		r.Delete("/{path}", routeHandler.DeleteRoute)
+		r.Get("/{path}/descriptors", routeHandler.GetRouteDescriptors)
+		r.Put("/{path}/descriptors", routeHandler.PutRouteDescriptors)
+		r.Delete("/{path}/descriptors", routeHandler.DeleteRouteDescriptors)
+		r.Put("/{path}/{policy}", routeHandler.PutRoutePolicy)
+		r.Delete("/{path}/{policy}", routeHandler.DeleteRoutePolicy)
+	})
+
+	// Response cache
+	r.Post("/api/cache/purge", cacheHandler.PurgeCache)
+
+	// Circuit breaker state; policies live under /api/services/{name}/circuit-breaker
+	r.Route("/api/circuit-breakers", func(r chi.Router) {
+		r.Get("/", circuitBreakerHandler.ListCircuitBreakers)
+		r.Get("/{name}", circuitBreakerHandler.GetCircuitBreaker)
+		r.Post("/{name}/open", circuitBreakerHandler.ForceOpen)
+		r.Post("/{name}/close", circuitBreakerHandler.ForceClose)
+		r.Post("/{name}/reset", circuitBreakerHandler.ResetCircuitBreaker)
 	})
 
 	// Auth configuration
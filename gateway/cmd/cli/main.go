@@ -21,5 +21,7 @@ func main() {
 		Name:        "ikyk",
 		Port:        port,
 		Environment: env,
+		TLSCertFile: os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:  os.Getenv("TLS_KEY_FILE"),
 	}, internals.SetupGateway)
 }
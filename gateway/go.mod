@@ -1,14 +1,17 @@
 module github.com/chann44/ikyk/gateway
 
-go 1.23
+go 1.24.0
 
 replace github.com/chann44/ikyk/pkg => ../pkg
 
 require (
+	github.com/alicebob/miniredis/v2 v2.39.0
 	github.com/chann44/ikyk/pkg v0.0.0
 	github.com/go-chi/chi/v5 v5.2.3
 	github.com/prometheus/client_golang v1.23.2
 	github.com/redis/go-redis/v9 v9.17.2
+	google.golang.org/genproto/googleapis/api v0.0.0-20250519155744-55703ea1f237
+	google.golang.org/protobuf v1.36.8
 )
 
 require (
@@ -20,7 +23,7 @@ require (
 	github.com/prometheus/client_model v0.6.2 // indirect
 	github.com/prometheus/common v0.66.1 // indirect
 	github.com/prometheus/procfs v0.16.1 // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
 	go.yaml.in/yaml/v2 v2.4.2 // indirect
 	golang.org/x/sys v0.35.0 // indirect
-	google.golang.org/protobuf v1.36.8 // indirect
 )
@@ -0,0 +1,124 @@
+package internals
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chann44/ikyk/pkg/logger"
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+const defaultAffinityCookie = "ikyk_affinity"
+
+// SessionAffinity issues and verifies signed cookies that pin a client to
+// one service of a route
+type SessionAffinity struct {
+	secret []byte
+	log    *logger.Logger
+}
+
+// NewSessionAffinity signs cookies with secret. An empty secret generates a
+// random one, which only works while a single gateway replica is running.
+func NewSessionAffinity(secret string, log *logger.Logger) *SessionAffinity {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		rand.Read(key)
+		log.Warn("AFFINITY_SECRET not set, using a random key; sticky sessions will not survive restarts or span replicas")
+	}
+
+	return &SessionAffinity{
+		secret: key,
+		log:    log,
+	}
+}
+
+// Pinned returns the service the client is pinned to for path, or "" if the
+// request carries no valid affinity cookie
+func (sa *SessionAffinity) Pinned(r *http.Request, path string, config *types.AffinityConfig) string {
+	name := cookieName(config)
+	for _, cookie := range r.Cookies() {
+		if cookie.Name != name {
+			continue
+		}
+		if service, ok := sa.verify(cookie.Value, path); ok {
+			return service
+		}
+	}
+	return ""
+}
+
+// Pin sets the affinity cookie for path on the response
+func (sa *SessionAffinity) Pin(w http.ResponseWriter, r *http.Request, path, serviceName string, config *types.AffinityConfig) {
+	var expires int64
+	if config.TTL > 0 {
+		expires = time.Now().Add(config.TTL).Unix()
+	}
+
+	cookie := &http.Cookie{
+		Name:     cookieName(config),
+		Value:    sa.sign(serviceName, path, expires),
+		Path:     path,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	}
+	if config.TTL > 0 {
+		cookie.MaxAge = int(config.TTL.Seconds())
+	}
+
+	http.SetCookie(w, cookie)
+}
+
+func (sa *SessionAffinity) sign(serviceName, path string, expires int64) string {
+	payload := serviceName + "|" + path + "|" + strconv.FormatInt(expires, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(sa.mac(payload))
+}
+
+func (sa *SessionAffinity) verify(value, path string) (string, bool) {
+	encoded, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return "", false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, sa.mac(string(payload))) {
+		return "", false
+	}
+
+	parts := strings.Split(string(payload), "|")
+	if len(parts) != 3 || parts[1] != path {
+		return "", false
+	}
+
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || (expires > 0 && time.Now().Unix() > expires) {
+		return "", false
+	}
+
+	return parts[0], true
+}
+
+func (sa *SessionAffinity) mac(payload string) []byte {
+	h := hmac.New(sha256.New, sa.secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+func cookieName(config *types.AffinityConfig) string {
+	if config.CookieName != "" {
+		return config.CookieName
+	}
+	return defaultAffinityCookie
+}
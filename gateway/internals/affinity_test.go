@@ -0,0 +1,65 @@
+package internals
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+func TestSessionAffinityRoundTrip(t *testing.T) {
+	sa := NewSessionAffinity("secret", newTestLogger())
+	config := &types.AffinityConfig{Enabled: true, CookieName: "sticky", TTL: time.Hour}
+
+	w := httptest.NewRecorder()
+	sa.Pin(w, httptest.NewRequest(http.MethodGet, "/api", nil), "/api", "svc-b", config)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Pin() set %d cookies, want 1", len(cookies))
+	}
+	cookie := cookies[0]
+	if cookie.Name != "sticky" || cookie.Path != "/api" || !cookie.HttpOnly || cookie.MaxAge != 3600 {
+		t.Errorf("cookie = %+v", cookie)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/items", nil)
+	r.AddCookie(cookie)
+	if got := sa.Pinned(r, "/api", config); got != "svc-b" {
+		t.Errorf("Pinned() = %q, want svc-b", got)
+	}
+}
+
+func TestSessionAffinityRejects(t *testing.T) {
+	sa := NewSessionAffinity("secret", newTestLogger())
+	valid := sa.sign("svc", "/api", 0)
+	encoded, signature, _ := strings.Cut(valid, ".")
+
+	tests := []struct {
+		name  string
+		value string
+		path  string
+	}{
+		{"other path", valid, "/other"},
+		{"expired", sa.sign("svc", "/api", time.Now().Add(-time.Minute).Unix()), "/api"},
+		{"other secret", NewSessionAffinity("other", newTestLogger()).sign("svc", "/api", 0), "/api"},
+		{"tampered payload", base64.RawURLEncoding.EncodeToString([]byte("evil|/api|0")) + "." + signature, "/api"},
+		{"unsigned", encoded, "/api"},
+		{"not base64", "!!!." + signature, "/api"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if service, ok := sa.verify(tt.value, tt.path); ok {
+				t.Errorf("verify() accepted %q for %s", tt.value, service)
+			}
+		})
+	}
+
+	if service, ok := sa.verify(valid, "/api"); !ok || service != "svc" {
+		t.Errorf("verify() = %q, %v for a valid cookie", service, ok)
+	}
+}
@@ -0,0 +1,198 @@
+package internals
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultAggregateTimeout = 5 * time.Second
+
+type aggregateCallKey struct{}
+
+// callResult is the outcome of one aggregated call
+type callResult struct {
+	key      string
+	response *bufferedResponse
+	err      string
+}
+
+// aggregate fans the route's calls out through the gateway in parallel and
+// merges their JSON responses under their keys. Calls that fail or time out
+// are reported under "_errors" instead of failing the whole response.
+func (g *Gateway) aggregate(w http.ResponseWriter, r *http.Request, route *RouteMatch) {
+	if r.Context().Value(aggregateCallKey{}) != nil {
+		http.Error(w, "Aggregate routes cannot be nested", http.StatusLoopDetected)
+		return
+	}
+
+	config := route.Config.Aggregate
+	results := make([]callResult, len(config.Calls))
+
+	var wg sync.WaitGroup
+	for i, call := range config.Calls {
+		timeout := call.Timeout
+		if timeout == 0 {
+			timeout = config.Timeout
+		}
+		if timeout == 0 {
+			timeout = defaultAggregateTimeout
+		}
+
+		wg.Add(1)
+		go func(i int, key, method, path string, timeout time.Duration) {
+			defer wg.Done()
+			results[i] = g.aggregateCall(r, route, key, method, path, timeout)
+		}(i, call.Key, call.Method, call.Path, timeout)
+	}
+	wg.Wait()
+
+	merged := make(map[string]json.RawMessage, len(results)+1)
+	failures := make(map[string]interface{})
+	for _, result := range results {
+		if result.err != "" {
+			failures[result.key] = map[string]interface{}{"error": result.err}
+			continue
+		}
+
+		response := result.response
+		if response.status >= http.StatusBadRequest {
+			failures[result.key] = map[string]interface{}{
+				"status": response.status,
+				"error":  response.payload(),
+			}
+			continue
+		}
+		merged[result.key] = response.payload()
+	}
+
+	status := http.StatusOK
+	if len(failures) > 0 {
+		data, _ := json.Marshal(failures)
+		merged["_errors"] = data
+		if len(failures) == len(results) {
+			status = http.StatusBadGateway
+		}
+		g.log.Warn("aggregate call failures", "path", r.URL.Path, "failed", len(failures), "calls", len(results))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(merged)
+}
+
+func (g *Gateway) aggregateCall(r *http.Request, route *RouteMatch, key, method, path string, timeout time.Duration) callResult {
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithValue(r.Context(), aggregateCallKey{}, key), timeout)
+	defer cancel()
+
+	target := templateParam.ReplaceAllStringFunc(path, func(token string) string {
+		return route.Params[token[1:len(token)-1]]
+	})
+
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return callResult{key: key, err: err.Error()}
+	}
+
+	// The call acts on behalf of the client: same credentials, host and address
+	req.Header = r.Header.Clone()
+	req.Header.Del("Content-Length")
+	req.Header.Del("Accept-Encoding") // Responses have to be readable to be merged
+	req.Header.Del("Upgrade")
+	req.Header.Del("Connection")
+	req.Host = r.Host
+	req.RemoteAddr = r.RemoteAddr
+	req.TLS = r.TLS
+
+	response := newBufferedResponse()
+	done := make(chan struct{})
+	var panicked bool
+	go func() {
+		defer close(done)
+		// Nothing recovers in this goroutine, so a panicking call would take
+		// the gateway down; it fails on its own instead
+		defer func() {
+			if p := recover(); p != nil {
+				g.log.Error("aggregate call panicked", "key", key, "path", target, "panic", p)
+				panicked = true
+			}
+		}()
+		g.handler().ServeHTTP(response, req)
+	}()
+
+	select {
+	case <-done:
+		if panicked {
+			return callResult{key: key, err: "internal error"}
+		}
+		return callResult{key: key, response: response}
+	case <-ctx.Done():
+		// The call keeps its own writer, so it can finish in the background
+		return callResult{key: key, err: "timeout after " + timeout.String()}
+	}
+}
+
+// handler is the full request chain (auth, rate limiting, metrics and
+// proxying) that aggregated calls go through
+func (g *Gateway) handler() http.Handler {
+	if g.chain != nil {
+		return g.chain
+	}
+	return http.HandlerFunc(g.ProxyHandler)
+}
+
+// SetHandler registers the middleware chain in front of ProxyHandler, so
+// calls made by the gateway itself are authenticated like any other request
+func (g *Gateway) SetHandler(chain http.Handler) {
+	g.chain = chain
+}
+
+// bufferedResponse records a response in memory
+type bufferedResponse struct {
+	header      http.Header
+	status      int
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+}
+
+func (br *bufferedResponse) Header() http.Header {
+	return br.header
+}
+
+func (br *bufferedResponse) WriteHeader(status int) {
+	if br.wroteHeader {
+		return
+	}
+	br.status = status
+	br.wroteHeader = true
+}
+
+func (br *bufferedResponse) Write(p []byte) (int, error) {
+	br.WriteHeader(http.StatusOK)
+	return br.body.Write(p)
+}
+
+// payload is the body as JSON: as-is for JSON responses, as a string otherwise
+func (br *bufferedResponse) payload() json.RawMessage {
+	mediaType, _, _ := mime.ParseMediaType(br.header.Get("Content-Type"))
+	body := br.body.Bytes()
+	if (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) && json.Valid(body) {
+		return body
+	}
+
+	data, _ := json.Marshal(strings.TrimSpace(string(body)))
+	return data
+}
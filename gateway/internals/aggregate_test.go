@@ -0,0 +1,53 @@
+package internals
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+func TestAggregateRecoversPanickingCall(t *testing.T) {
+	g, _ := newTestGateway(t, "http://127.0.0.1:1", true, &types.RouteConfig{})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":1}`))
+	})
+	mux.HandleFunc("/boom", func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	g.SetHandler(mux)
+
+	config := &types.RouteConfig{Aggregate: &types.AggregateConfig{Calls: []types.AggregateCall{
+		{Key: "user", Path: "/ok"},
+		{Key: "orders", Path: "/boom"},
+	}}}
+	route, err := newRoute("/combined", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	g.aggregate(w, httptest.NewRequest(http.MethodGet, "/combined", nil), &RouteMatch{Route: route})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var body struct {
+		User   map[string]int               `json:"user"`
+		Errors map[string]map[string]string `json:"_errors"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid body %q: %v", w.Body.String(), err)
+	}
+	if body.User["id"] != 1 {
+		t.Errorf("user = %v, want the successful call's payload", body.User)
+	}
+	if body.Errors["orders"]["error"] != "internal error" {
+		t.Errorf("_errors = %v, want the panicking call reported", body.Errors)
+	}
+}
@@ -14,6 +14,28 @@ import (
 	"github.com/chann44/ikyk/pkg/types"
 )
 
+type consumerContextKey struct{}
+
+// ConsumerFromContext returns the authenticated consumer of a request, or ""
+// when the route does not identify its callers
+func ConsumerFromContext(ctx context.Context) string {
+	consumer, _ := ctx.Value(consumerContextKey{}).(string)
+	return consumer
+}
+
+// withConsumer identifies API key callers by a digest of their key, so the
+// key itself never reaches logs or upstream headers
+func withConsumer(r *http.Request) *http.Request {
+	apiKey := requestAPIKey(r)
+	if apiKey == "" {
+		return r
+	}
+
+	hash := sha256.Sum256([]byte(apiKey))
+	consumer := "key-" + hex.EncodeToString(hash[:])[:12]
+	return r.WithContext(context.WithValue(r.Context(), consumerContextKey{}, consumer))
+}
+
 type AuthManager struct {
 	storage *RedisClient
 	log     *logger.Logger
@@ -43,7 +65,7 @@ func (am *AuthManager) Middleware(next http.Handler) http.Handler {
 		// Check cache first
 		cacheKey := am.getCacheKey(r, path)
 		if am.isCached(ctx, cacheKey) {
-			next.ServeHTTP(w, r)
+			next.ServeHTTP(w, withConsumer(r))
 			return
 		}
 
@@ -67,15 +89,22 @@ func (am *AuthManager) Middleware(next http.Handler) http.Handler {
 		// Cache the validation result
 		am.cacheValidation(ctx, cacheKey)
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, withConsumer(r))
 	})
 }
 
-func (am *AuthManager) validateAPIKey(r *http.Request, config *types.AuthConfig) bool {
+// requestAPIKey reads the key from X-API-Key or, for clients that cannot set
+// headers such as browser WebSocket handshakes, the api_key query param
+func requestAPIKey(r *http.Request) string {
 	apiKey := r.Header.Get("X-API-Key")
 	if apiKey == "" {
 		apiKey = r.URL.Query().Get("api_key")
 	}
+	return apiKey
+}
+
+func (am *AuthManager) validateAPIKey(r *http.Request, config *types.AuthConfig) bool {
+	apiKey := requestAPIKey(r)
 
 	for _, validKey := range config.APIKeys {
 		if apiKey == validKey {
@@ -97,7 +126,7 @@ func (am *AuthManager) validateCustomHeaders(r *http.Request, config *types.Auth
 }
 
 func (am *AuthManager) getCacheKey(r *http.Request, path string) string {
-	apiKey := r.Header.Get("X-API-Key")
+	apiKey := requestAPIKey(r)
 	hash := sha256.Sum256([]byte(apiKey + path))
 	return "auth:cache:" + hex.EncodeToString(hash[:])
 }
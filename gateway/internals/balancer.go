@@ -0,0 +1,277 @@
+package internals
+
+import (
+	"hash/crc32"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+const (
+	StrategyRoundRobin     = "round_robin"
+	StrategyLeastConn      = "least_conn"
+	StrategyP2CEWMA        = "p2c_ewma"
+	StrategyConsistentHash = "consistent_hash"
+)
+
+// Balancer picks one service out of the healthy services registered for a path.
+// services is never empty.
+type Balancer interface {
+	Pick(r *http.Request, path string, services []*types.Service, config *types.BalancerConfig) *types.Service
+}
+
+func newBalancers(loads *LoadTracker) map[string]Balancer {
+	roundRobin := &RoundRobinBalancer{}
+	return map[string]Balancer{
+		StrategyRoundRobin:     roundRobin,
+		StrategyLeastConn:      &LeastConnBalancer{loads: loads},
+		StrategyP2CEWMA:        &P2CEWMABalancer{loads: loads},
+		StrategyConsistentHash: &ConsistentHashBalancer{fallback: roundRobin, rings: make(map[string]*hashRing)},
+	}
+}
+
+// RoundRobinBalancer cycles through services with an in-process counter per path
+type RoundRobinBalancer struct {
+	counters sync.Map // path -> *atomic.Uint64
+}
+
+func (b *RoundRobinBalancer) Pick(r *http.Request, path string, services []*types.Service, config *types.BalancerConfig) *types.Service {
+	counter, _ := b.counters.LoadOrStore(path, new(atomic.Uint64))
+	index := counter.(*atomic.Uint64).Add(1) - 1
+	return services[index%uint64(len(services))]
+}
+
+// LeastConnBalancer picks the service with the fewest outstanding requests
+type LeastConnBalancer struct {
+	loads *LoadTracker
+}
+
+func (b *LeastConnBalancer) Pick(r *http.Request, path string, services []*types.Service, config *types.BalancerConfig) *types.Service {
+	// Start at a random offset so ties don't always land on the same service
+	offset := rand.IntN(len(services))
+
+	var best *types.Service
+	var bestInflight int64
+	for i := range services {
+		service := services[(offset+i)%len(services)]
+		inflight, _ := b.loads.Load(service.Name)
+		if best == nil || inflight < bestInflight {
+			best = service
+			bestInflight = inflight
+		}
+	}
+	return best
+}
+
+// P2CEWMABalancer samples two services at random and keeps the one with the
+// lower latency EWMA weighted by its outstanding requests
+type P2CEWMABalancer struct {
+	loads *LoadTracker
+}
+
+func (b *P2CEWMABalancer) Pick(r *http.Request, path string, services []*types.Service, config *types.BalancerConfig) *types.Service {
+	if len(services) == 1 {
+		return services[0]
+	}
+
+	i := rand.IntN(len(services))
+	j := rand.IntN(len(services) - 1)
+	if j >= i {
+		j++
+	}
+
+	first, second := services[i], services[j]
+	if b.cost(second) < b.cost(first) {
+		return second
+	}
+	return first
+}
+
+func (b *P2CEWMABalancer) cost(service *types.Service) float64 {
+	inflight, ewma := b.loads.Load(service.Name)
+	return ewma * float64(inflight+1)
+}
+
+// ConsistentHashBalancer maps a request key (header, cookie or client IP) onto
+// a hash ring so the same key keeps hitting the same service
+type ConsistentHashBalancer struct {
+	fallback Balancer
+	mu       sync.Mutex
+	rings    map[string]*hashRing
+}
+
+const ringReplicas = 100
+
+// hashRing places service names, not services: the services behind a name
+// are resolved on every pick, so a reload that changes a URL or health state
+// never routes to the old entry
+type hashRing struct {
+	members string
+	hashes  []uint32
+	owners  map[uint32]string
+}
+
+func (b *ConsistentHashBalancer) Pick(r *http.Request, path string, services []*types.Service, config *types.BalancerConfig) *types.Service {
+	key := hashKey(r, config)
+	if key == "" {
+		return b.fallback.Pick(r, path, services, config)
+	}
+
+	ring := b.ring(path, services)
+	hash := crc32.ChecksumIEEE([]byte(key))
+	idx := sort.Search(len(ring.hashes), func(i int) bool { return ring.hashes[i] >= hash })
+	if idx == len(ring.hashes) {
+		idx = 0
+	}
+	owner := ring.owners[ring.hashes[idx]]
+	for _, service := range services {
+		if service.Name == owner {
+			return service
+		}
+	}
+	return b.fallback.Pick(r, path, services, config)
+}
+
+// ring returns the cached ring for path, rebuilding it when membership changed
+func (b *ConsistentHashBalancer) ring(path string, services []*types.Service) *hashRing {
+	names := make([]string, len(services))
+	for i, service := range services {
+		names[i] = service.Name
+	}
+	sort.Strings(names)
+	members := strings.Join(names, ",")
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ring, ok := b.rings[path]; ok && ring.members == members {
+		return ring
+	}
+
+	ring := &hashRing{
+		members: members,
+		hashes:  make([]uint32, 0, len(services)*ringReplicas),
+		owners:  make(map[uint32]string, len(services)*ringReplicas),
+	}
+	for _, name := range names {
+		for i := 0; i < ringReplicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(name + "#" + strconv.Itoa(i)))
+			if _, taken := ring.owners[hash]; taken {
+				continue
+			}
+			ring.owners[hash] = name
+			ring.hashes = append(ring.hashes, hash)
+		}
+	}
+	sort.Slice(ring.hashes, func(i, j int) bool { return ring.hashes[i] < ring.hashes[j] })
+
+	b.rings[path] = ring
+	return ring
+}
+
+func hashKey(r *http.Request, config *types.BalancerConfig) string {
+	if config == nil {
+		return ""
+	}
+
+	switch config.HashOn {
+	case "header":
+		return r.Header.Get(config.HashKey)
+	case "cookie":
+		if cookie, err := r.Cookie(config.HashKey); err == nil {
+			return cookie.Value
+		}
+		return ""
+	case "ip":
+		return clientIP(r)
+	}
+	return ""
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// LoadTracker keeps per-service outstanding request counts and a latency
+// EWMA for the load-aware balancers
+type LoadTracker struct {
+	mu    sync.Mutex
+	stats map[string]*serviceLoad
+}
+
+type serviceLoad struct {
+	inflight   int64
+	ewma       float64 // seconds
+	lastSample time.Time
+}
+
+// ewmaDecay is the time constant for latency samples to fade out
+const ewmaDecay = 10 * time.Second
+
+func NewLoadTracker() *LoadTracker {
+	return &LoadTracker{
+		stats: make(map[string]*serviceLoad),
+	}
+}
+
+func (lt *LoadTracker) get(serviceName string) *serviceLoad {
+	load, ok := lt.stats[serviceName]
+	if !ok {
+		load = &serviceLoad{}
+		lt.stats[serviceName] = load
+	}
+	return load
+}
+
+// Begin marks a request to serviceName as outstanding
+func (lt *LoadTracker) Begin(serviceName string) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.get(serviceName).inflight++
+}
+
+// End completes a request started with Begin and folds its latency into the EWMA
+func (lt *LoadTracker) End(serviceName string, rtt time.Duration) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	load := lt.get(serviceName)
+	if load.inflight > 0 {
+		load.inflight--
+	}
+
+	now := time.Now()
+	sample := rtt.Seconds()
+	if load.lastSample.IsZero() {
+		load.ewma = sample
+	} else {
+		w := math.Exp(-float64(now.Sub(load.lastSample)) / float64(ewmaDecay))
+		load.ewma = load.ewma*w + sample*(1-w)
+	}
+	load.lastSample = now
+}
+
+// Load returns the outstanding requests and latency EWMA (in seconds) for serviceName
+func (lt *LoadTracker) Load(serviceName string) (int64, float64) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	load, ok := lt.stats[serviceName]
+	if !ok {
+		return 0, 0
+	}
+	return load.inflight, load.ewma
+}
@@ -0,0 +1,121 @@
+package internals
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+func testServices(names ...string) []*types.Service {
+	services := make([]*types.Service, len(names))
+	for i, name := range names {
+		services[i] = &types.Service{Name: name, URL: &url.URL{Scheme: "http", Host: name + ":8080"}, Healthy: true}
+	}
+	return services
+}
+
+func hashedRequest(key string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/api", nil)
+	r.Header.Set("X-User", key)
+	return r
+}
+
+var hashOnUser = &types.BalancerConfig{Strategy: StrategyConsistentHash, HashOn: "header", HashKey: "X-User"}
+
+func TestBalancerDistribution(t *testing.T) {
+	loads := NewLoadTracker()
+	balancers := newBalancers(loads)
+	services := testServices("a", "b", "c")
+
+	tests := []struct {
+		name     string
+		strategy string
+		config   *types.BalancerConfig
+		request  func(i int) *http.Request
+		min, max int // Picks per service out of 3000
+	}{
+		{"round robin", StrategyRoundRobin, nil, func(int) *http.Request { return hashedRequest("") }, 1000, 1000},
+		{"least conn idle", StrategyLeastConn, nil, func(int) *http.Request { return hashedRequest("") }, 800, 1200},
+		{"p2c idle", StrategyP2CEWMA, nil, func(int) *http.Request { return hashedRequest("") }, 800, 1200},
+		{"consistent hash", StrategyConsistentHash, hashOnUser, func(i int) *http.Request { return hashedRequest(fmt.Sprintf("user-%d", i)) }, 600, 1400},
+		{"consistent hash without key", StrategyConsistentHash, hashOnUser, func(int) *http.Request { return hashedRequest("") }, 1000, 1000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			picks := make(map[string]int)
+			for i := 0; i < 3000; i++ {
+				picks[balancers[tt.strategy].Pick(tt.request(i), "/"+tt.name, services, tt.config).Name]++
+			}
+			for _, service := range services {
+				if n := picks[service.Name]; n < tt.min || n > tt.max {
+					t.Errorf("%s picked %d times, want %d-%d (%v)", service.Name, n, tt.min, tt.max, picks)
+				}
+			}
+		})
+	}
+}
+
+func TestLeastConnAvoidsBusyServices(t *testing.T) {
+	loads := NewLoadTracker()
+	balancer := &LeastConnBalancer{loads: loads}
+	services := testServices("a", "b", "c")
+	loads.Begin("a")
+	loads.Begin("c")
+
+	for i := 0; i < 20; i++ {
+		if got := balancer.Pick(hashedRequest(""), "/api", services, nil); got.Name != "b" {
+			t.Fatalf("Pick() = %s, want b", got.Name)
+		}
+	}
+}
+
+func TestConsistentHashStickiness(t *testing.T) {
+	balancer := newBalancers(NewLoadTracker())[StrategyConsistentHash]
+	services := testServices("a", "b", "c", "d")
+
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		before[key] = balancer.Pick(hashedRequest(key), "/api", services, hashOnUser).Name
+		if again := balancer.Pick(hashedRequest(key), "/api", services, hashOnUser).Name; again != before[key] {
+			t.Fatalf("%s moved from %s to %s without a membership change", key, before[key], again)
+		}
+	}
+
+	// Dropping a service only moves the keys it owned
+	remaining := services[:3]
+	for key, owner := range before {
+		got := balancer.Pick(hashedRequest(key), "/api", remaining, hashOnUser).Name
+		if owner != "d" && got != owner {
+			t.Errorf("%s moved from %s to %s when d left", key, owner, got)
+		}
+		if got == "d" {
+			t.Errorf("%s still routed to d", key)
+		}
+	}
+}
+
+// A reload that moves a service keeps the ring but must route to the new URL
+func TestConsistentHashFollowsReloadedServices(t *testing.T) {
+	balancer := newBalancers(NewLoadTracker())[StrategyConsistentHash]
+	services := testServices("a", "b")
+	owner := balancer.Pick(hashedRequest("user-1"), "/api", services, hashOnUser)
+
+	reloaded := testServices("a", "b")
+	for _, service := range reloaded {
+		service.URL.Host = service.Name + ":9090"
+	}
+	got := balancer.Pick(hashedRequest("user-1"), "/api", reloaded, hashOnUser)
+
+	if got.Name != owner.Name {
+		t.Fatalf("Pick() = %s after reload, want %s", got.Name, owner.Name)
+	}
+	if got.URL.Host != owner.Name+":9090" {
+		t.Errorf("Pick() URL = %s, want the reloaded %s:9090", got.URL.Host, owner.Name)
+	}
+}
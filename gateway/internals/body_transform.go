@@ -0,0 +1,250 @@
+package internals
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+// defaultMaxTransformBody bounds the bodies buffered for transformation
+const defaultMaxTransformBody = 1 << 20
+
+// transformRequestBody applies the route's request transform to a JSON body
+func (g *Gateway) transformRequestBody(r *http.Request, config *types.BodyConfig) {
+	if config.Request == nil || r.Body == nil || r.Body == http.NoBody || !transformableBody(r.Header) {
+		return
+	}
+
+	body, ok := bufferBody(&r.Body, r.ContentLength, maxTransformBody(config))
+	if !ok {
+		return
+	}
+
+	transformed, err := transformJSON(body, config.Request)
+	if err != nil {
+		g.log.Warn("request body not transformed", "path", r.URL.Path, "error", err)
+		transformed = body
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(transformed))
+	r.ContentLength = int64(len(transformed))
+	r.Header.Del("Content-Length")
+}
+
+// errBodyNotTransformed fails responses that would reach the client with
+// fields the route masks or removes
+var errBodyNotTransformed = errors.New("response body not transformed")
+
+// transformResponseBody applies the route's response transform to a JSON
+// body, before it is cached so masked fields are never stored. Transforms
+// that mask or remove fields fail closed: a body they can't be applied to
+// returns errBodyNotTransformed instead of passing through.
+func (g *Gateway) transformResponseBody(resp *http.Response, config *types.BodyConfig) error {
+	if config.Response == nil || !jsonBody(resp.Header) {
+		return nil
+	}
+
+	failClosed := hidesFields(config.Response)
+	if encodedBody(resp.Header) {
+		if failClosed {
+			return fmt.Errorf("%w: %s encoded", errBodyNotTransformed, resp.Header.Get("Content-Encoding"))
+		}
+		return nil
+	}
+
+	body, ok := bufferBody(&resp.Body, resp.ContentLength, maxTransformBody(config))
+	if !ok {
+		if failClosed {
+			return fmt.Errorf("%w: larger than %d bytes", errBodyNotTransformed, maxTransformBody(config))
+		}
+		return nil
+	}
+
+	transformed, err := transformJSON(body, config.Response)
+	if err != nil {
+		if failClosed {
+			return fmt.Errorf("%w: %v", errBodyNotTransformed, err)
+		}
+		g.log.Warn("response body not transformed", "path", resp.Request.URL.Path, "error", err)
+		transformed = body
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(transformed))
+	resp.ContentLength = int64(len(transformed))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(transformed)))
+	return nil
+}
+
+// hidesFields reports whether transform keeps data from clients, so a body
+// it can't be applied to must not reach them
+func hidesFields(transform *types.JSONTransform) bool {
+	return len(transform.Mask) > 0 || len(transform.Remove) > 0
+}
+
+func maxTransformBody(config *types.BodyConfig) int64 {
+	if config.MaxSize > 0 {
+		return config.MaxSize
+	}
+	return defaultMaxTransformBody
+}
+
+// transformableBody reports whether the body is uncompressed JSON
+func transformableBody(header http.Header) bool {
+	return jsonBody(header) && !encodedBody(header)
+}
+
+func jsonBody(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func encodedBody(header http.Header) bool {
+	encoding := header.Get("Content-Encoding")
+	return encoding != "" && encoding != "identity"
+}
+
+// bufferBody reads a body of at most max bytes. Larger bodies are restored
+// unread so they pass through as they are.
+func bufferBody(body *io.ReadCloser, length, max int64) ([]byte, bool) {
+	if length > max {
+		return nil, false
+	}
+
+	original := *body
+	buffered, err := io.ReadAll(io.LimitReader(original, max+1))
+	if err != nil || int64(len(buffered)) > max {
+		*body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buffered), original), original}
+		return nil, false
+	}
+
+	original.Close()
+	return buffered, true
+}
+
+// transformJSON applies transform to a JSON document: rename, remove, add, mask
+func transformJSON(body []byte, transform *types.JSONTransform) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+
+	for path, name := range transform.Rename {
+		walkJSON(document, parseJSONPath(path), false, func(parent map[string]interface{}, field string) {
+			if value, ok := parent[field]; ok {
+				delete(parent, field)
+				parent[name] = value
+			}
+		})
+	}
+
+	for _, path := range transform.Remove {
+		walkJSON(document, parseJSONPath(path), false, func(parent map[string]interface{}, field string) {
+			delete(parent, field)
+		})
+	}
+
+	for path, raw := range transform.Add {
+		if !json.Valid(raw) {
+			return nil, fmt.Errorf("invalid value for %s", path)
+		}
+		walkJSON(document, parseJSONPath(path), true, func(parent map[string]interface{}, field string) {
+			// Decoded per field so array elements never share a value
+			var value interface{}
+			json.Unmarshal(raw, &value)
+			parent[field] = value
+		})
+	}
+
+	for _, path := range transform.Mask {
+		walkJSON(document, parseJSONPath(path), false, func(parent map[string]interface{}, field string) {
+			if value, ok := parent[field]; ok && value != nil {
+				parent[field] = maskValue(value)
+			}
+		})
+	}
+
+	return json.Marshal(document)
+}
+
+// parseJSONPath splits "items[*].card.number" into [items * card number]
+func parseJSONPath(path string) []string {
+	var segments []string
+	for _, part := range strings.Split(path, ".") {
+		arrays := 0
+		for strings.HasSuffix(part, "[*]") {
+			part = strings.TrimSuffix(part, "[*]")
+			arrays++
+		}
+		segments = append(segments, part)
+		for ; arrays > 0; arrays-- {
+			segments = append(segments, "*")
+		}
+	}
+	return segments
+}
+
+// walkJSON calls fn with the object holding each field path selects. With
+// create, missing objects along the path are added.
+func walkJSON(node interface{}, path []string, create bool, fn func(parent map[string]interface{}, field string)) {
+	if len(path) == 0 {
+		return
+	}
+
+	if path[0] == "*" {
+		if items, ok := node.([]interface{}); ok {
+			for _, item := range items {
+				walkJSON(item, path[1:], create, fn)
+			}
+		}
+		return
+	}
+
+	object, ok := node.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	if len(path) == 1 {
+		fn(object, path[0])
+		return
+	}
+
+	child, exists := object[path[0]]
+	if !exists && create && path[1] != "*" {
+		child = make(map[string]interface{})
+		object[path[0]] = child
+	}
+	walkJSON(child, path[1:], create, fn)
+}
+
+// maskValue hides a value, keeping the last 4 characters of long strings
+// (e.g. card numbers) so they stay recognizable
+func maskValue(value interface{}) interface{} {
+	text, ok := value.(string)
+	if !ok {
+		return "****"
+	}
+
+	runes := []rune(text)
+	if len(runes) < 8 {
+		return strings.Repeat("*", len(runes))
+	}
+	return strings.Repeat("*", len(runes)-4) + string(runes[len(runes)-4:])
+}
@@ -0,0 +1,187 @@
+package internals
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+func TestTransformJSON(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		transform *types.JSONTransform
+		want      string
+	}{
+		{"rename", `{"a":1}`, &types.JSONTransform{Rename: map[string]string{"a": "b"}}, `{"b":1}`},
+		{"remove nested", `{"user":{"id":1,"password":"x"}}`,
+			&types.JSONTransform{Remove: []string{"user.password"}}, `{"user":{"id":1}}`},
+		{"add creates objects", `{}`,
+			&types.JSONTransform{Add: map[string]json.RawMessage{"meta.version": json.RawMessage(`2`)}}, `{"meta":{"version":2}}`},
+		{"add into array elements", `{"items":[{},{}]}`,
+			&types.JSONTransform{Add: map[string]json.RawMessage{"items[*].seen": json.RawMessage(`true`)}},
+			`{"items":[{"seen":true},{"seen":true}]}`},
+		{"mask keeps last 4", `{"items":[{"card":"4111111111111111"},{"card":"12345"}]}`,
+			&types.JSONTransform{Mask: []string{"items[*].card"}},
+			`{"items":[{"card":"************1111"},{"card":"*****"}]}`},
+		{"mask non-strings and skip null", `{"pin":1234,"token":null}`,
+			&types.JSONTransform{Mask: []string{"pin", "token", "missing"}}, `{"pin":"****","token":null}`},
+		{"rename before mask", `{"ssn":"123456789"}`,
+			&types.JSONTransform{Rename: map[string]string{"ssn": "tax_id"}, Mask: []string{"tax_id"}},
+			`{"tax_id":"*****6789"}`},
+		{"numbers keep precision", `{"id":12345678901234567890}`, &types.JSONTransform{}, `{"id":12345678901234567890}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := transformJSON([]byte(tt.body), tt.transform)
+			if err != nil {
+				t.Fatalf("transformJSON: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("transformJSON = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformJSONErrors(t *testing.T) {
+	if _, err := transformJSON([]byte(`{"a":`), &types.JSONTransform{}); err == nil {
+		t.Error("truncated document: want error")
+	}
+
+	invalid := &types.JSONTransform{Add: map[string]json.RawMessage{"a": json.RawMessage(`{`)}}
+	if _, err := transformJSON([]byte(`{}`), invalid); err == nil {
+		t.Error("invalid add value: want error")
+	}
+}
+
+func TestParseJSONPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"name", []string{"name"}},
+		{"user.card.number", []string{"user", "card", "number"}},
+		{"items[*].id", []string{"items", "*", "id"}},
+		{"grid[*][*]", []string{"grid", "*", "*"}},
+	}
+
+	for _, tt := range tests {
+		if got := parseJSONPath(tt.path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseJSONPath(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestTransformableBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   bool
+	}{
+		{"json", http.Header{"Content-Type": {"application/json; charset=utf-8"}}, true},
+		{"json suffix", http.Header{"Content-Type": {"application/problem+json"}}, true},
+		{"identity encoding", http.Header{"Content-Type": {"application/json"}, "Content-Encoding": {"identity"}}, true},
+		{"gzip", http.Header{"Content-Type": {"application/json"}, "Content-Encoding": {"gzip"}}, false},
+		{"text", http.Header{"Content-Type": {"text/plain"}}, false},
+		{"no content type", http.Header{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := transformableBody(tt.header); got != tt.want {
+				t.Errorf("transformableBody = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBufferBody(t *testing.T) {
+	body := io.NopCloser(strings.NewReader("0123456789"))
+	buffered, ok := bufferBody(&body, -1, 10)
+	if !ok || string(buffered) != "0123456789" {
+		t.Errorf("within limit = %q, %v", buffered, ok)
+	}
+
+	// Oversized bodies are restored so they still reach the client whole
+	body = io.NopCloser(strings.NewReader("0123456789"))
+	if _, ok := bufferBody(&body, -1, 4); ok {
+		t.Error("over limit: want not buffered")
+	}
+	if rest, _ := io.ReadAll(body); string(rest) != "0123456789" {
+		t.Errorf("restored body = %q", rest)
+	}
+}
+
+// Responses that mask or remove fields never reach the client untransformed
+func TestTransformResponseBodyFailsClosed(t *testing.T) {
+	mask := &types.JSONTransform{Mask: []string{"card"}}
+	rename := &types.JSONTransform{Rename: map[string]string{"card": "number"}}
+
+	tests := []struct {
+		name     string
+		config   *types.BodyConfig
+		encoding string // Sent whatever the request accepts
+		body     string
+		status   int
+		want     string
+	}{
+		{"compressed upstream", &types.BodyConfig{Response: mask}, "", `{"card":"4111111111111111"}`, http.StatusOK, `{"card":"************1111"}`},
+		{"unsupported encoding", &types.BodyConfig{Response: mask}, "br", `{"card":"4111111111111111"}`, http.StatusBadGateway, ""},
+		{"invalid json", &types.BodyConfig{Response: mask}, "", `{"card":"4111111111111111"`, http.StatusBadGateway, ""},
+		{"too large", &types.BodyConfig{Response: mask, MaxSize: 8}, "", `{"card":"4111111111111111"}`, http.StatusBadGateway, ""},
+		{"invalid json without mask", &types.BodyConfig{Response: rename}, "", `{"card":"4111111111111111"`, http.StatusOK, `{"card":"4111111111111111"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch {
+				case tt.encoding != "":
+					w.Header().Set("Content-Encoding", tt.encoding)
+					io.WriteString(w, tt.body)
+				case strings.Contains(r.Header.Get("Accept-Encoding"), "gzip"):
+					w.Header().Set("Content-Encoding", "gzip")
+					gz := gzip.NewWriter(w)
+					io.WriteString(gz, tt.body)
+					gz.Close()
+				default:
+					io.WriteString(w, tt.body)
+				}
+			}))
+			defer upstream.Close()
+
+			g, _ := newTestGateway(t, upstream.URL, true, &types.RouteConfig{Body: tt.config})
+			gateway := httptest.NewServer(http.HandlerFunc(g.ProxyHandler))
+			defer gateway.Close()
+
+			req, _ := http.NewRequest(http.MethodGet, gateway.URL+"/api/cards/1", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status == http.StatusOK && string(body) != tt.want {
+				t.Errorf("body = %s, want %s", body, tt.want)
+			}
+			if strings.Contains(string(body), "4111111111111111") && tt.config.Response == mask {
+				t.Errorf("masked field leaked: %s", body)
+			}
+		})
+	}
+}
@@ -7,91 +7,630 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"io"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/chann44/ikyk/pkg/logger"
 	"github.com/chann44/ikyk/pkg/types"
+	"github.com/redis/go-redis/v9"
 )
 
+// CacheInvalidationsChannel carries types.CacheInvalidation messages, so
+// every gateway drops the in-process copies of changed or purged entries
+const CacheInvalidationsChannel = "cache:invalidations"
+
+// CacheManager is a shared HTTP cache in Redis. It follows RFC 9111: the
+// upstream's Cache-Control and Expires decide what is stored and for how
+// long, responses are keyed by the request headers they Vary on, and
+// personalized responses are never stored unless the upstream says so.
+// An optional in-process LRU tier answers hot entries without Redis.
 type CacheManager struct {
-	storage *RedisClient
-	log     *logger.Logger
-	ttl     time.Duration
+	storage  *RedisClient
+	log      *logger.Logger
+	metrics  *MetricsCollector
+	ttl      time.Duration // Lifetime of responses without explicit freshness
+	local    *localCache   // nil when disabled
+	compress bool          // gzip bodies stored in Redis
+	id       string        // Tells this gateway's invalidations from others'
+
+	mu      sync.Mutex
+	flights map[string]chan struct{} // Upstream fetches in progress, by key
 }
 
-func NewCacheManager(storage *RedisClient, log *logger.Logger, ttl time.Duration) *CacheManager {
+// NewCacheManager creates the cache. localBytes sizes the in-process tier,
+// 0 disables it.
+func NewCacheManager(storage *RedisClient, log *logger.Logger, metrics *MetricsCollector, ttl time.Duration, localBytes int64, compress bool) *CacheManager {
 	return &CacheManager{
-		storage: storage,
-		log:     log,
-		ttl:     ttl,
+		storage:  storage,
+		log:      log,
+		metrics:  metrics,
+		ttl:      ttl,
+		local:    newLocalCache(localBytes),
+		compress: compress,
+		id:       strconv.FormatUint(rand.Uint64(), 36),
+		flights:  make(map[string]chan struct{}),
 	}
 }
 
-func (cm *CacheManager) Get(r *http.Request) *types.CachedResponse {
-	if r.Method != "GET" {
-		return nil
+const (
+	// defaultMaxCacheBody bounds the responses stored when the route sets no limit
+	defaultMaxCacheBody = 8 << 20
+	// revalidationWindow keeps expired responses with validators around so
+	// they can be revalidated instead of refetched
+	revalidationWindow = time.Hour
+	// fetchLockTTL bounds how long one replica holds a resource's fetch lock
+	fetchLockTTL = 10 * time.Second
+	// coalesceWait is the longest a request waits for another one's fetch
+	coalesceWait = 5 * time.Second
+	coalescePoll = 25 * time.Millisecond
+	// localIndexTTL bounds how long the local tier trusts a vary index, in
+	// case an invalidation message was missed
+	localIndexTTL = time.Minute
+)
+
+// releaseLock deletes a fetch lock only if it is still the caller's
+var releaseLock = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Get looks up the cached response for a GET or HEAD request under the
+// route's cache policy. A fresh one can be served as is; a stale one is only
+// returned when it has an ETag or Last-Modified to revalidate with, or may
+// still be served stale.
+func (cm *CacheManager) Get(r *http.Request, route *RouteMatch) (cached *types.CachedResponse, fresh bool) {
+	policy := route.Config.Cache
+	if !cachesRequest(r, policy) {
+		return nil, false
 	}
 
-	key := cm.generateKey(r)
-	ctx := context.Background()
+	cc := parseCacheControl(r.Header)
+	if cc.has("no-store") {
+		return nil, false
+	}
 
-	data, err := cm.storage.Get(ctx, key).Result()
+	ctx := context.Background()
+	key, err := cm.lookupKey(ctx, r, policy)
 	if err != nil {
-		return nil
+		return nil, false
 	}
 
-	var cached types.CachedResponse
-	if err := json.Unmarshal([]byte(data), &cached); err != nil {
-		cm.log.Error("failed to unmarshal cached response: %v", err)
-		return nil
+	cached = cm.load(ctx, key)
+	if cached == nil {
+		return nil, false
 	}
 
-	return &cached
+	if r.Header.Get("Authorization") != "" && !cached.Shared && !keysConsumer(r, policy) {
+		return nil, false
+	}
+
+	// The client may ask for a response validated by the origin
+	fresh = time.Now().Before(cached.Expires) && !cc.has("no-cache")
+	if maxAge, ok := cc.seconds("max-age"); ok && cachedAge(cached) > maxAge {
+		fresh = false
+	}
+
+	if !fresh && !hasValidators(cached.Headers) && !staleWithin(cached, max(cached.StaleWhileRevalidate, cached.StaleIfError)) {
+		return nil, false
+	}
+	return cached, fresh
 }
 
-func (cm *CacheManager) Set(r *http.Request, resp *http.Response) {
-	if r.Method != "GET" || resp.StatusCode != http.StatusOK {
+// Set stores the response to a GET request when HTTP caching rules and the
+// route's policy allow it. The body is read and restored for the client.
+func (cm *CacheManager) Set(r *http.Request, resp *http.Response, route *RouteMatch) {
+	policy := route.Config.Cache
+	if r.Method != http.MethodGet || !cachesRequest(r, policy) || !cacheableStatus[resp.StatusCode] {
+		return
+	}
+	if parseCacheControl(r.Header).has("no-store") {
 		return
 	}
 
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
+	cc := parseCacheControl(resp.Header)
+	if cc.has("no-store") || cc.has("private") {
+		return
+	}
+
+	// no-cache responses may be stored, but only to be revalidated
+	validators := hasValidators(resp.Header)
+	if cc.has("no-cache") && !validators {
+		return
+	}
+
+	// Cookies belong to one client
+	if resp.Header.Get("Set-Cookie") != "" {
+		return
+	}
+
+	if _, star := varyHeaders(resp.Header); star {
+		return
+	}
+
+	// Authenticated responses are personal unless explicitly shareable or
+	// keyed per identified consumer
+	shared := cc.has("public") || cc.has("s-maxage") || cc.has("must-revalidate")
+	if r.Header.Get("Authorization") != "" && !shared && !keysConsumer(r, policy) {
+		return
+	}
+
+	maxBody := int64(defaultMaxCacheBody)
+	if policy != nil && policy.MaxBodySize > 0 {
+		maxBody = policy.MaxBodySize
+	}
+
+	cached := &types.CachedResponse{
+		StatusCode: resp.StatusCode,
+		Headers:    resp.Header.Clone(),
+		Shared:     shared,
+	}
+	if !cm.freshen(cached, responseAge(resp), policy) {
+		return
+	}
+
+	// Read response body; larger ones pass through uncached
+	body, ok := bufferBody(&resp.Body, resp.ContentLength, maxBody)
+	if !ok {
 		return
 	}
 
 	// Restore body for downstream
 	resp.Body = io.NopCloser(bytes.NewBuffer(body))
+	cached.Body = body
 
-	// Convert http.Header to map[string][]string for JSON
-	headers := make(map[string][]string)
-	for k, v := range resp.Header {
-		headers[k] = v
+	cm.store(r, route, cached)
+}
+
+// Refresh updates a stale response with the headers of the upstream's 304
+// to a revalidation and stores it again, fresh
+func (cm *CacheManager) Refresh(r *http.Request, stale *types.CachedResponse, resp *http.Response, route *RouteMatch) *types.CachedResponse {
+	refreshed := *stale
+	refreshed.Headers = http.Header(stale.Headers).Clone()
+	for name, values := range resp.Header {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "Connection":
+			continue
+		}
+		refreshed.Headers[name] = values
 	}
 
-	cached := types.CachedResponse{
-		StatusCode: resp.StatusCode,
-		Headers:    headers,
-		Body:       body,
-		CachedAt:   time.Now(),
+	if cm.freshen(&refreshed, responseAge(resp), route.Config.Cache) {
+		cm.store(r, route, &refreshed)
 	}
+	return &refreshed
+}
 
-	data, err := json.Marshal(cached)
-	if err != nil {
-		cm.log.Error("failed to marshal cached response: %v", err)
+// freshen computes when cached expires from its headers, as of now. It is
+// false when the response must not be stored.
+func (cm *CacheManager) freshen(cached *types.CachedResponse, age time.Duration, policy *types.CacheConfig) bool {
+	ttl := cm.ttl
+	if policy != nil && policy.TTL > 0 {
+		ttl = policy.TTL
+	}
+
+	header := http.Header(cached.Headers)
+	cc := parseCacheControl(header)
+	lifetime, ok := freshnessLifetime(&http.Response{StatusCode: cached.StatusCode, Header: header}, cc, ttl)
+	if !ok {
+		return false
+	}
+
+	fresh := lifetime - age
+	if cc.has("no-cache") || fresh < 0 {
+		fresh = 0
+	}
+
+	// Serving stale is up to the upstream, then the route; s-maxage and the
+	// revalidate directives rule it out for shared caches
+	cached.StaleWhileRevalidate, cached.StaleIfError = 0, 0
+	if !cc.has("no-cache") && !cc.has("must-revalidate") && !cc.has("proxy-revalidate") && !cc.has("s-maxage") {
+		var policySWR, policySIE time.Duration
+		if policy != nil {
+			policySWR, policySIE = policy.StaleWhileRevalidate, policy.StaleIfError
+		}
+		cached.StaleWhileRevalidate = staleWindow(cc, "stale-while-revalidate", policySWR)
+		cached.StaleIfError = staleWindow(cc, "stale-if-error", policySIE)
+	}
+
+	if fresh == 0 && !hasValidators(header) && cached.StaleWhileRevalidate == 0 && cached.StaleIfError == 0 {
+		return false
+	}
+
+	header.Del("Age") // Computed when served
+	now := time.Now()
+	cached.CachedAt = now
+	cached.InitialAge = age
+	cached.Expires = now.Add(fresh)
+	return true
+}
+
+// store writes cached under the variant key of r, along with the vary index
+// and the purge indexes: by URL, path, route and surrogate key
+func (cm *CacheManager) store(r *http.Request, route *RouteMatch, cached *types.CachedResponse) {
+	data := encodeCachedResponse(cached, cm.compress)
+
+	// Responses that can be revalidated or served stale outlive their freshness
+	grace := max(cached.StaleWhileRevalidate, cached.StaleIfError)
+	if hasValidators(cached.Headers) {
+		grace = max(grace, revalidationWindow)
+	}
+	retention := time.Until(cached.Expires) + grace
+
+	ctx := context.Background()
+	base := cm.generateKey(r, route.Config.Cache)
+	index := varyIndexKey(base)
+	vary, _ := varyHeaders(cached.Headers)
+	key := variantKey(base, vary, r)
+
+	pipe := cm.storage.Pipeline()
+	if len(vary) > 0 {
+		pipe.Set(ctx, index, strings.Join(vary, ","), retention)
+	} else {
+		pipe.Del(ctx, index)
+	}
+	pipe.Set(ctx, key, data, retention)
+
+	indexes := []string{
+		"cache:index:url:" + requestURI(r.URL),
+		"cache:index:path:" + r.URL.Path,
+		"cache:index:route:" + route.Path,
+	}
+	for _, tag := range surrogateKeys(cached.Headers) {
+		indexes = append(indexes, "cache:index:tag:"+tag)
+	}
+	for _, index := range indexes {
+		// Indexes live as long as their longest-lived entry
+		pipe.SAdd(ctx, index, key)
+		pipe.ExpireNX(ctx, index, retention)
+		pipe.ExpireGT(ctx, index, retention)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		cm.log.Warn("failed to cache response", "path", r.URL.Path, "error", err)
+		return
+	}
+
+	cm.local.set(key, cached, entrySize(cached), retention)
+	cm.local.set(index, strings.Join(vary, ","), int64(len(index)), localIndexTTL)
+	cm.publishInvalidation(ctx, index, key)
+}
+
+// Invalidate drops the cached GET responses for a resource after a
+// successful unsafe request to it (RFC 9111 4.4): every query of the request
+// path, and of the Location and Content-Location paths on the same host
+func (cm *CacheManager) Invalidate(r *http.Request, resp *http.Response, route *RouteMatch) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return
+	}
+	if resp.StatusCode >= http.StatusBadRequest || resp.StatusCode < http.StatusOK {
+		return
+	}
+	if policy := route.Config.Cache; policy != nil && !policy.Enabled {
 		return
 	}
 
-	key := cm.generateKey(r)
+	paths := []string{r.URL.Path}
+	for _, name := range []string{"Location", "Content-Location"} {
+		location, err := r.URL.Parse(resp.Header.Get(name))
+		if err != nil || resp.Header.Get(name) == "" || (location.Host != "" && location.Host != r.Host) {
+			continue
+		}
+		paths = append(paths, location.Path)
+	}
+
 	ctx := context.Background()
+	for _, path := range paths {
+		index := "cache:index:path:" + path
+		keys, err := cm.storage.SMembers(ctx, index).Result()
+		if err != nil {
+			cm.log.Warn("failed to invalidate cached responses", "path", path, "error", err)
+			continue
+		}
+		if err := cm.storage.Del(ctx, append(keys, index)...).Err(); err != nil {
+			cm.log.Warn("failed to invalidate cached responses", "path", path, "error", err)
+			continue
+		}
+		cm.local.remove(keys...)
+		cm.publishInvalidation(ctx, keys...)
+		if len(keys) > 0 {
+			cm.log.Debug("cached responses invalidated", "path", path, "method", r.Method, "entries", len(keys))
+		}
+	}
+}
 
-	cm.storage.Set(ctx, key, data, cm.ttl)
+// load reads an entry from the local tier, then from Redis
+func (cm *CacheManager) load(ctx context.Context, key string) *types.CachedResponse {
+	if value, ok := cm.local.get(key); ok {
+		cm.metrics.RecordCacheLookup("local", true)
+		return value.(*types.CachedResponse)
+	}
+	if cm.local != nil {
+		cm.metrics.RecordCacheLookup("local", false)
+	}
+
+	pipe := cm.storage.Pipeline()
+	get := pipe.Get(ctx, key)
+	ttl := pipe.PTTL(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		cm.metrics.RecordCacheLookup("redis", false)
+		return nil
+	}
+
+	data, _ := get.Bytes()
+	cached, err := decodeCachedResponse(data)
+	if err != nil {
+		cm.log.Error("failed to decode cached response", "key", key, "error", err)
+		cm.metrics.RecordCacheLookup("redis", false)
+		return nil
+	}
+	cm.metrics.RecordCacheLookup("redis", true)
+
+	cm.local.set(key, cached, entrySize(cached), ttl.Val())
+	return cached
 }
 
-func (cm *CacheManager) generateKey(r *http.Request) string {
-	// Create unique key: method + path + query
-	raw := r.Method + ":" + r.URL.Path + ":" + r.URL.RawQuery
+// publishInvalidation tells the other gateways to drop their local copies
+func (cm *CacheManager) publishInvalidation(ctx context.Context, keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	message, _ := json.Marshal(types.CacheInvalidation{Origin: cm.id, Keys: keys})
+	if err := cm.storage.Publish(ctx, CacheInvalidationsChannel, message).Err(); err != nil {
+		cm.log.Warn("failed to publish cache invalidation", "error", err)
+	}
+}
+
+// Watch keeps the local tier coherent with changes made by other gateways
+// and purges from the management API
+func (cm *CacheManager) Watch(ctx context.Context) {
+	if cm.local == nil {
+		return
+	}
+
+	pubsub := cm.storage.Subscribe(ctx, CacheInvalidationsChannel)
+	defer pubsub.Close()
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+			var invalidation types.CacheInvalidation
+			if err := json.Unmarshal([]byte(message.Payload), &invalidation); err != nil {
+				cm.log.Warn("invalid cache invalidation", "error", err)
+				continue
+			}
+			if invalidation.Origin != cm.id {
+				cm.local.remove(invalidation.Keys...)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Coalesce makes concurrent misses for the same resource, in this and other
+// gateway replicas, wait for a single upstream fetch. The leader gets a
+// release func to call once the response is stored, or found uncacheable;
+// calling it again is a no-op. Everyone else gets nil once the leader
+// released or the wait timed out, and should look in the cache again.
+// Requests the shared cache can't answer never wait.
+func (cm *CacheManager) Coalesce(r *http.Request, route *RouteMatch) (release func()) {
+	if !sharesFetch(r, route.Config.Cache) {
+		return func() {}
+	}
+
+	key := cm.generateKey(r, route.Config.Cache)
+	ctx := r.Context()
+
+	cm.mu.Lock()
+	if done, ok := cm.flights[key]; ok {
+		cm.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+		case <-time.After(coalesceWait):
+		}
+		return nil
+	}
+	done := make(chan struct{})
+	cm.flights[key] = done
+	cm.mu.Unlock()
+
+	land := func() {
+		cm.mu.Lock()
+		delete(cm.flights, key)
+		cm.mu.Unlock()
+		close(done)
+	}
+
+	lock := "cache:lock:" + strings.TrimPrefix(key, "cache:response:")
+	token := strconv.FormatUint(rand.Uint64(), 36)
+	acquired, err := cm.storage.SetNX(ctx, lock, token, fetchLockTTL).Result()
+	if err != nil || acquired {
+		// Without Redis every replica fetches on its own
+		var once sync.Once
+		return func() {
+			once.Do(func() {
+				if acquired {
+					releaseLock.Run(context.Background(), cm.storage, []string{lock}, token)
+				}
+				land()
+			})
+		}
+	}
+
+	// Another replica is fetching; wait for it to release the lock
+	deadline := time.Now().Add(coalesceWait)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		time.Sleep(coalescePoll)
+		if n, err := cm.storage.Exists(ctx, lock).Result(); err != nil || n == 0 {
+			break
+		}
+	}
+	land()
+	return nil
+}
+
+// lookupKey resolves the key of the variant matching the request's headers
+func (cm *CacheManager) lookupKey(ctx context.Context, r *http.Request, policy *types.CacheConfig) (string, error) {
+	base := cm.generateKey(r, policy)
+
+	index := varyIndexKey(base)
+	value, ok := cm.local.get(index)
+	names, _ := value.(string)
+	if !ok {
+		var err error
+		names, err = cm.storage.Get(ctx, index).Result()
+		if err != nil && err != redis.Nil {
+			return "", err
+		}
+		cm.local.set(index, names, int64(len(index)+len(names)), localIndexTTL)
+	}
+
+	var vary []string
+	if names != "" {
+		vary = strings.Split(names, ",")
+	}
+	return variantKey(base, vary, r), nil
+}
+
+func (cm *CacheManager) generateKey(r *http.Request, policy *types.CacheConfig) string {
+	// Create unique key: host + path + query (routes can differ per host).
+	// HEAD requests share the GET entries.
+	raw := r.Host + ":" + r.URL.Path + ":" + cacheKeyQuery(r, policy)
+
+	if policy != nil && policy.Key != nil {
+		for _, name := range policy.Key.Headers {
+			raw += "\n" + http.CanonicalHeaderKey(name) + ":" + strings.Join(r.Header.Values(name), ",")
+		}
+		if policy.Key.Consumer {
+			raw += "\nconsumer:" + ConsumerFromContext(r.Context())
+		}
+	}
+
 	hash := sha256.Sum256([]byte(raw))
 	return "cache:response:" + hex.EncodeToString(hash[:])
 }
+
+// cacheKeyQuery is the part of the query string that goes into the key
+func cacheKeyQuery(r *http.Request, policy *types.CacheConfig) string {
+	if policy == nil || policy.Key == nil || (len(policy.Key.Query) == 0 && len(policy.Key.IgnoreQuery) == 0) {
+		return r.URL.RawQuery
+	}
+
+	query := r.URL.Query()
+	if include := policy.Key.Query; len(include) > 0 {
+		selected := url.Values{}
+		for _, name := range include {
+			if values, ok := query[name]; ok {
+				selected[name] = values
+			}
+		}
+		query = selected
+	}
+	for _, name := range policy.Key.IgnoreQuery {
+		query.Del(name)
+	}
+
+	// Encode sorts by name, so parameter order doesn't split entries
+	return query.Encode()
+}
+
+// cachesRequest applies the route's policy: whether it caches at all, which
+// methods it serves from the cache and under which path prefix
+func cachesRequest(r *http.Request, policy *types.CacheConfig) bool {
+	if policy == nil {
+		return r.Method == http.MethodGet || r.Method == http.MethodHead
+	}
+	if !policy.Enabled || !strings.HasPrefix(r.URL.Path, policy.PathPrefix) {
+		return false
+	}
+
+	if len(policy.Methods) == 0 {
+		return r.Method == http.MethodGet || r.Method == http.MethodHead
+	}
+	for _, method := range policy.Methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	return false
+}
+
+// sharesFetch reports whether r could be answered by another request's
+// response: requests with credentials only can when the policy keys entries
+// by consumer and r has one, and no-cache and no-store requests never do
+func sharesFetch(r *http.Request, policy *types.CacheConfig) bool {
+	cc := parseCacheControl(r.Header)
+	if cc.has("no-cache") || cc.has("no-store") {
+		return false
+	}
+	return r.Header.Get("Authorization") == "" || keysConsumer(r, policy)
+}
+
+// keysConsumer reports whether r's entries are keyed by its consumer.
+// Consumers only come from API keys, so requests authenticated otherwise
+// would all share the empty consumer's entries.
+func keysConsumer(r *http.Request, policy *types.CacheConfig) bool {
+	return policy != nil && policy.Key != nil && policy.Key.Consumer && ConsumerFromContext(r.Context()) != ""
+}
+
+// varyIndexKey holds the header names the responses for base vary on
+func varyIndexKey(base string) string {
+	return "cache:vary:" + strings.TrimPrefix(base, "cache:response:")
+}
+
+// variantKey extends base with the request's values of the vary headers
+func variantKey(base string, vary []string, r *http.Request) string {
+	if len(vary) == 0 {
+		return base
+	}
+
+	var raw strings.Builder
+	for _, name := range vary {
+		raw.WriteString(name)
+		raw.WriteByte(':')
+		raw.WriteString(strings.Join(r.Header.Values(name), ","))
+		raw.WriteByte('\n')
+	}
+	hash := sha256.Sum256([]byte(raw.String()))
+	return base + ":" + hex.EncodeToString(hash[:8])
+}
+
+// cachedAge is the current age of a cached response
+func cachedAge(cached *types.CachedResponse) time.Duration {
+	return cached.InitialAge + time.Since(cached.CachedAt)
+}
+
+// staleWindow is a stale-* directive of the response, or the route's default
+func staleWindow(cc cacheControl, directive string, fallback time.Duration) time.Duration {
+	if window, ok := cc.seconds(directive); ok {
+		return window
+	}
+	return fallback
+}
+
+// requestURI is the path and query the URL purge index is keyed by
+func requestURI(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	return u.Path + "?" + u.RawQuery
+}
+
+// surrogateKeys are the space separated tags of a Surrogate-Key header
+func surrogateKeys(header http.Header) []string {
+	return strings.Fields(strings.Join(header.Values("Surrogate-Key"), " "))
+}
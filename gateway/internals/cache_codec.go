@@ -0,0 +1,183 @@
+package internals
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+// Cached responses are stored in a compact binary layout instead of JSON,
+// whose base64 bodies cost a third more space and a decode on every hit:
+//
+//	magic 'C', version 1, flags
+//	status (uvarint), cached at, expires (unix nanos, varint)
+//	initial age, stale-while-revalidate, stale-if-error (nanos, varint)
+//	headers: count, then name, value count and values (length-prefixed)
+//	body (length-prefixed, gzipped when flagGzipBody is set)
+const (
+	cacheCodecMagic   = 'C'
+	cacheCodecVersion = 1
+
+	flagShared   = 1 << 0
+	flagGzipBody = 1 << 1
+
+	// minCompressSize is the smallest body worth compressing
+	minCompressSize = 1024
+)
+
+var errCorruptEntry = errors.New("corrupt cache entry")
+
+// encodeCachedResponse serializes cached, gzipping the body when compress is
+// set and it pays off
+func encodeCachedResponse(cached *types.CachedResponse, compress bool) []byte {
+	body := cached.Body
+	var flags byte
+	if cached.Shared {
+		flags |= flagShared
+	}
+	if compress && len(body) >= minCompressSize && http.Header(cached.Headers).Get("Content-Encoding") == "" {
+		if compressed, ok := gzipBody(body); ok {
+			body = compressed
+			flags |= flagGzipBody
+		}
+	}
+
+	buf := make([]byte, 0, len(body)+512)
+	buf = append(buf, cacheCodecMagic, cacheCodecVersion, flags)
+	buf = binary.AppendUvarint(buf, uint64(cached.StatusCode))
+	buf = binary.AppendVarint(buf, cached.CachedAt.UnixNano())
+	buf = binary.AppendVarint(buf, cached.Expires.UnixNano())
+	buf = binary.AppendVarint(buf, int64(cached.InitialAge))
+	buf = binary.AppendVarint(buf, int64(cached.StaleWhileRevalidate))
+	buf = binary.AppendVarint(buf, int64(cached.StaleIfError))
+
+	buf = binary.AppendUvarint(buf, uint64(len(cached.Headers)))
+	for name, values := range cached.Headers {
+		buf = appendBytes(buf, []byte(name))
+		buf = binary.AppendUvarint(buf, uint64(len(values)))
+		for _, value := range values {
+			buf = appendBytes(buf, []byte(value))
+		}
+	}
+	return appendBytes(buf, body)
+}
+
+// decodeCachedResponse reads an entry written by encodeCachedResponse, or a
+// JSON one stored by earlier gateway versions
+func decodeCachedResponse(data []byte) (*types.CachedResponse, error) {
+	cached := &types.CachedResponse{}
+	if len(data) > 0 && data[0] == '{' {
+		if err := json.Unmarshal(data, cached); err != nil {
+			return nil, err
+		}
+		return cached, nil
+	}
+
+	if len(data) < 3 || data[0] != cacheCodecMagic || data[1] != cacheCodecVersion {
+		return nil, errCorruptEntry
+	}
+	flags := data[2]
+	d := &entryDecoder{data: data[3:]}
+
+	cached.StatusCode = int(d.uvarint())
+	cached.CachedAt = time.Unix(0, d.varint())
+	cached.Expires = time.Unix(0, d.varint())
+	cached.InitialAge = time.Duration(d.varint())
+	cached.StaleWhileRevalidate = time.Duration(d.varint())
+	cached.StaleIfError = time.Duration(d.varint())
+	cached.Shared = flags&flagShared != 0
+
+	count := d.uvarint()
+	cached.Headers = make(map[string][]string, min(count, 64))
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		name := string(d.bytes())
+		n := d.uvarint()
+		values := make([]string, 0, min(n, 16))
+		for j := uint64(0); j < n && d.err == nil; j++ {
+			values = append(values, string(d.bytes()))
+		}
+		cached.Headers[name] = values
+	}
+
+	body := d.bytes()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if flags&flagGzipBody != 0 {
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body, err = io.ReadAll(reader); err != nil {
+			return nil, err
+		}
+	}
+	cached.Body = body
+	return cached, nil
+}
+
+func gzipBody(body []byte) ([]byte, bool) {
+	var buf bytes.Buffer
+	writer, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	writer.Write(body)
+	writer.Close()
+	return buf.Bytes(), buf.Len() < len(body)
+}
+
+func appendBytes(buf, value []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// entryDecoder reads the fields of an entry; the first error sticks
+type entryDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *entryDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	value, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errCorruptEntry
+		return 0
+	}
+	d.data = d.data[n:]
+	return value
+}
+
+func (d *entryDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	value, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = errCorruptEntry
+		return 0
+	}
+	d.data = d.data[n:]
+	return value
+}
+
+func (d *entryDecoder) bytes() []byte {
+	length := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if length > uint64(len(d.data)) {
+		d.err = errCorruptEntry
+		return nil
+	}
+	value := d.data[:length:length]
+	d.data = d.data[length:]
+	return value
+}
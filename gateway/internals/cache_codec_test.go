@@ -0,0 +1,132 @@
+package internals
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+func TestCachedResponseRoundTrip(t *testing.T) {
+	now := time.Now()
+	large := []byte(strings.Repeat("cacheable ", 500))
+
+	tests := []struct {
+		name     string
+		cached   *types.CachedResponse
+		compress bool
+		wantGzip bool
+	}{
+		{"empty", &types.CachedResponse{StatusCode: 204, Headers: map[string][]string{}, CachedAt: now, Expires: now}, true, false},
+		{"small body", &types.CachedResponse{
+			StatusCode:           200,
+			Headers:              map[string][]string{"Content-Type": {"application/json"}, "Vary": {"Accept", "Accept-Language"}},
+			Body:                 []byte(`{"ok":true}`),
+			CachedAt:             now,
+			Expires:              now.Add(time.Minute),
+			InitialAge:           3 * time.Second,
+			StaleWhileRevalidate: 30 * time.Second,
+			StaleIfError:         time.Hour,
+			Shared:               true,
+		}, true, false},
+		{"compressed", &types.CachedResponse{StatusCode: 200, Headers: map[string][]string{}, Body: large, CachedAt: now, Expires: now}, true, true},
+		{"compression off", &types.CachedResponse{StatusCode: 200, Headers: map[string][]string{}, Body: large, CachedAt: now, Expires: now}, false, false},
+		{"already encoded", &types.CachedResponse{StatusCode: 200, Headers: map[string][]string{"Content-Encoding": {"br"}}, Body: large, CachedAt: now, Expires: now}, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := encodeCachedResponse(tt.cached, tt.compress)
+			if gzipped := data[2]&flagGzipBody != 0; gzipped != tt.wantGzip {
+				t.Errorf("gzipped = %v, want %v", gzipped, tt.wantGzip)
+			}
+			if tt.wantGzip && len(data) >= len(tt.cached.Body) {
+				t.Errorf("compressed entry is %d bytes for a %d byte body", len(data), len(tt.cached.Body))
+			}
+
+			got, err := decodeCachedResponse(data)
+			if err != nil {
+				t.Fatalf("decodeCachedResponse() error = %v", err)
+			}
+			assertCachedEqual(t, got, tt.cached)
+		})
+	}
+}
+
+// Entries stored as JSON by earlier gateways must still decode
+func TestDecodeCachedResponseJSON(t *testing.T) {
+	cached := &types.CachedResponse{
+		StatusCode: 200,
+		Headers:    map[string][]string{"Etag": {`"v1"`}},
+		Body:       []byte("hello"),
+		CachedAt:   time.Now(),
+		Expires:    time.Now().Add(time.Minute),
+	}
+	data, err := json.Marshal(cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := decodeCachedResponse(data)
+	if err != nil {
+		t.Fatalf("decodeCachedResponse() error = %v", err)
+	}
+	assertCachedEqual(t, got, cached)
+}
+
+func TestDecodeCachedResponseCorrupt(t *testing.T) {
+	valid := encodeCachedResponse(&types.CachedResponse{
+		StatusCode: 200,
+		Headers:    map[string][]string{"Content-Type": {"text/plain"}},
+		Body:       []byte("hello"),
+	}, false)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"wrong magic", []byte{'X', cacheCodecVersion, 0}},
+		{"unknown version", []byte{cacheCodecMagic, cacheCodecVersion + 1, 0}},
+		{"truncated", valid[:len(valid)-2]},
+		{"bad gzip", append([]byte{cacheCodecMagic, cacheCodecVersion, flagGzipBody}, bytes.Repeat([]byte{0}, 7)...)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeCachedResponse(tt.data); err == nil {
+				t.Error("decodeCachedResponse() succeeded on a corrupt entry")
+			}
+		})
+	}
+
+	if _, err := decodeCachedResponse(valid[:3]); !errors.Is(err, errCorruptEntry) {
+		t.Errorf("decodeCachedResponse() error = %v, want %v", err, errCorruptEntry)
+	}
+}
+
+func assertCachedEqual(t *testing.T, got, want *types.CachedResponse) {
+	t.Helper()
+	if got.StatusCode != want.StatusCode || got.Shared != want.Shared {
+		t.Errorf("status, shared = %d, %v, want %d, %v", got.StatusCode, got.Shared, want.StatusCode, want.Shared)
+	}
+	if !got.CachedAt.Equal(want.CachedAt) || !got.Expires.Equal(want.Expires) {
+		t.Errorf("times = %v, %v, want %v, %v", got.CachedAt, got.Expires, want.CachedAt, want.Expires)
+	}
+	if got.InitialAge != want.InitialAge || got.StaleWhileRevalidate != want.StaleWhileRevalidate || got.StaleIfError != want.StaleIfError {
+		t.Errorf("durations = %v, %v, %v, want %v, %v, %v",
+			got.InitialAge, got.StaleWhileRevalidate, got.StaleIfError,
+			want.InitialAge, want.StaleWhileRevalidate, want.StaleIfError)
+	}
+	if !reflect.DeepEqual(got.Headers, want.Headers) {
+		t.Errorf("headers = %v, want %v", got.Headers, want.Headers)
+	}
+	if !bytes.Equal(got.Body, want.Body) {
+		t.Errorf("body = %q, want %q", got.Body, want.Body)
+	}
+}
@@ -0,0 +1,186 @@
+package internals
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheControl holds the directives of Cache-Control headers, keyed by
+// lowercase name; valueless directives map to ""
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name == "" {
+				continue
+			}
+			cc[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+
+	// HTTP/1.0 clients send Pragma: no-cache instead
+	if len(cc) == 0 && strings.Contains(strings.ToLower(header.Get("Pragma")), "no-cache") {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds returns a delta-seconds directive such as max-age
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	value, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		// An invalid lifetime means stale (RFC 9111 4.2.1)
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// heuristicallyCacheable are the statuses cached without explicit freshness
+var heuristicallyCacheable = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusGone:                 true,
+}
+
+// cacheableStatus are the final statuses a cache understands
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+	http.StatusPermanentRedirect:    true,
+}
+
+// freshnessLifetime is how long a response stays fresh in a shared cache:
+// s-maxage, then max-age, then Expires, then the heuristic for statuses that
+// allow one. ok is false when the response must not be stored.
+func freshnessLifetime(resp *http.Response, cc cacheControl, heuristic time.Duration) (time.Duration, bool) {
+	if lifetime, ok := cc.seconds("s-maxage"); ok {
+		return lifetime, true
+	}
+	if lifetime, ok := cc.seconds("max-age"); ok {
+		return lifetime, true
+	}
+
+	if expires := resp.Header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return 0, true // Invalid dates mean already expired
+		}
+		date, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		return expiresAt.Sub(date), true
+	}
+
+	if !heuristicallyCacheable[resp.StatusCode] && !cc.has("public") {
+		return 0, false
+	}
+
+	// 10% of the time since the last modification, capped at the default TTL
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		if lifetime := time.Since(lastModified) / 10; lifetime < heuristic {
+			return lifetime, true
+		}
+	}
+	return heuristic, true
+}
+
+// responseAge is the Age the upstream reported for resp
+func responseAge(resp *http.Response) time.Duration {
+	age, err := strconv.ParseInt(resp.Header.Get("Age"), 10, 64)
+	if err != nil || age < 0 {
+		return 0
+	}
+	return time.Duration(age) * time.Second
+}
+
+// varyHeaders lists the request headers a response varies on, canonical and
+// sorted. star is true for Vary: *, which is never cached.
+func varyHeaders(header http.Header) (names []string, star bool) {
+	seen := map[string]bool{}
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" || seen[name] {
+				continue
+			}
+			if name == "*" {
+				return nil, true
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, false
+}
+
+// hasValidators reports whether a response can be revalidated
+func hasValidators(header http.Header) bool {
+	return header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+}
+
+// setValidators turns req into a conditional request for the cached copy
+func setValidators(req *http.Request, cached http.Header) {
+	if etag := cached.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := cached.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+}
+
+// notModified evaluates the client's If-None-Match, or else its
+// If-Modified-Since, against a response's validators (RFC 9110 13.2.2)
+func notModified(r *http.Request, header http.Header) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if match := r.Header.Values("If-None-Match"); len(match) > 0 {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(strings.Join(match, ","), ",") {
+			candidate = strings.TrimSpace(candidate)
+			// Weak comparison: W/"x" matches "x"
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
@@ -0,0 +1,151 @@
+package internals
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   cacheControl
+	}{
+		{"empty", http.Header{}, cacheControl{}},
+		{"valueless", http.Header{"Cache-Control": {"no-store"}}, cacheControl{"no-store": ""}},
+		{"arguments", http.Header{"Cache-Control": {"public, max-age=60, s-maxage=120"}}, cacheControl{"public": "", "max-age": "60", "s-maxage": "120"}},
+		{"quoted and cased", http.Header{"Cache-Control": {`Private="Set-Cookie", MAX-AGE=5`}}, cacheControl{"private": "Set-Cookie", "max-age": "5"}},
+		{"several headers", http.Header{"Cache-Control": {"max-age=5", "must-revalidate"}}, cacheControl{"max-age": "5", "must-revalidate": ""}},
+		{"empty directives", http.Header{"Cache-Control": {" , max-age=5,,"}}, cacheControl{"max-age": "5"}},
+		{"pragma", http.Header{"Pragma": {"no-cache"}}, cacheControl{"no-cache": ""}},
+		{"cache-control wins over pragma", http.Header{"Cache-Control": {"max-age=5"}, "Pragma": {"no-cache"}}, cacheControl{"max-age": "5"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseCacheControl(tt.header); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCacheControl() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheControlSeconds(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOk bool
+	}{
+		{"60", time.Minute, true},
+		{"0", 0, true},
+		{"-1", 0, true},
+		{"soon", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, ok := cacheControl{"max-age": tt.value}.seconds("max-age")
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("seconds() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+
+	if _, ok := (cacheControl{}).seconds("max-age"); ok {
+		t.Error("seconds() found a missing directive")
+	}
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	date := now.Format(http.TimeFormat)
+
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+		want   time.Duration
+		wantOk bool
+	}{
+		{"s-maxage over max-age", http.StatusOK, http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, 2 * time.Minute, true},
+		{"max-age over expires", http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, time.Minute, true},
+		{"expires from date", http.StatusOK, http.Header{"Date": {date}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, time.Hour, true},
+		{"invalid expires", http.StatusOK, http.Header{"Expires": {"0"}}, 0, true},
+		{"heuristic", http.StatusOK, http.Header{}, 5 * time.Minute, true},
+		{"heuristic from last-modified", http.StatusOK, http.Header{"Last-Modified": {now.Add(-10 * time.Minute).Format(http.TimeFormat)}}, time.Minute, true},
+		{"no heuristic for 404", http.StatusNotFound, http.Header{}, 0, false},
+		{"public allows heuristic", http.StatusNotFound, http.Header{"Cache-Control": {"public"}}, 5 * time.Minute, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: tt.header}
+			got, ok := freshnessLifetime(resp, parseCacheControl(tt.header), 5*time.Minute)
+			if ok != tt.wantOk || (got-tt.want).Abs() > time.Second {
+				t.Errorf("freshnessLifetime() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestVaryHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   http.Header
+		want     []string
+		wantStar bool
+	}{
+		{"none", http.Header{}, nil, false},
+		{"canonical and sorted", http.Header{"Vary": {"accept-language, Accept-Encoding"}}, []string{"Accept-Encoding", "Accept-Language"}, false},
+		{"deduplicated", http.Header{"Vary": {"Accept", "accept, "}}, []string{"Accept"}, false},
+		{"star", http.Header{"Vary": {"Accept, *"}}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, star := varyHeaders(tt.header)
+			if !reflect.DeepEqual(got, tt.want) || star != tt.wantStar {
+				t.Errorf("varyHeaders() = %v, %v, want %v, %v", got, star, tt.want, tt.wantStar)
+			}
+		})
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Format(http.TimeFormat)
+	earlier := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+	validators := http.Header{"Etag": {`"v2"`}, "Last-Modified": {modified}}
+
+	tests := []struct {
+		name    string
+		method  string
+		request http.Header
+		header  http.Header
+		want    bool
+	}{
+		{"matching etag", http.MethodGet, http.Header{"If-None-Match": {`"v2"`}}, validators, true},
+		{"etag in list", http.MethodGet, http.Header{"If-None-Match": {`"v1", "v2"`}}, validators, true},
+		{"weak comparison", http.MethodGet, http.Header{"If-None-Match": {`W/"v2"`}}, validators, true},
+		{"star", http.MethodGet, http.Header{"If-None-Match": {"*"}}, validators, true},
+		{"other etag", http.MethodGet, http.Header{"If-None-Match": {`"v1"`}}, validators, false},
+		{"etag wins over date", http.MethodGet, http.Header{"If-None-Match": {`"v1"`}, "If-Modified-Since": {modified}}, validators, false},
+		{"no etag to match", http.MethodGet, http.Header{"If-None-Match": {"*"}}, http.Header{"Last-Modified": {modified}}, false},
+		{"unmodified since", http.MethodHead, http.Header{"If-Modified-Since": {modified}}, validators, true},
+		{"modified since", http.MethodGet, http.Header{"If-Modified-Since": {earlier}}, validators, false},
+		{"invalid date", http.MethodGet, http.Header{"If-Modified-Since": {"yesterday"}}, validators, false},
+		{"unsafe method", http.MethodPost, http.Header{"If-None-Match": {`"v2"`}}, validators, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/api", nil)
+			r.Header = tt.request
+			if got := notModified(r, tt.header); got != tt.want {
+				t.Errorf("notModified() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
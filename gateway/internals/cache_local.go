@@ -0,0 +1,111 @@
+package internals
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+// localCache is the in-process tier in front of Redis: an LRU bounded by the
+// approximate size of its entries, each with its own expiry. A nil
+// localCache is a disabled tier that never hits.
+type localCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	items    map[string]*list.Element
+	order    *list.List // Most recently used first
+}
+
+type localEntry struct {
+	key     string
+	value   any // *types.CachedResponse, or the header names of a vary index
+	size    int64
+	expires time.Time
+}
+
+func newLocalCache(maxBytes int64) *localCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &localCache{
+		maxBytes: maxBytes,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (lc *localCache) get(key string) (any, bool) {
+	if lc == nil {
+		return nil, false
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	element, ok := lc.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*localEntry)
+	if time.Now().After(entry.expires) {
+		lc.removeElement(element)
+		return nil, false
+	}
+	lc.order.MoveToFront(element)
+	return entry.value, true
+}
+
+// set adds or replaces key for ttl, evicting the least recently used
+// entries to make room. Entries larger than an eighth of the tier are left
+// to Redis.
+func (lc *localCache) set(key string, value any, size int64, ttl time.Duration) {
+	if lc == nil || ttl <= 0 || size > lc.maxBytes/8 {
+		return
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if element, ok := lc.items[key]; ok {
+		lc.removeElement(element)
+	}
+	lc.items[key] = lc.order.PushFront(&localEntry{key: key, value: value, size: size, expires: time.Now().Add(ttl)})
+	lc.size += size
+
+	for lc.size > lc.maxBytes {
+		lc.removeElement(lc.order.Back())
+	}
+}
+
+func (lc *localCache) remove(keys ...string) {
+	if lc == nil {
+		return
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	for _, key := range keys {
+		if element, ok := lc.items[key]; ok {
+			lc.removeElement(element)
+		}
+	}
+}
+
+func (lc *localCache) removeElement(element *list.Element) {
+	entry := lc.order.Remove(element).(*localEntry)
+	delete(lc.items, entry.key)
+	lc.size -= entry.size
+}
+
+// entrySize approximates the memory a cached response holds
+func entrySize(cached *types.CachedResponse) int64 {
+	size := int64(len(cached.Body)) + 256
+	for name, values := range cached.Headers {
+		size += int64(len(name))
+		for _, value := range values {
+			size += int64(len(value)) + 16
+		}
+	}
+	return size
+}
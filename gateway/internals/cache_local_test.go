@@ -0,0 +1,84 @@
+package internals
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLocalCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	lc := newLocalCache(800)
+	lc.set("a", "a", 100, time.Minute)
+	lc.set("b", "b", 100, time.Minute)
+	lc.get("a")
+	for _, key := range []string{"c", "d", "e", "f", "g", "h", "i"} {
+		lc.set(key, key, 100, time.Minute)
+	}
+
+	if _, ok := lc.get("b"); ok {
+		t.Error("b survived eviction")
+	}
+	if _, ok := lc.get("a"); !ok {
+		t.Error("a was evicted although recently used")
+	}
+	if lc.size > lc.maxBytes {
+		t.Errorf("size = %d, over the %d limit", lc.size, lc.maxBytes)
+	}
+}
+
+func TestLocalCache(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int64
+		ttl    time.Duration
+		wait   time.Duration
+		wantOk bool
+	}{
+		{"hit", 100, time.Minute, 0, true},
+		{"expired", 100, 10 * time.Millisecond, 20 * time.Millisecond, false},
+		{"no ttl", 100, 0, 0, false},
+		{"too large", 200, time.Minute, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lc := newLocalCache(1000)
+			lc.set("key", "value", tt.size, tt.ttl)
+			time.Sleep(tt.wait)
+
+			value, ok := lc.get("key")
+			if ok != tt.wantOk {
+				t.Fatalf("get() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if ok && value != "value" {
+				t.Errorf("get() = %v, want value", value)
+			}
+		})
+	}
+}
+
+func TestLocalCacheReplaceAndRemove(t *testing.T) {
+	lc := newLocalCache(1000)
+	lc.set("key", "old", 100, time.Minute)
+	lc.set("key", "new", 50, time.Minute)
+	if value, _ := lc.get("key"); value != "new" || lc.size != 50 {
+		t.Errorf("get() = %v with size %d, want new with size 50", value, lc.size)
+	}
+
+	lc.remove("key", "missing")
+	if _, ok := lc.get("key"); ok || lc.size != 0 {
+		t.Errorf("key still cached after remove, size %d", lc.size)
+	}
+}
+
+// A disabled tier is nil and must be safe to use
+func TestLocalCacheDisabled(t *testing.T) {
+	lc := newLocalCache(0)
+	if lc != nil {
+		t.Fatal("newLocalCache(0) returned an enabled tier")
+	}
+	lc.set("key", "value", 1, time.Minute)
+	lc.remove("key")
+	if _, ok := lc.get("key"); ok {
+		t.Error("disabled tier hit")
+	}
+}
@@ -0,0 +1,158 @@
+package internals
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+func TestCoalesceSkipsUnsharedRequests(t *testing.T) {
+	policy := &types.CacheConfig{Enabled: true}
+	byConsumer := &types.CacheConfig{Enabled: true, Key: &types.CacheKeyConfig{Consumer: true}}
+
+	tests := []struct {
+		name    string
+		policy  *types.CacheConfig
+		headers map[string]string
+		waits   bool
+	}{
+		{"plain request", policy, nil, true},
+		{"authorization", policy, map[string]string{"Authorization": "Bearer x"}, false},
+		{"authorization keyed by consumer", byConsumer, map[string]string{"Authorization": "Bearer x", "X-API-Key": "k"}, true},
+		{"authorization without a consumer", byConsumer, map[string]string{"Authorization": "Bearer x"}, false},
+		{"no-cache", policy, map[string]string{"Cache-Control": "no-cache"}, false},
+		{"no-store", policy, map[string]string{"Cache-Control": "no-store"}, false},
+		{"pragma no-cache", policy, map[string]string{"Pragma": "no-cache"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, _ := newTestGateway(t, "http://127.0.0.1:1", true, &types.RouteConfig{Cache: tt.policy})
+			route := &RouteMatch{Route: testRoute(t, "/api", nil)}
+			route.Config.Cache = tt.policy
+
+			r := httptest.NewRequest(http.MethodGet, "/api/items", nil)
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			r = withConsumer(r)
+
+			// Another request is already fetching the resource
+			leader := httptest.NewRequest(http.MethodGet, "/api/items", nil)
+			leader.Header = r.Header.Clone()
+			leader.Header.Del("Cache-Control")
+			leader.Header.Del("Pragma")
+			leader = withConsumer(leader)
+			release := g.cache.Coalesce(leader, route)
+			if release == nil {
+				t.Fatal("first request did not lead")
+			}
+			time.AfterFunc(100*time.Millisecond, release)
+
+			start := time.Now()
+			got := g.cache.Coalesce(r, route)
+			waited := time.Since(start) >= 100*time.Millisecond
+
+			if waited != tt.waits {
+				t.Errorf("waited = %v, want %v", waited, tt.waits)
+			}
+			if (got == nil) != tt.waits {
+				t.Errorf("Coalesce() leader = %v, want %v", got != nil, !tt.waits)
+			}
+			if got != nil {
+				got()
+				got() // Releasing twice is a no-op
+			}
+		})
+	}
+}
+
+// Requests authenticated without an API key have no consumer to key their
+// entries by, so they never read or store private responses
+func TestCacheConsumerKeyRequiresConsumer(t *testing.T) {
+	policy := &types.CacheConfig{Enabled: true, Key: &types.CacheKeyConfig{Consumer: true}}
+
+	tests := []struct {
+		name        string
+		owner, peer map[string]string
+		wantShared  bool
+	}{
+		{"bearer tokens", map[string]string{"Authorization": "Bearer alice"}, map[string]string{"Authorization": "Bearer bob"}, false},
+		{"same api key", map[string]string{"Authorization": "Bearer x", "X-API-Key": "k1"}, map[string]string{"Authorization": "Bearer y", "X-API-Key": "k1"}, true},
+		{"other api key", map[string]string{"Authorization": "Bearer x", "X-API-Key": "k1"}, map[string]string{"Authorization": "Bearer x", "X-API-Key": "k2"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, _ := newTestGateway(t, "http://127.0.0.1:1", true, &types.RouteConfig{Cache: policy})
+			route := &RouteMatch{Route: testRoute(t, "/api", nil)}
+			route.Config.Cache = policy
+
+			request := func(headers map[string]string) *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/api/me", nil)
+				for name, value := range headers {
+					r.Header.Set(name, value)
+				}
+				return withConsumer(r)
+			}
+
+			resp := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Cache-Control": {"max-age=60"}},
+				Body:       io.NopCloser(strings.NewReader("private")),
+			}
+			g.cache.Set(request(tt.owner), resp, route)
+			io.ReadAll(resp.Body)
+
+			cached, _ := g.cache.Get(request(tt.peer), route)
+			if shared := cached != nil; shared != tt.wantShared {
+				t.Errorf("peer got the owner's response = %v, want %v", shared, tt.wantShared)
+			}
+		})
+	}
+}
+
+// A leader whose response turns out uncacheable lets the waiting requests go
+// upstream as soon as it has the headers, not once its body is done
+func TestCoalesceReleasesFollowersOnUncacheableResponse(t *testing.T) {
+	var mu sync.Mutex
+	var arrivals []time.Time
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		arrivals = append(arrivals, time.Now())
+		mu.Unlock()
+
+		w.Header().Set("Cache-Control", "private")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+	defer upstream.Close()
+
+	g, _ := newTestGateway(t, upstream.URL, true, &types.RouteConfig{Cache: &types.CacheConfig{Enabled: true}})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.ProxyHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/items", nil))
+		}()
+		time.Sleep(50 * time.Millisecond)
+	}
+	wg.Wait()
+
+	if len(arrivals) != 2 {
+		t.Fatalf("upstream saw %d requests, want 2", len(arrivals))
+	}
+	if gap := arrivals[1].Sub(arrivals[0]); gap >= 250*time.Millisecond {
+		t.Errorf("follower reached the upstream %v after the leader, want it released before the leader's body ended", gap)
+	}
+}
@@ -2,11 +2,14 @@ package internals
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/chann44/ikyk/pkg/logger"
+	"github.com/chann44/ikyk/pkg/types"
+	"github.com/redis/go-redis/v9"
 )
 
 type CircuitState string
@@ -15,130 +18,439 @@ const (
 	StateClosed   CircuitState = "closed"
 	StateOpen     CircuitState = "open"
 	StateHalfOpen CircuitState = "half-open"
+
+	// Set by operators through the management API; they hold until reset
+	StateForcedOpen   CircuitState = "forced-open"
+	StateForcedClosed CircuitState = "forced-closed"
+)
+
+// circuitStates are the states exported by the state gauge
+var circuitStates = []CircuitState{StateClosed, StateOpen, StateHalfOpen, StateForcedOpen, StateForcedClosed}
+
+// CircuitEventsChannel carries types.CircuitEvent messages published when a
+// breaker changes state
+const CircuitEventsChannel = "circuit:events"
+
+const (
+	// circuitStateTTL forgets a breaker nobody has called for a day
+	circuitStateTTL = 24 * time.Hour
+	// circuitResyncInterval refreshes the state gauge in case events were missed
+	circuitResyncInterval = 30 * time.Second
+	// countWindowTTL drops a count window once a service has been idle this
+	// long, so stale outcomes don't trip the breaker on its next burst
+	countWindowTTL = 10 * time.Minute
 )
 
+// allowCall is the admission half of the breaker's state machine, run
+// atomically so replicas agree on transitions. An open breaker turns
+// half-open once its timeout has elapsed; a half-open one admits at most
+// the permitted number of probes in flight. Forced states are left alone.
+// Returns {allowed, from, to, reason}, with from and to set only on a
+// transition.
+//
+// KEYS: breaker hash
+// ARGV: timeout ms, permitted probes, breaker TTL seconds
+var allowCall = redis.NewScript(`
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local timeout = tonumber(ARGV[1])
+
+local breaker = redis.call("HMGET", KEYS[1], "state", "changed_at", "probes", "probe_at")
+local state = breaker[1] or "closed"
+
+if state == "forced-open" then
+	return {0}
+end
+
+if state == "open" then
+	if now - (tonumber(breaker[2]) or 0) < timeout then
+		return {0}
+	end
+	redis.call("HSET", KEYS[1], "state", "half-open", "changed_at", now, "probes", 1, "successes", 0, "probe_at", now)
+	redis.call("EXPIRE", KEYS[1], ARGV[3])
+	return {1, "open", "half-open", "timeout elapsed"}
+end
+
+if state == "half-open" then
+	local probes = tonumber(breaker[3]) or 0
+	if probes >= tonumber(ARGV[2]) then
+		-- Probes that never reported back free their slots after the timeout
+		if now - (tonumber(breaker[4]) or 0) < timeout then
+			return {0}
+		end
+		probes = 0
+	end
+	redis.call("HSET", KEYS[1], "probes", probes + 1, "probe_at", now)
+end
+return {1}
+`)
+
+// recordCall is the outcome half of the state machine. While closed it adds
+// the call to the sliding window and opens the breaker once the window holds
+// the minimum calls and a rate reaches its threshold. Count windows keep
+// the outcomes in a list with running totals in a hash; time windows keep
+// per-second buckets in a hash and drop the ones that fell out of the window.
+// While half-open a failure reopens the breaker and enough successes close
+// it. Returns {from, to, reason} on a transition and {} otherwise.
+//
+// KEYS: breaker hash, calls list, totals hash, buckets hash
+// ARGV: window type, window size, failed (0/1), slow (0/1), count window TTL
+// seconds, success threshold, minimum calls, failure rate threshold, slow
+// call rate threshold, breaker TTL seconds
+var recordCall = redis.NewScript(`
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local size = tonumber(ARGV[2])
+local failed = tonumber(ARGV[3])
+local slow = tonumber(ARGV[4])
+
+local function transition(to)
+	redis.call("HSET", KEYS[1], "state", to, "changed_at", now, "probes", 0, "successes", 0)
+	redis.call("EXPIRE", KEYS[1], ARGV[10])
+	redis.call("DEL", KEYS[2], KEYS[3], KEYS[4])
+end
+
+local state = redis.call("HGET", KEYS[1], "state") or "closed"
+
+if state == "open" or state == "forced-open" or state == "forced-closed" then
+	-- Admitted before the breaker opened, or forced by an operator
+	return {}
+end
+
+if state == "half-open" then
+	if failed == 1 then
+		transition("open")
+		return {"half-open", "open", "probe failed"}
+	end
+	if redis.call("HINCRBY", KEYS[1], "successes", 1) >= tonumber(ARGV[6]) then
+		transition("closed")
+		return {"half-open", "closed", "probes succeeded"}
+	end
+	if (tonumber(redis.call("HGET", KEYS[1], "probes")) or 0) > 0 then
+		redis.call("HINCRBY", KEYS[1], "probes", -1)
+	end
+	return {}
+end
+
+local calls, failures, slows = 0, 0, 0
+if ARGV[1] == "time" then
+	local second = math.floor(now / 1000)
+	redis.call("HINCRBY", KEYS[4], second .. ":c", 1)
+	if failed == 1 then
+		redis.call("HINCRBY", KEYS[4], second .. ":f", 1)
+	end
+	if slow == 1 then
+		redis.call("HINCRBY", KEYS[4], second .. ":s", 1)
+	end
+
+	local expired = {}
+	local fields = redis.call("HGETALL", KEYS[4])
+	for i = 1, #fields, 2 do
+		local bucket, kind = string.match(fields[i], "^(%d+):(%a)$")
+		if bucket == nil or tonumber(bucket) <= second - size then
+			table.insert(expired, fields[i])
+		else
+			local n = tonumber(fields[i + 1])
+			if kind == "c" then
+				calls = calls + n
+			elseif kind == "f" then
+				failures = failures + n
+			else
+				slows = slows + n
+			end
+		end
+	end
+	if #expired > 0 then
+		redis.call("HDEL", KEYS[4], unpack(expired))
+	end
+	redis.call("EXPIRE", KEYS[4], size + 1)
+else
+	redis.call("LPUSH", KEYS[2], failed * 2 + slow)
+	redis.call("HINCRBY", KEYS[3], "calls", 1)
+	redis.call("HINCRBY", KEYS[3], "failures", failed)
+	redis.call("HINCRBY", KEYS[3], "slow", slow)
+
+	-- Evict the oldest outcomes, more than one if the window shrank
+	while redis.call("LLEN", KEYS[2]) > size do
+		local outcome = tonumber(redis.call("RPOP", KEYS[2]))
+		redis.call("HINCRBY", KEYS[3], "calls", -1)
+		if outcome >= 2 then
+			redis.call("HINCRBY", KEYS[3], "failures", -1)
+		end
+		if outcome % 2 == 1 then
+			redis.call("HINCRBY", KEYS[3], "slow", -1)
+		end
+	end
+
+	redis.call("EXPIRE", KEYS[2], ARGV[5])
+	redis.call("EXPIRE", KEYS[3], ARGV[5])
+	local totals = redis.call("HMGET", KEYS[3], "calls", "failures", "slow")
+	calls, failures, slows = tonumber(totals[1]) or 0, tonumber(totals[2]) or 0, tonumber(totals[3]) or 0
+end
+
+if calls == 0 or calls < tonumber(ARGV[7]) then
+	return {}
+end
+
+local failureRate = failures * 100 / calls
+local slowRate = slows * 100 / calls
+local reason
+if failureRate >= tonumber(ARGV[8]) then
+	reason = string.format("failure rate %.1f%% over %d calls", failureRate, calls)
+elseif slowRate >= tonumber(ARGV[9]) then
+	reason = string.format("slow call rate %.1f%% over %d calls", slowRate, calls)
+else
+	return {}
+end
+
+transition("open")
+return {"closed", "open", reason}
+`)
+
+// releaseProbe frees the half-open probe slot of a call that ended without
+// an outcome for the service, e.g. one answered by an injected fault
+//
+// KEYS: breaker hash
+var releaseProbe = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "state") == "half-open" and (tonumber(redis.call("HGET", KEYS[1], "probes")) or 0) > 0 then
+	redis.call("HINCRBY", KEYS[1], "probes", -1)
+end
+return 0
+`)
+
 type CircuitBreaker struct {
-	storage          *RedisClient
-	log              *logger.Logger
-	failureThreshold int
-	successThreshold int
-	timeout          time.Duration
-	mu               sync.RWMutex
+	storage  *RedisClient
+	log      *logger.Logger
+	registry *Registery
+	metrics  *MetricsCollector
+	defaults types.CircuitBreakerConfig
 }
 
-func NewCircuitBreaker(storage *RedisClient, log *logger.Logger, failThreshold, successThreshold int, timeout time.Duration) *CircuitBreaker {
+// NewCircuitBreaker creates a breaker whose defaults apply to services
+// without a policy in the registry, and to unset fields of stored policies
+func NewCircuitBreaker(storage *RedisClient, log *logger.Logger, registry *Registery, metrics *MetricsCollector, defaults types.CircuitBreakerConfig) *CircuitBreaker {
 	return &CircuitBreaker{
-		storage:          storage,
-		log:              log,
-		failureThreshold: failThreshold,
-		successThreshold: successThreshold,
-		timeout:          timeout,
+		storage:  storage,
+		log:      log,
+		registry: registry,
+		metrics:  metrics,
+		defaults: defaults,
 	}
 }
 
+// policy resolves the breaker settings for a service
+func (cb *CircuitBreaker) policy(ctx context.Context, serviceName string) types.CircuitBreakerConfig {
+	policy := cb.defaults
+	if cb.registry == nil {
+		return policy
+	}
+
+	config := cb.registry.CircuitBreakerConfig(ctx, serviceName)
+	if config == nil {
+		return policy
+	}
+	if config.Enabled != nil {
+		policy.Enabled = config.Enabled
+	}
+	if config.SuccessThreshold > 0 {
+		policy.SuccessThreshold = config.SuccessThreshold
+	}
+	if config.PermittedHalfOpenCalls > 0 {
+		policy.PermittedHalfOpenCalls = config.PermittedHalfOpenCalls
+	}
+	if config.Timeout > 0 {
+		policy.Timeout = config.Timeout
+	}
+	if config.WindowType != "" {
+		policy.WindowType = config.WindowType
+	}
+	if config.WindowSize > 0 {
+		policy.WindowSize = config.WindowSize
+	}
+	if config.MinimumCalls > 0 {
+		policy.MinimumCalls = config.MinimumCalls
+	}
+	if config.FailureRateThreshold > 0 {
+		policy.FailureRateThreshold = config.FailureRateThreshold
+	}
+	if config.SlowCallDurationThreshold > 0 {
+		policy.SlowCallDurationThreshold = config.SlowCallDurationThreshold
+	}
+	if config.SlowCallRateThreshold > 0 {
+		policy.SlowCallRateThreshold = config.SlowCallRateThreshold
+	}
+	return policy
+}
+
+// breakerEnabled reports whether policy turns the breaker on; it is unless
+// a stored policy says otherwise
+func breakerEnabled(policy types.CircuitBreakerConfig) bool {
+	return policy.Enabled == nil || *policy.Enabled
+}
+
+// AllowRequest reports whether a call to the service may go through. Redis
+// errors fail open.
 func (cb *CircuitBreaker) AllowRequest(serviceName string) bool {
 	ctx := context.Background()
-	state := cb.getState(ctx, serviceName)
-
-	switch state {
-	case StateClosed:
+	policy := cb.policy(ctx, serviceName)
+	if !breakerEnabled(policy) {
 		return true
-	case StateOpen:
-		// Check if timeout has passed
-		lastFailure := cb.getLastFailureTime(ctx, serviceName)
-		if time.Since(lastFailure) > cb.timeout {
-			cb.setState(ctx, serviceName, StateHalfOpen)
-			return true
-		}
-		return false
-	case StateHalfOpen:
+	}
+
+	result, err := allowCall.Run(ctx, cb.storage, []string{cb.breakerKey(serviceName)},
+		policy.Timeout.Milliseconds(), policy.PermittedHalfOpenCalls, int(circuitStateTTL.Seconds()),
+	).Slice()
+	if err != nil || len(result) == 0 {
+		cb.log.Error("failed to check circuit breaker", "service", serviceName, "error", err)
 		return true
 	}
 
-	return true
+	cb.transitioned(ctx, serviceName, result[1:])
+	allowed, _ := result[0].(int64)
+	return allowed == 1
 }
 
-func (cb *CircuitBreaker) RecordSuccess(serviceName string) {
-	ctx := context.Background()
-	state := cb.getState(ctx, serviceName)
-
-	if state == StateHalfOpen {
-		successCount := cb.incrementSuccess(ctx, serviceName)
-		if successCount >= cb.successThreshold {
-			cb.setState(ctx, serviceName, StateClosed)
-			cb.resetCounters(ctx, serviceName)
-			cb.log.Info("circuit breaker closed", "service", serviceName)
-		}
-	} else if state == StateClosed {
-		cb.resetCounters(ctx, serviceName)
-	}
+// RecordSuccess records a call the service answered; duration is its latency,
+// or zero when it should not count towards the slow-call rate
+func (cb *CircuitBreaker) RecordSuccess(serviceName string, duration time.Duration) {
+	cb.record(serviceName, false, duration)
 }
 
-func (cb *CircuitBreaker) RecordFailure(serviceName string) {
-	ctx := context.Background()
-	state := cb.getState(ctx, serviceName)
+// RecordFailure records a failed call; duration is as for RecordSuccess
+func (cb *CircuitBreaker) RecordFailure(serviceName string, duration time.Duration) {
+	cb.record(serviceName, true, duration)
+}
 
-	if state == StateHalfOpen {
-		cb.setState(ctx, serviceName, StateOpen)
-		cb.setLastFailureTime(ctx, serviceName)
-		cb.log.Warn("circuit breaker reopened", "service", serviceName)
+// Release returns the probe slot of an admitted call that never reached the
+// service, so a half-open breaker can admit another probe
+func (cb *CircuitBreaker) Release(serviceName string) {
+	ctx := context.Background()
+	if !breakerEnabled(cb.policy(ctx, serviceName)) {
 		return
 	}
 
-	if state == StateClosed {
-		failureCount := cb.incrementFailure(ctx, serviceName)
-		if failureCount >= cb.failureThreshold {
-			cb.setState(ctx, serviceName, StateOpen)
-			cb.setLastFailureTime(ctx, serviceName)
-			cb.log.Warn("circuit breaker opened", "service", serviceName, "failures", failureCount)
-		}
+	if err := releaseProbe.Run(ctx, cb.storage, []string{cb.breakerKey(serviceName)}).Err(); err != nil {
+		cb.log.Error("failed to release circuit breaker probe", "service", serviceName, "error", err)
 	}
 }
 
-func (cb *CircuitBreaker) getState(ctx context.Context, serviceName string) CircuitState {
-	key := fmt.Sprintf("circuit:%s:state", serviceName)
-	state, err := cb.storage.Get(ctx, key).Result()
+func (cb *CircuitBreaker) record(serviceName string, failed bool, duration time.Duration) {
+	ctx := context.Background()
+	policy := cb.policy(ctx, serviceName)
+	if !breakerEnabled(policy) {
+		return
+	}
+	slow := duration > 0 && duration >= policy.SlowCallDurationThreshold
+
+	keys := append([]string{cb.breakerKey(serviceName)}, cb.windowKeys(serviceName)...)
+	result, err := recordCall.Run(ctx, cb.storage, keys,
+		policy.WindowType, policy.WindowSize, boolFlag(failed), boolFlag(slow), int(countWindowTTL.Seconds()),
+		policy.SuccessThreshold, policy.MinimumCalls, policy.FailureRateThreshold, policy.SlowCallRateThreshold,
+		int(circuitStateTTL.Seconds()),
+	).Slice()
 	if err != nil {
-		return StateClosed
+		cb.log.Error("failed to record circuit breaker call", "service", serviceName, "error", err)
+		return
 	}
-	return CircuitState(state)
+
+	cb.transitioned(ctx, serviceName, result)
 }
 
-func (cb *CircuitBreaker) setState(ctx context.Context, serviceName string, state CircuitState) {
-	key := fmt.Sprintf("circuit:%s:state", serviceName)
-	cb.storage.Set(ctx, key, string(state), 24*time.Hour)
+// transitioned logs and publishes the {from, to, reason} transition a
+// script returned, if any
+func (cb *CircuitBreaker) transitioned(ctx context.Context, serviceName string, transition []interface{}) {
+	if len(transition) < 3 {
+		return
+	}
+	from, _ := transition[0].(string)
+	to, _ := transition[1].(string)
+	reason, _ := transition[2].(string)
+
+	if CircuitState(to) == StateOpen {
+		cb.log.Warn("circuit breaker opened", "service", serviceName, "from", from, "reason", reason)
+	} else {
+		cb.log.Info("circuit breaker "+to, "service", serviceName, "from", from, "reason", reason)
+	}
+	cb.metrics.SetCircuitState(serviceName, to)
+
+	event, _ := json.Marshal(types.CircuitEvent{
+		Service: serviceName,
+		From:    from,
+		To:      to,
+		Reason:  reason,
+		At:      time.Now(),
+	})
+	if err := cb.storage.Publish(ctx, CircuitEventsChannel, event).Err(); err != nil {
+		cb.log.Warn("failed to publish circuit event", "error", err)
+	}
 }
 
-func (cb *CircuitBreaker) incrementFailure(ctx context.Context, serviceName string) int {
-	key := fmt.Sprintf("circuit:%s:failures", serviceName)
-	count, _ := cb.storage.Incr(ctx, key).Result()
-	cb.storage.Expire(ctx, key, 10*time.Minute)
-	return int(count)
+// Watch keeps the state gauge current: it follows the transitions published
+// by every gateway and the management API, and rereads all breakers
+// periodically in case events were missed
+func (cb *CircuitBreaker) Watch(ctx context.Context) {
+	pubsub := cb.storage.Subscribe(ctx, CircuitEventsChannel)
+	defer pubsub.Close()
+
+	events := pubsub.Channel()
+	ticker := time.NewTicker(circuitResyncInterval)
+	defer ticker.Stop()
+
+	cb.resync(ctx)
+	for {
+		select {
+		case msg, ok := <-events:
+			if !ok {
+				return
+			}
+			var event types.CircuitEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				cb.log.Warn("invalid circuit event", "error", err)
+				continue
+			}
+			cb.metrics.SetCircuitState(event.Service, event.To)
+		case <-ticker.C:
+			cb.resync(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
-func (cb *CircuitBreaker) incrementSuccess(ctx context.Context, serviceName string) int {
-	key := fmt.Sprintf("circuit:%s:successes", serviceName)
-	count, _ := cb.storage.Incr(ctx, key).Result()
-	cb.storage.Expire(ctx, key, 5*time.Minute)
-	return int(count)
+// resync sets the state gauge from the breakers stored in Redis
+func (cb *CircuitBreaker) resync(ctx context.Context) {
+	iter := cb.storage.Scan(ctx, 0, "circuit:*:breaker", 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		state, err := cb.storage.HGet(ctx, key, "state").Result()
+		if err != nil {
+			continue
+		}
+		serviceName := strings.TrimSuffix(strings.TrimPrefix(key, "circuit:"), ":breaker")
+		cb.metrics.SetCircuitState(serviceName, state)
+	}
+	if err := iter.Err(); err != nil {
+		cb.log.Warn("failed to read circuit breaker states", "error", err)
+	}
 }
 
-func (cb *CircuitBreaker) resetCounters(ctx context.Context, serviceName string) {
-	cb.storage.Del(ctx,
-		fmt.Sprintf("circuit:%s:failures", serviceName),
-		fmt.Sprintf("circuit:%s:successes", serviceName))
+// breakerKey holds a service's state, when it last changed and its
+// half-open probes
+func (cb *CircuitBreaker) breakerKey(serviceName string) string {
+	return fmt.Sprintf("circuit:%s:breaker", serviceName)
 }
 
-func (cb *CircuitBreaker) setLastFailureTime(ctx context.Context, serviceName string) {
-	key := fmt.Sprintf("circuit:%s:last_failure", serviceName)
-	cb.storage.Set(ctx, key, time.Now().Unix(), 24*time.Hour)
+func (cb *CircuitBreaker) windowKeys(serviceName string) []string {
+	return []string{
+		fmt.Sprintf("circuit:%s:calls", serviceName),
+		fmt.Sprintf("circuit:%s:calls:totals", serviceName),
+		fmt.Sprintf("circuit:%s:buckets", serviceName),
+	}
 }
 
-func (cb *CircuitBreaker) getLastFailureTime(ctx context.Context, serviceName string) time.Time {
-	key := fmt.Sprintf("circuit:%s:last_failure", serviceName)
-	timestamp, err := cb.storage.Get(ctx, key).Int64()
-	if err != nil {
-		return time.Time{}
+func boolFlag(b bool) int {
+	if b {
+		return 1
 	}
-	return time.Unix(timestamp, 0)
+	return 0
 }
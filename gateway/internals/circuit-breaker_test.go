@@ -0,0 +1,265 @@
+package internals
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+func newTestBreaker(t *testing.T, defaults types.CircuitBreakerConfig) (*CircuitBreaker, *miniredis.Miniredis) {
+	t.Helper()
+	client, mr := newTestRedis(t)
+	return NewCircuitBreaker(client, newTestLogger(), nil, testMetrics, defaults), mr
+}
+
+// setBreaker stores a breaker that changed state ago
+func setBreaker(mr *miniredis.Miniredis, state CircuitState, ago time.Duration) {
+	mr.HSet("circuit:svc:breaker",
+		"state", string(state),
+		"changed_at", strconv.FormatInt(time.Now().Add(-ago).UnixMilli(), 10),
+		"probes", "0",
+		"successes", "0")
+}
+
+type call struct {
+	failed   bool
+	duration time.Duration
+}
+
+func calls(n int, failed bool, duration time.Duration) []call {
+	out := make([]call, n)
+	for i := range out {
+		out[i] = call{failed, duration}
+	}
+	return out
+}
+
+func TestCircuitBreakerOpensOnRates(t *testing.T) {
+	slow := 2 * time.Second
+
+	tests := []struct {
+		name      string
+		calls     []call
+		wantState string
+	}{
+		{"under minimum calls", calls(3, true, 0), ""},
+		{"failure rate reached", append(calls(2, false, 0), calls(2, true, 0)...), "open"},
+		{"failure rate below threshold", append(calls(3, false, 0), calls(1, true, 0)...), ""},
+		{"slow rate reached", calls(4, false, slow), "open"},
+		{"slow failures", calls(4, true, slow), "open"},
+		{"failures evicted from the window", append(calls(1, true, 0), calls(12, false, 0)...), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb, mr := newTestBreaker(t, testBreakerDefaults)
+			for _, c := range tt.calls {
+				if !cb.AllowRequest("svc") {
+					t.Fatal("call rejected before the breaker opened")
+				}
+				if c.failed {
+					cb.RecordFailure("svc", c.duration)
+				} else {
+					cb.RecordSuccess("svc", c.duration)
+				}
+			}
+
+			if state := mr.HGet("circuit:svc:breaker", "state"); state != tt.wantState {
+				t.Errorf("state = %q, want %q", state, tt.wantState)
+			}
+			if tt.wantState == "open" && cb.AllowRequest("svc") {
+				t.Error("open breaker admitted a call")
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerCountWindowTotals(t *testing.T) {
+	cb, mr := newTestBreaker(t, testBreakerDefaults)
+	cb.RecordFailure("svc", 0)
+	for i := 0; i < 12; i++ {
+		cb.RecordSuccess("svc", 0)
+	}
+
+	if got := mr.HGet("circuit:svc:calls:totals", "calls"); got != "10" {
+		t.Errorf("calls = %s, want the window size 10", got)
+	}
+	if got := mr.HGet("circuit:svc:calls:totals", "failures"); got != "0" {
+		t.Errorf("failures = %s, want 0 once the failure left the window", got)
+	}
+}
+
+func TestCircuitBreakerTimeWindow(t *testing.T) {
+	defaults := testBreakerDefaults
+	defaults.WindowType = "time"
+	defaults.WindowSize = 10
+	cb, mr := newTestBreaker(t, defaults)
+
+	// A bucket from long ago must not count and is dropped
+	mr.HSet("circuit:svc:buckets", "1:c", "100", "1:f", "100")
+	for i := 0; i < 4; i++ {
+		cb.RecordSuccess("svc", 0)
+	}
+	if state := mr.HGet("circuit:svc:breaker", "state"); state != "" {
+		t.Fatalf("state = %q after successes, want closed", state)
+	}
+	if mr.HGet("circuit:svc:buckets", "1:f") != "" {
+		t.Error("expired bucket kept")
+	}
+
+	for i := 0; i < 4; i++ {
+		cb.RecordFailure("svc", 0)
+	}
+	if state := mr.HGet("circuit:svc:breaker", "state"); state != "open" {
+		t.Errorf("state = %q after failures, want open", state)
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	t.Run("stays open until the timeout", func(t *testing.T) {
+		cb, mr := newTestBreaker(t, testBreakerDefaults)
+		setBreaker(mr, StateOpen, 30*time.Second)
+		if cb.AllowRequest("svc") {
+			t.Error("open breaker admitted a call before its timeout")
+		}
+	})
+
+	t.Run("probes succeed", func(t *testing.T) {
+		cb, mr := newTestBreaker(t, testBreakerDefaults)
+		setBreaker(mr, StateOpen, 2*time.Minute)
+
+		if !cb.AllowRequest("svc") {
+			t.Fatal("first probe rejected after the timeout")
+		}
+		if state := mr.HGet("circuit:svc:breaker", "state"); state != "half-open" {
+			t.Fatalf("state = %q, want half-open", state)
+		}
+		if cb.AllowRequest("svc") {
+			t.Error("second probe admitted over the permitted calls")
+		}
+
+		cb.RecordSuccess("svc", 0)
+		if state := mr.HGet("circuit:svc:breaker", "state"); state != "half-open" {
+			t.Fatalf("state = %q after one success, want half-open", state)
+		}
+		if !cb.AllowRequest("svc") {
+			t.Fatal("probe rejected after the previous one succeeded")
+		}
+		cb.RecordSuccess("svc", 0)
+		if state := mr.HGet("circuit:svc:breaker", "state"); state != "closed" {
+			t.Errorf("state = %q after the success threshold, want closed", state)
+		}
+	})
+
+	t.Run("probe fails", func(t *testing.T) {
+		cb, mr := newTestBreaker(t, testBreakerDefaults)
+		setBreaker(mr, StateOpen, 2*time.Minute)
+
+		cb.AllowRequest("svc")
+		cb.RecordFailure("svc", 0)
+		if state := mr.HGet("circuit:svc:breaker", "state"); state != "open" {
+			t.Errorf("state = %q, want open", state)
+		}
+		if cb.AllowRequest("svc") {
+			t.Error("reopened breaker admitted a call")
+		}
+	})
+
+	t.Run("lost probe frees its slot after the timeout", func(t *testing.T) {
+		cb, mr := newTestBreaker(t, testBreakerDefaults)
+		setBreaker(mr, StateHalfOpen, 2*time.Minute)
+		mr.HSet("circuit:svc:breaker", "probes", "1",
+			"probe_at", strconv.FormatInt(time.Now().Add(-2*time.Minute).UnixMilli(), 10))
+
+		if !cb.AllowRequest("svc") {
+			t.Error("probe rejected although the previous one timed out")
+		}
+	})
+}
+
+func TestCircuitBreakerForcedStates(t *testing.T) {
+	tests := []struct {
+		state       CircuitState
+		wantAllowed bool
+	}{
+		{StateForcedOpen, false},
+		{StateForcedClosed, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.state), func(t *testing.T) {
+			cb, mr := newTestBreaker(t, testBreakerDefaults)
+			setBreaker(mr, tt.state, 2*time.Minute)
+
+			for i := 0; i < 10; i++ {
+				if allowed := cb.AllowRequest("svc"); allowed != tt.wantAllowed {
+					t.Fatalf("AllowRequest() = %v, want %v", allowed, tt.wantAllowed)
+				}
+				cb.RecordFailure("svc", 0)
+			}
+			if state := mr.HGet("circuit:svc:breaker", "state"); state != string(tt.state) {
+				t.Errorf("state = %q, want %q held", state, tt.state)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerStoredEnabled(t *testing.T) {
+	tests := []struct {
+		name        string
+		stored      string
+		wantAllowed bool
+	}{
+		{"disabled", `{"enabled":false}`, true},
+		{"enabled", `{"enabled":true}`, false},
+		{"unset keeps the default", `{"window_size":50}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mr := newTestRedis(t)
+			log := newTestLogger()
+			registry := NewRegistery(client, log, NewLoadTracker())
+			cb := NewCircuitBreaker(client, log, registry, testMetrics, testBreakerDefaults)
+			mr.Set("registry:service:svc:circuit", tt.stored)
+			setBreaker(mr, StateForcedOpen, 0)
+
+			if allowed := cb.AllowRequest("svc"); allowed != tt.wantAllowed {
+				t.Errorf("AllowRequest() = %v, want %v", allowed, tt.wantAllowed)
+			}
+		})
+	}
+}
+
+// A client hanging up says nothing about the service: the call frees its
+// probe slot instead of reopening the breaker
+func TestProxyHandlerClientCancelReleasesProbe(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	g, mr := newTestGateway(t, upstream.URL, true, &types.RouteConfig{})
+	setBreaker(mr, StateHalfOpen, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	w := httptest.NewRecorder()
+	g.ProxyHandler(w, httptest.NewRequest(http.MethodGet, "/api/items", nil).WithContext(ctx))
+
+	if w.Code != statusClientClosedRequest {
+		t.Errorf("status = %d, want %d", w.Code, statusClientClosedRequest)
+	}
+	if state := mr.HGet("circuit:svc:breaker", "state"); state != string(StateHalfOpen) {
+		t.Errorf("state = %q, want half-open", state)
+	}
+	if probes := mr.HGet("circuit:svc:breaker", "probes"); probes != "0" {
+		t.Errorf("probes = %q, want the slot released", probes)
+	}
+}
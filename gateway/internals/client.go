@@ -1,155 +1,444 @@
 package internals
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httputil"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/chann44/ikyk/pkg/logger"
 	"github.com/chann44/ikyk/pkg/types"
 )
 
+// statusClientClosedRequest is nginx's status for requests the client
+// abandoned before the response was ready
+const statusClientClosedRequest = 499
+
 type Gateway struct {
 	registry       *Registery
 	log            *logger.Logger
 	metrics        *MetricsCollector
 	cache          *CacheManager
 	circuitBreaker *CircuitBreaker
+	loads          *LoadTracker
+	affinity       *SessionAffinity
+	upgrades       *connectionLimiter
+	chain          http.Handler
+	mirrors        chan struct{}
 }
 
-func NewGateway(log *logger.Logger, registry *Registery, metrics *MetricsCollector, cache *CacheManager, cb *CircuitBreaker) *Gateway {
+func NewGateway(log *logger.Logger, registry *Registery, metrics *MetricsCollector, cache *CacheManager, cb *CircuitBreaker, loads *LoadTracker, affinity *SessionAffinity) *Gateway {
 	return &Gateway{
 		registry:       registry,
 		log:            log,
 		metrics:        metrics,
 		cache:          cache,
 		circuitBreaker: cb,
+		loads:          loads,
+		affinity:       affinity,
+		upgrades:       newConnectionLimiter(),
+		mirrors:        make(chan struct{}, maxMirrorsInFlight),
 	}
 }
 
 func (g *Gateway) ProxyHandler(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	path := r.URL.Path
-	ctx := r.Context()
 
-	// Find matching service path (longest prefix match)
-	servicePath, err := g.findServicePath(ctx, path)
+	// Find the matching route (priority, then longest pattern)
+	route, err := g.findRoute(r)
 	if err != nil {
-		g.log.Error("path not found: %v", err)
-		http.Error(w, "Service not found", http.StatusNotFound)
+		g.log.Warn("no route matched", "path", path, "host", r.Host, "error", err)
+		writeError(w, r, "Service not found", http.StatusNotFound)
+		return
+	}
+	servicePath := route.Path
+
+	// Mock and composition routes answer without calling a service
+	if route.Config.Mock != nil {
+		g.serveMock(w, r, route)
+		return
+	}
+	if route.Config.Aggregate != nil {
+		g.aggregate(w, r, route)
 		return
 	}
 
-	// Check cache for GET requests
-	if r.Method == "GET" {
-		if cached := g.cache.Get(r); cached != nil {
-			g.metrics.RecordCacheHit(servicePath)
-			g.serveCachedResponse(w, cached)
+	streaming := route.Config.Streaming != nil && route.Config.Streaming.Enabled
+
+	// Check the cache as the route's policy allows; streams are never cached.
+	// Stale entries are kept to revalidate with the upstream, or to stand in
+	// for it when it fails.
+	refreshing := r.Context().Value(cacheRefreshKey{}) != nil
+	var stale *types.CachedResponse
+	var landed func()
+	if !streaming && !isUpgradeRequest(r) && cachesRequest(r, route.Config.Cache) {
+		cached, fresh := g.cache.Get(r, route)
+		if !refreshing && g.serveFromCache(w, r, route, cached, fresh) {
 			return
 		}
+
+		// Concurrent misses wait for a single upstream fetch and read its result
+		if release := g.cache.Coalesce(r, route); release != nil {
+			defer release()
+			landed = release
+		} else {
+			if refreshing {
+				return
+			}
+			cached, fresh = g.cache.Get(r, route)
+			if g.serveFromCache(w, r, route, cached, fresh) {
+				return
+			}
+		}
+		stale = cached
 	}
 
-	// Get next healthy service (round-robin)
-	service, err := g.registry.GetNextService(ctx, servicePath)
+	// Get the pinned service or the next healthy one from the route's balancer
+	service, err := g.pickService(w, r, route)
 	if err != nil {
-		g.log.Error("no healthy service found: %v", err)
+		g.log.Error("no healthy service found", "path", servicePath, "error", err)
 		g.metrics.RecordError(servicePath, "no_healthy_service")
-		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		if g.serveStale(w, r, route, stale) {
+			return
+		}
+		writeError(w, r, "Service unavailable", http.StatusServiceUnavailable)
 		return
 	}
 
 	// Check circuit breaker
 	if !g.circuitBreaker.AllowRequest(service.Name) {
-		g.log.Warn("circuit breaker open for service: %s", service.Name)
-		http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
+		g.log.Warn("circuit breaker open", "service", service.Name)
+		if g.serveStale(w, r, route, stale) {
+			return
+		}
+		writeError(w, r, "Service temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Injected delays and errors, for resilience testing
+	if g.injectFault(w, r, route, service) {
 		return
 	}
 
-	// Strip service prefix from path
-	targetPath := g.stripPrefix(path, servicePath)
+	// Strip the matched prefix or apply the route's rewrite template
+	targetPath := route.TargetPath()
+
+	// gRPC services route on the full /package.Service/Method path
+	grpc := isGRPCRequest(r)
+	if grpc && route.Config.Rewrite == "" {
+		targetPath = r.URL.Path
+	}
+
+	if body := route.Config.Body; body != nil && !grpc && !isUpgradeRequest(r) {
+		g.transformRequestBody(r, body)
+	}
+
+	// REST calls bound to a gRPC method by the route's descriptor set;
+	// anything else falls through to regular proxying
+	if route.transcoder != nil && !grpc {
+		if binding, vars, ok := route.transcoder.match(r); ok {
+			g.transcode(w, r, route, binding, vars, service)
+			return
+		}
+	}
+
+	// WebSocket and other Upgrade requests get a dedicated, tracked connection
+	if isUpgradeRequest(r) {
+		g.proxyUpgrade(w, r, route, service, targetPath)
+		return
+	}
+
+	// Copy the request to the route's shadow services, if any
+	if !grpc {
+		g.mirror(r, route, targetPath)
+	}
+
+	// The route timeout bounds regular requests; it is lifted once a
+	// response turns out to be a stream
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	var deadline *time.Timer
+	var timedOut atomic.Bool
+	if route.Config.Timeout > 0 && !streaming {
+		deadline = time.AfterFunc(route.Config.Timeout, func() {
+			timedOut.Store(true)
+			cancel()
+		})
+		defer deadline.Stop()
+	}
 
 	// Create reverse proxy
-	proxy := httputil.NewSingleHostReverseProxy(service.URL)
+	var upstreamLatency time.Duration
+	upstreamStart := time.Now()
+	proxy := newReverseProxy(r, route, service, targetPath)
+	if streaming || grpc {
+		proxy.FlushInterval = -1
+	}
+	if grpc {
+		proxy.Transport = grpcTransport
+	}
+
+	// The cache fetches full responses and answers the client's own
+	// conditional requests itself; the upstream only sees its validators
+	caching := !streaming && !grpc && cachesRequest(r, route.Config.Cache)
+	if caching {
+		director := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			director(req)
+			req.Header.Del("If-None-Match")
+			req.Header.Del("If-Modified-Since")
+			if stale != nil {
+				setValidators(req, stale.Headers)
+			}
+		}
+	}
+	// Responses have to be readable to be transformed
+	if body := route.Config.Body; body != nil && body.Response != nil && !grpc {
+		director := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			director(req)
+			req.Header.Del("Accept-Encoding")
+		}
+	}
+
 	proxy.ModifyResponse = func(resp *http.Response) error {
-		// Cache successful GET responses
-		if r.Method == "GET" && resp.StatusCode == http.StatusOK {
-			g.cache.Set(r, resp)
+		upstreamLatency = time.Since(upstreamStart)
+
+		if grpc {
+			g.metrics.RecordRequest(service.Name, r.Method, resp.StatusCode, time.Since(start))
+			g.modifyGRPCResponse(r, resp, service, start)
+			transformResponseHeaders(resp.Header, r, route)
+			return nil
+		}
+
+		status := resp.StatusCode
+		var transformErr error
+
+		if streaming || isStreamingResponse(resp) {
+			// Flush every event as it arrives, keep it out of the cache and
+			// only give up when the stream goes quiet
+			if deadline != nil {
+				deadline.Stop()
+			}
+			if config := route.Config.Streaming; config != nil && config.IdleTimeout > 0 {
+				resp.Body = newIdleTimeoutBody(resp.Body, config.IdleTimeout, cancel)
+			}
+		} else if stale != nil && resp.StatusCode == http.StatusNotModified {
+			// The stored copy is still current: refresh it and serve it
+			cached := g.cache.Refresh(r, stale, resp, route)
+			replaceWithCached(resp, cached)
+			resp.Header.Set("X-Cache", "REVALIDATED")
+		} else if status >= 500 && stale != nil && staleWithin(stale, stale.StaleIfError) {
+			// A stale copy beats an error page
+			replaceWithCached(resp, stale)
+			resp.Header.Set("X-Cache", "STALE")
+		} else {
+			if body := route.Config.Body; body != nil {
+				transformErr = g.transformResponseBody(resp, body)
+			}
+
+			// The cache decides from the response's Cache-Control whether to keep it
+			if r.Method == "GET" && transformErr == nil {
+				g.cache.Set(r, resp, route)
+			}
+		}
+
+		// Waiting requests can read the stored entry now, or go upstream
+		// themselves when the response wasn't cacheable
+		if landed != nil {
+			landed()
+		}
+
+		// Successful writes invalidate the resource's cached responses
+		g.cache.Invalidate(r, resp, route)
+
+		if caching && resp.StatusCode == http.StatusOK && notModified(r, resp.Header) {
+			resp.Body.Close()
+			resp.Body = http.NoBody
+			resp.ContentLength = 0
+			resp.StatusCode = http.StatusNotModified
+			resp.Header.Del("Content-Length")
 		}
 
 		// Record metrics
 		duration := time.Since(start)
-		g.metrics.RecordRequest(service.Name, r.Method, resp.StatusCode, duration)
+		g.metrics.RecordRequest(service.Name, r.Method, status, duration)
 
 		// Update circuit breaker
-		if resp.StatusCode >= 500 {
-			g.circuitBreaker.RecordFailure(service.Name)
+		if status >= 500 {
+			g.circuitBreaker.RecordFailure(service.Name, duration)
 		} else {
-			g.circuitBreaker.RecordSuccess(service.Name)
+			g.circuitBreaker.RecordSuccess(service.Name, duration)
 		}
 
+		// The service answered, but not with a body the client may see
+		if transformErr != nil {
+			return transformErr
+		}
+
+		// The cache keeps the service's headers; the route's rules run on every reply
+		transformResponseHeaders(resp.Header, r, route)
 		return nil
 	}
 
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		g.log.Error("proxy error: %v", err)
+		if errors.Is(err, errBodyNotTransformed) {
+			g.log.Error("response withheld", "service", service.Name, "path", path, "error", err)
+			g.metrics.RecordError(service.Name, "body_transform")
+			writeError(w, r, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+
+		if timedOut.Load() {
+			g.log.Warn("upstream timed out", "service", service.Name, "path", path, "timeout", route.Config.Timeout.String())
+			g.metrics.RecordError(service.Name, "timeout")
+			g.circuitBreaker.RecordFailure(service.Name, time.Since(start))
+			if g.serveStale(w, r, route, stale) {
+				return
+			}
+			writeError(w, r, "Gateway Timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		// The client went away before the service answered: nobody is left
+		// to serve and the call says nothing about the service's health
+		if errors.Is(err, context.Canceled) {
+			g.log.Info("client closed request", "service", service.Name, "path", path)
+			g.circuitBreaker.Release(service.Name)
+			w.WriteHeader(statusClientClosedRequest)
+			return
+		}
+
+		g.log.Error("proxy error", "service", service.Name, "error", err)
 		g.metrics.RecordError(service.Name, "proxy_error")
-		g.circuitBreaker.RecordFailure(service.Name)
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		g.circuitBreaker.RecordFailure(service.Name, time.Since(start))
+		if g.serveStale(w, r, route, stale) {
+			return
+		}
+		writeError(w, r, "Bad Gateway", http.StatusBadGateway)
 	}
 
-	// Modify request
-	r.URL.Path = targetPath
-	r.URL.Host = service.URL.Host
-	r.URL.Scheme = service.URL.Scheme
-	r.Header.Set("X-Forwarded-Host", r.Host)
-	r.Header.Set("X-Forwarded-Proto", r.URL.Scheme)
-	r.Header.Set("X-Forwarded-For", r.RemoteAddr)
-	r.Host = service.URL.Host
-
 	g.log.Info("proxying request",
 		"service", service.Name,
 		"path", path,
 		"target", targetPath)
 
+	g.loads.Begin(service.Name)
 	proxy.ServeHTTP(w, r)
+
+	// Streams are weighed by time to first byte, not by how long they stayed open
+	if upstreamLatency == 0 {
+		upstreamLatency = time.Since(upstreamStart)
+	}
+	g.loads.End(service.Name, upstreamLatency)
 }
 
-func (g *Gateway) findServicePath(ctx context.Context, requestPath string) (string, error) {
-	paths, err := g.registry.ListAllPaths(ctx)
-	if err != nil {
-		return "", err
+// pickService honors the route's session affinity cookie while the pinned
+// service stays healthy, and falls back to the balancer otherwise
+func (g *Gateway) pickService(w http.ResponseWriter, r *http.Request, route *RouteMatch) (*types.Service, error) {
+	ctx := r.Context()
+	servicePath := route.Path
+	config := route.Config
+
+	if config.Affinity == nil || !config.Affinity.Enabled {
+		return g.registry.GetNextService(ctx, servicePath, r)
 	}
 
-	// Longest prefix match
-	var matched string
-	for _, path := range paths {
-		if len(requestPath) >= len(path) && requestPath[:len(path)] == path {
-			if len(path) > len(matched) {
-				matched = path
-			}
+	if name := g.affinity.Pinned(r, servicePath, config.Affinity); name != "" {
+		service, err := g.registry.GetService(ctx, servicePath, name)
+		if err == nil && service.Healthy {
+			return service, nil
 		}
 	}
 
-	if matched == "" {
-		return "", ErrPathNotFound
+	service, err := g.registry.GetNextService(ctx, servicePath, r)
+	if err != nil {
+		return nil, err
 	}
 
-	return matched, nil
+	g.affinity.Pin(w, r, servicePath, service.Name, config.Affinity)
+	return service, nil
 }
 
-func (g *Gateway) stripPrefix(fullPath, prefix string) string {
-	if len(fullPath) > len(prefix) {
-		return fullPath[len(prefix):]
+func (g *Gateway) findRoute(r *http.Request) (*RouteMatch, error) {
+	routes, err := g.registry.Routes(r.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	// Routes are already in match order, the first hit wins
+	for _, route := range routes {
+		if match, ok := route.Match(r); ok {
+			return match, nil
+		}
 	}
-	return "/"
+
+	return nil, ErrPathNotFound
 }
 
-func (g *Gateway) serveCachedResponse(w http.ResponseWriter, cached *types.CachedResponse) {
+// newReverseProxy proxies to service at targetPath. Only the outbound copy of
+// the request is modified; r itself stays untouched so the cache sees the
+// client's host and path.
+func newReverseProxy(r *http.Request, route *RouteMatch, service *types.Service, targetPath string) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(service.URL)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		req.URL.Path = targetPath
+		req.URL.RawPath = ""
+		director(req)
+		req.Header.Set("X-Forwarded-Host", r.Host)
+		req.Header.Set("X-Forwarded-Proto", requestScheme(r))
+		req.Header.Set("X-Forwarded-For", r.RemoteAddr)
+		req.Host = service.URL.Host
+		transformRequestHeaders(req.Header, r, route)
+	}
+	return proxy
+}
+
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// serveCachedResponse writes cached, labelled with X-Cache: HIT or STALE
+func (g *Gateway) serveCachedResponse(w http.ResponseWriter, r *http.Request, route *RouteMatch, cached *types.CachedResponse, label string) {
 	for k, v := range cached.Headers {
 		w.Header()[k] = v
 	}
-	w.Header().Set("X-Cache", "HIT")
-	w.WriteHeader(cached.StatusCode)
-	w.Write(cached.Body)
+	transformResponseHeaders(w.Header(), r, route)
+	w.Header().Set("Age", strconv.FormatInt(int64(cachedAge(cached)/time.Second), 10))
+	w.Header().Set("X-Cache", label)
+
+	// Clients that already hold this version only get the headers
+	status := cached.StatusCode
+	if status == http.StatusOK && notModified(r, w.Header()) {
+		status = http.StatusNotModified
+		w.Header().Del("Content-Length")
+	}
+
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead && status != http.StatusNotModified {
+		w.Write(cached.Body)
+	}
+}
+
+// replaceWithCached turns resp into the cached response
+func replaceWithCached(resp *http.Response, cached *types.CachedResponse) {
+	resp.Body.Close()
+	resp.StatusCode = cached.StatusCode
+	resp.Header = http.Header(cached.Headers).Clone()
+	resp.Header.Set("Age", strconv.FormatInt(int64(cachedAge(cached)/time.Second), 10))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(cached.Body)))
+	resp.ContentLength = int64(len(cached.Body))
+	resp.Body = io.NopCloser(bytes.NewReader(cached.Body))
 }
@@ -0,0 +1,80 @@
+package internals
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+// injectFault applies the route's fault policy. It reports whether the
+// request was aborted and already answered.
+func (g *Gateway) injectFault(w http.ResponseWriter, r *http.Request, route *RouteMatch, service *types.Service) bool {
+	config := route.Config.Fault
+	if config == nil || !faultTargeted(r, config) {
+		return false
+	}
+
+	if delay := config.Delay; delay != nil && faultRoll(delay.Percent) {
+		g.metrics.RecordFault(route.Path, "delay")
+		timer := time.NewTimer(delay.Duration)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			g.circuitBreaker.Release(service.Name)
+			return true
+		}
+	}
+
+	abort := config.Abort
+	if abort == nil || !faultRoll(abort.Percent) {
+		return false
+	}
+
+	g.metrics.RecordFault(route.Path, "abort")
+	// The service was never called: only injected server errors count
+	if abort.Status >= 500 {
+		g.circuitBreaker.RecordFailure(service.Name, 0)
+	} else {
+		g.circuitBreaker.Release(service.Name)
+	}
+
+	g.log.Info("fault injected", "path", r.URL.Path, "service", service.Name, "status", abort.Status)
+	w.Header().Set("X-Fault-Injected", "abort")
+
+	message := abort.Body
+	if message == "" {
+		message = http.StatusText(abort.Status)
+	}
+	writeError(w, r, message, abort.Status)
+	return true
+}
+
+// faultTargeted reports whether r carries the policy's headers and comes
+// from one of its consumers
+func faultTargeted(r *http.Request, config *types.FaultConfig) bool {
+	for name, expected := range config.Headers {
+		values, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok || !matchValue(expected, values) {
+			return false
+		}
+	}
+
+	if len(config.Consumers) == 0 {
+		return true
+	}
+	consumer := ConsumerFromContext(r.Context())
+	for _, candidate := range config.Consumers {
+		if consumer != "" && candidate == consumer {
+			return true
+		}
+	}
+	return false
+}
+
+// faultRoll decides whether a fault applies; 0 percent means always
+func faultRoll(percent float64) bool {
+	return percent == 0 || rand.Float64()*100 < percent
+}
@@ -0,0 +1,62 @@
+package internals
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+// Injected faults that end a request without a service outcome must hand
+// their half-open probe slot back
+func TestInjectFaultReleasesProbe(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name       string
+		fault      *types.FaultConfig
+		cancel     bool
+		wantProbes string
+		wantState  string
+	}{
+		{"client error abort", &types.FaultConfig{Abort: &types.FaultAbort{Status: http.StatusTeapot}}, false, "0", "half-open"},
+		{"cancelled delay", &types.FaultConfig{Delay: &types.FaultDelay{Duration: time.Minute}}, true, "0", "half-open"},
+		{"server error abort", &types.FaultConfig{Abort: &types.FaultAbort{Status: http.StatusServiceUnavailable}}, false, "", "open"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, mr := newTestGateway(t, upstream.URL, true, &types.RouteConfig{Fault: tt.fault})
+			mr.HSet("circuit:svc:breaker",
+				"state", "half-open",
+				"changed_at", strconv.FormatInt(time.Now().UnixMilli(), 10),
+				"probes", "0")
+
+			r := httptest.NewRequest(http.MethodGet, "/api/items", nil)
+			if tt.cancel {
+				ctx, cancel := context.WithCancel(r.Context())
+				cancel()
+				r = r.WithContext(ctx)
+			}
+			g.ProxyHandler(httptest.NewRecorder(), r)
+
+			if state := mr.HGet("circuit:svc:breaker", "state"); state != tt.wantState {
+				t.Errorf("state = %q, want %q", state, tt.wantState)
+			}
+			if tt.wantState != "half-open" {
+				return
+			}
+			if probes := mr.HGet("circuit:svc:breaker", "probes"); probes != tt.wantProbes {
+				t.Errorf("probes = %q, want %q", probes, tt.wantProbes)
+			}
+			if !g.circuitBreaker.AllowRequest("svc") {
+				t.Error("next probe rejected after the fault")
+			}
+		})
+	}
+}
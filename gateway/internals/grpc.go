@@ -0,0 +1,177 @@
+package internals
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+// gRPC status codes the gateway produces or treats as service failures
+const (
+	grpcCancelled         = 1
+	grpcUnknown           = 2
+	grpcDeadlineExceeded  = 4
+	grpcResourceExhausted = 8
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+	grpcDataLoss          = 15
+)
+
+// grpcTransport speaks HTTP/2 to upstreams: h2c for http:// services and
+// HTTP/2 over TLS for https:// ones, as gRPC requires
+var grpcTransport = func() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	protocols := new(http.Protocols)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	transport.Protocols = protocols
+	return transport
+}()
+
+// isGRPCRequest reports whether r is a gRPC call (application/grpc, +proto, +json, ...)
+func isGRPCRequest(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcMethod is the "package.Service/Method" label of a gRPC call
+func grpcMethod(r *http.Request) string {
+	return strings.TrimPrefix(r.URL.Path, "/")
+}
+
+// grpcFailure reports whether code means the service itself failed, as
+// opposed to the call being rejected (NOT_FOUND, INVALID_ARGUMENT, ...)
+func grpcFailure(code int) bool {
+	switch code {
+	case grpcUnknown, grpcDeadlineExceeded, grpcInternal, grpcUnavailable, grpcDataLoss:
+		return true
+	}
+	return false
+}
+
+// grpcStatusFromHTTP maps the gateway's own HTTP errors to gRPC codes
+func grpcStatusFromHTTP(status int) int {
+	switch status {
+	case http.StatusNotFound:
+		return 12 // UNIMPLEMENTED
+	case http.StatusBadRequest:
+		return 3 // INVALID_ARGUMENT
+	case http.StatusUnauthorized:
+		return 16 // UNAUTHENTICATED
+	case http.StatusForbidden:
+		return 7 // PERMISSION_DENIED
+	case http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case http.StatusGatewayTimeout:
+		return grpcDeadlineExceeded
+	case http.StatusServiceUnavailable, http.StatusBadGateway:
+		return grpcUnavailable
+	}
+	return grpcUnknown
+}
+
+// writeError replies with message in the caller's protocol: a trailers-only
+// gRPC response for gRPC calls, a plain HTTP error otherwise
+func writeError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	if !isGRPCRequest(r) {
+		http.Error(w, message, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(grpcStatusFromHTTP(status)))
+	w.Header().Set("Grpc-Message", url.PathEscape(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcResponseBody reports the call's grpc-status once the upstream has
+// finished the stream and its trailers are available
+type grpcResponseBody struct {
+	io.ReadCloser
+	resp   *http.Response
+	once   sync.Once
+	finish func(code int)
+}
+
+func newGRPCResponseBody(resp *http.Response, finish func(code int)) *grpcResponseBody {
+	return &grpcResponseBody{
+		ReadCloser: resp.Body,
+		resp:       resp,
+		finish:     finish,
+	}
+}
+
+func (b *grpcResponseBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) {
+		b.report()
+	}
+	return n, err
+}
+
+func (b *grpcResponseBody) Close() error {
+	// Closed before EOF: the stream was cut off, usually by the client going away
+	b.once.Do(func() { b.finish(grpcCancelled) })
+	return b.ReadCloser.Close()
+}
+
+func (b *grpcResponseBody) report() {
+	b.once.Do(func() {
+		b.finish(grpcStatus(b.resp))
+	})
+}
+
+// grpcStatus reads grpc-status from the trailers, or from the headers of a
+// trailers-only response
+func grpcStatus(resp *http.Response) int {
+	value := resp.Trailer.Get("Grpc-Status")
+	if value == "" {
+		value = resp.Header.Get("Grpc-Status")
+	}
+	if value == "" {
+		// A finished call without a status is a broken upstream
+		return grpcUnknown
+	}
+
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		return grpcUnknown
+	}
+	return code
+}
+
+// modifyGRPCResponse records metrics and circuit breaker state from the
+// call's grpc-status instead of the HTTP status, which is 200 for most failures
+func (g *Gateway) modifyGRPCResponse(r *http.Request, resp *http.Response, service *types.Service, start time.Time) {
+	method := grpcMethod(r)
+
+	finish := func(code int) {
+		g.metrics.RecordGRPCRequest(service.Name, method, code, time.Since(start))
+		if code == grpcCancelled {
+			g.circuitBreaker.Release(service.Name)
+			return
+		}
+		if grpcFailure(code) {
+			g.circuitBreaker.RecordFailure(service.Name, time.Since(start))
+		} else {
+			g.circuitBreaker.RecordSuccess(service.Name, time.Since(start))
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		// Not a gRPC response at all (e.g. a proxy in front of the service)
+		g.metrics.RecordGRPCRequest(service.Name, method, grpcStatusFromHTTP(resp.StatusCode), time.Since(start))
+		if resp.StatusCode >= 500 {
+			g.circuitBreaker.RecordFailure(service.Name, time.Since(start))
+		}
+		return
+	}
+
+	resp.Body = newGRPCResponseBody(resp, finish)
+}
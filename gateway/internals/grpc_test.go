@@ -0,0 +1,173 @@
+package internals
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+func TestGRPCStatusFromHTTP(t *testing.T) {
+	tests := []struct {
+		status int
+		want   int
+	}{
+		{http.StatusNotFound, 12},
+		{http.StatusBadRequest, 3},
+		{http.StatusUnauthorized, 16},
+		{http.StatusForbidden, 7},
+		{http.StatusTooManyRequests, grpcResourceExhausted},
+		{http.StatusGatewayTimeout, grpcDeadlineExceeded},
+		{http.StatusServiceUnavailable, grpcUnavailable},
+		{http.StatusBadGateway, grpcUnavailable},
+		{http.StatusTeapot, grpcUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.status), func(t *testing.T) {
+			if got := grpcStatusFromHTTP(tt.status); got != tt.want {
+				t.Errorf("grpcStatusFromHTTP(%d) = %d, want %d", tt.status, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGRPCFailure(t *testing.T) {
+	failures := map[int]bool{grpcUnknown: true, grpcDeadlineExceeded: true, grpcInternal: true, grpcUnavailable: true, grpcDataLoss: true}
+	for code := 0; code <= 16; code++ {
+		if got := grpcFailure(code); got != failures[code] {
+			t.Errorf("grpcFailure(%d) = %v, want %v", code, got, failures[code])
+		}
+	}
+}
+
+func TestGRPCStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  http.Header
+		trailer http.Header
+		want    int
+	}{
+		{"trailer", http.Header{}, http.Header{"Grpc-Status": {"5"}}, 5},
+		{"trailers-only", http.Header{"Grpc-Status": {"7"}}, http.Header{}, 7},
+		{"trailer wins", http.Header{"Grpc-Status": {"7"}}, http.Header{"Grpc-Status": {"0"}}, 0},
+		{"missing", http.Header{}, http.Header{}, grpcUnknown},
+		{"invalid", http.Header{}, http.Header{"Grpc-Status": {"ok"}}, grpcUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Header: tt.header, Trailer: tt.trailer}
+			if got := grpcStatus(resp); got != tt.want {
+				t.Errorf("grpcStatus() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		name        string
+		protoMajor  int
+		contentType string
+		wantStatus  int
+		wantGRPC    string
+	}{
+		{"http", 1, "application/json", http.StatusServiceUnavailable, ""},
+		{"grpc", 2, "application/grpc", http.StatusOK, "14"},
+		{"grpc over http/1", 1, "application/grpc", http.StatusServiceUnavailable, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/echo.Echo/Say", nil)
+			r.ProtoMajor = tt.protoMajor
+			r.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+
+			writeError(w, r, "Service unavailable", http.StatusServiceUnavailable)
+			if w.Code != tt.wantStatus || w.Header().Get("Grpc-Status") != tt.wantGRPC {
+				t.Errorf("status = %d, grpc-status = %q, want %d, %q", w.Code, w.Header().Get("Grpc-Status"), tt.wantStatus, tt.wantGRPC)
+			}
+		})
+	}
+}
+
+// newH2CServer serves handler over HTTP/1.1 and unencrypted HTTP/2
+func newH2CServer(handler http.Handler) *httptest.Server {
+	server := httptest.NewUnstartedServer(handler)
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	server.Config.Protocols = protocols
+	server.Start()
+	return server
+}
+
+func callGRPC(t *testing.T, url string) (header, trailer http.Header, body string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader("\x00\x00\x00\x00\x00"))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	resp, err := (&http.Client{Transport: grpcTransport}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.Header, resp.Trailer, string(data)
+}
+
+func TestGRPCProxy(t *testing.T) {
+	tests := []struct {
+		name      string
+		code      int
+		wantCalls int64 // Out of 10; fewer once the breaker opens
+	}{
+		{"ok", 0, 10},
+		{"rejected calls leave the breaker closed", 5, 10},
+		{"failures open the breaker", grpcUnavailable, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int64
+			upstream := newH2CServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				if r.ProtoMajor != 2 || r.URL.Path != "/echo.Echo/Say" {
+					t.Errorf("upstream got %s %s", r.Proto, r.URL.Path)
+				}
+				w.Header().Set("Content-Type", "application/grpc")
+				w.Write([]byte("reply"))
+				w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(tt.code))
+			}))
+			defer upstream.Close()
+			g, _ := newTestGatewayAt(t, "/echo.Echo", upstream.URL, true, &types.RouteConfig{})
+			gateway := newH2CServer(http.HandlerFunc(g.ProxyHandler))
+			defer gateway.Close()
+
+			for i := 0; i < 10; i++ {
+				header, trailer, body := callGRPC(t, gateway.URL+"/echo.Echo/Say")
+				status := trailer.Get("Grpc-Status")
+				if status == "" {
+					status = header.Get("Grpc-Status")
+				}
+				if status != strconv.Itoa(tt.code) {
+					t.Fatalf("call %d: grpc-status = %q, want %d", i, status, tt.code)
+				}
+				if trailer.Get("Grpc-Status") != "" && body != "reply" {
+					t.Errorf("call %d: body = %q, want the upstream reply", i, body)
+				}
+			}
+
+			if got := calls.Load(); got > tt.wantCalls || (tt.wantCalls == 10 && got != 10) {
+				t.Errorf("upstream called %d times, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
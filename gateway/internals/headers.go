@@ -0,0 +1,110 @@
+package internals
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/chann44/ikyk/pkg/types"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// internalResponseHeaders leak implementation details of the services and
+// are dropped unless a route keeps them
+var internalResponseHeaders = []string{
+	"Server",
+	"X-Powered-By",
+	"X-AspNet-Version",
+	"X-AspNetMvc-Version",
+	"X-Runtime",
+}
+
+var headerVariable = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// transformRequestHeaders applies the route's request header rules to the
+// outbound request
+func transformRequestHeaders(header http.Header, r *http.Request, route *RouteMatch) {
+	if headers := route.Config.Headers; headers != nil {
+		applyHeaderRules(header, headers.Request, r, route)
+	}
+}
+
+// transformResponseHeaders strips internal headers and applies the route's
+// response header rules
+func transformResponseHeaders(header http.Header, r *http.Request, route *RouteMatch) {
+	headers := route.Config.Headers
+	if headers == nil || !headers.KeepServerHeaders {
+		for _, name := range internalResponseHeaders {
+			header.Del(name)
+		}
+	}
+
+	// Surrogate keys are meant for the gateway's cache, not for clients
+	header.Del("Surrogate-Key")
+
+	if headers != nil {
+		applyHeaderRules(header, headers.Response, r, route)
+	}
+}
+
+func applyHeaderRules(header http.Header, rules *types.HeaderRules, r *http.Request, route *RouteMatch) {
+	if rules == nil {
+		return
+	}
+
+	for from, to := range rules.Rename {
+		if values := header.Values(from); len(values) > 0 {
+			header.Del(from)
+			header[http.CanonicalHeaderKey(to)] = values
+		}
+	}
+
+	for _, name := range rules.Remove {
+		header.Del(name)
+	}
+
+	for name, value := range rules.Set {
+		header.Set(name, expandTemplate(value, r, route))
+	}
+
+	for name, value := range rules.Add {
+		header.Add(name, expandTemplate(value, r, route))
+	}
+}
+
+// expandTemplate fills in the template variables of header and mock values:
+// ${client_ip}, ${request_id}, ${consumer}, ${method}, ${path},
+// ${path.<param>}, ${query.<name>} and ${header.<name>}. Unknown variables
+// expand to nothing.
+func expandTemplate(value string, r *http.Request, route *RouteMatch) string {
+	if !strings.Contains(value, "${") {
+		return value
+	}
+
+	return headerVariable.ReplaceAllStringFunc(value, func(token string) string {
+		name := token[2 : len(token)-1]
+		switch name {
+		case "client_ip":
+			return clientIP(r)
+		case "request_id":
+			return middleware.GetReqID(r.Context())
+		case "consumer":
+			return ConsumerFromContext(r.Context())
+		case "method":
+			return r.Method
+		case "path":
+			return r.URL.Path
+		}
+
+		prefix, param, _ := strings.Cut(name, ".")
+		switch prefix {
+		case "path":
+			return route.Params[param]
+		case "query":
+			return r.URL.Query().Get(param)
+		case "header":
+			return r.Header.Get(param)
+		}
+		return ""
+	})
+}
@@ -0,0 +1,73 @@
+package internals
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+func TestApplyHeaderRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules *types.HeaderRules
+		in    http.Header
+		want  http.Header
+	}{
+		{"no rules", nil, http.Header{"A": {"1"}}, http.Header{"A": {"1"}}},
+		{"rename keeps values", &types.HeaderRules{Rename: map[string]string{"x-old": "x-new"}},
+			http.Header{"X-Old": {"1", "2"}}, http.Header{"X-New": {"1", "2"}}},
+		{"rename before remove", &types.HeaderRules{Rename: map[string]string{"X-A": "X-B"}, Remove: []string{"X-B"}},
+			http.Header{"X-A": {"1"}}, http.Header{}},
+		{"set replaces", &types.HeaderRules{Set: map[string]string{"X-Env": "prod"}},
+			http.Header{"X-Env": {"dev", "test"}}, http.Header{"X-Env": {"prod"}}},
+		{"add appends after set", &types.HeaderRules{Set: map[string]string{"X-Tag": "a"}, Add: map[string]string{"X-Tag": "b"}},
+			http.Header{"X-Tag": {"z"}}, http.Header{"X-Tag": {"a", "b"}}},
+		{"templates", &types.HeaderRules{Set: map[string]string{"X-Route": "${method} ${path.id} ${query.page} ${header.X-User} ${unknown}"}},
+			http.Header{}, http.Header{"X-Route": {"GET 42 3 alice "}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/items/42?page=3", nil)
+			r.Header.Set("X-User", "alice")
+			route := &RouteMatch{Params: map[string]string{"id": "42"}}
+
+			applyHeaderRules(tt.in, tt.rules, r, route)
+			if !reflect.DeepEqual(tt.in, tt.want) {
+				t.Errorf("headers = %v, want %v", tt.in, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformResponseHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers *types.HeadersConfig
+		want    http.Header
+	}{
+		{"strips internal headers", nil, http.Header{"Content-Type": {"text/plain"}}},
+		{"keeps server headers", &types.HeadersConfig{KeepServerHeaders: true},
+			http.Header{"Content-Type": {"text/plain"}, "Server": {"nginx"}, "X-Powered-By": {"php"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{
+				"Content-Type":  {"text/plain"},
+				"Server":        {"nginx"},
+				"X-Powered-By":  {"php"},
+				"Surrogate-Key": {"items"},
+			}
+			route := &RouteMatch{Route: &Route{Config: &types.RouteConfig{Headers: tt.headers}}}
+
+			transformResponseHeaders(header, httptest.NewRequest(http.MethodGet, "/api", nil), route)
+			if !reflect.DeepEqual(header, tt.want) {
+				t.Errorf("headers = %v, want %v", header, tt.want)
+			}
+		})
+	}
+}
@@ -55,7 +55,7 @@ func (hc *HealthChecker) Stop() {
 func (hc *HealthChecker) checkAllServices(ctx context.Context) {
 	paths, err := hc.registry.ListAllPaths(ctx)
 	if err != nil {
-		hc.log.Error("failed to list paths: %v", err)
+		hc.log.Error("failed to list paths", "error", err)
 		return
 	}
 
@@ -73,7 +73,7 @@ func (hc *HealthChecker) checkAllServices(ctx context.Context) {
 func (hc *HealthChecker) checkServicesForPath(ctx context.Context, path string) {
 	services, err := hc.registry.GetServices(ctx, path)
 	if err != nil {
-		hc.log.Error("failed to get services for path %s: %v", path, err)
+		hc.log.Error("failed to get services", "path", path, "error", err)
 		return
 	}
 
@@ -83,7 +83,7 @@ func (hc *HealthChecker) checkServicesForPath(ctx context.Context, path string)
 		// Update registry
 		err := hc.registry.UpdateServiceHealth(ctx, path, service.Name, healthy, time.Now())
 		if err != nil {
-			hc.log.Error("failed to update health for %s: %v", service.Name, err)
+			hc.log.Error("failed to update health", "service", service.Name, "error", err)
 		}
 
 		if !healthy {
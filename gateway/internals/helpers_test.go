@@ -0,0 +1,80 @@
+package internals
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/chann44/ikyk/pkg/logger"
+	"github.com/chann44/ikyk/pkg/types"
+	"github.com/chann44/ikyk/pkg/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+// testMetrics is shared because collectors register globally
+var testMetrics = NewMetricsCollector()
+
+var testBreakerDefaults = types.CircuitBreakerConfig{
+	SuccessThreshold:          2,
+	PermittedHalfOpenCalls:    1,
+	Timeout:                   time.Minute,
+	WindowType:                "count",
+	WindowSize:                10,
+	MinimumCalls:              4,
+	FailureRateThreshold:      50,
+	SlowCallDurationThreshold: time.Second,
+	SlowCallRateThreshold:     100,
+}
+
+func newTestLogger() *logger.Logger {
+	return logger.NewLogger(logger.LoggerConfig{})
+}
+
+func newTestRedis(t *testing.T) (*RedisClient, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return &RedisClient{Client: client}, mr
+}
+
+// newTestGateway serves config on /api from a single service "svc" at
+// upstream, with the route table loaded from Redis
+func newTestGateway(t *testing.T, upstream string, healthy bool, config *types.RouteConfig) (*Gateway, *miniredis.Miniredis) {
+	t.Helper()
+	return newTestGatewayAt(t, "/api", upstream, healthy, config)
+}
+
+func newTestGatewayAt(t *testing.T, path, upstream string, healthy bool, config *types.RouteConfig) (*Gateway, *miniredis.Miniredis) {
+	t.Helper()
+	ctx := context.Background()
+	client, mr := newTestRedis(t)
+	log := newTestLogger()
+	loads := NewLoadTracker()
+	registry := NewRegistery(client, log, loads)
+
+	target, err := url.Parse(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.AddService(ctx, path, &types.Service{Name: "svc", URL: target, Healthy: healthy}); err != nil {
+		t.Fatal(err)
+	}
+	fields, err := utils.ToHashFields(config, "path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) > 0 {
+		client.HSet(ctx, redisKey("registry:path", path, "config"), fields)
+	}
+	client.SAdd(ctx, "registry:routes", path)
+	if err := registry.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewCacheManager(client, log, testMetrics, 5*time.Minute, 0, false)
+	breaker := NewCircuitBreaker(client, log, registry, testMetrics, testBreakerDefaults)
+	return NewGateway(log, registry, testMetrics, cache, breaker, loads, NewSessionAffinity("test", log)), mr
+}
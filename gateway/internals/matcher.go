@@ -0,0 +1,428 @@
+package internals
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+// Route is a registry path together with the rules that select it
+type Route struct {
+	Path    string // Registry path the services and policies are stored under
+	Pattern string // Path template or regex matched against the request
+	Config  *types.RouteConfig
+	matcher *pathPattern
+
+	transcoder *transcoder // REST to gRPC bindings from the route's descriptor set
+}
+
+// RouteMatch is a route selected for a request, with the captured path
+// params and the part of the path after the matched prefix
+type RouteMatch struct {
+	*Route
+	Params map[string]string
+	Rest   string
+}
+
+func newRoute(path string, config *types.RouteConfig) (*Route, error) {
+	if config == nil {
+		config = &types.RouteConfig{Path: path}
+	}
+
+	pattern := path
+	var regex string
+	var exact bool
+	if match := config.Match; match != nil {
+		if match.Path != "" {
+			pattern = match.Path
+		}
+		if match.Regex != "" {
+			pattern = match.Regex
+			regex = match.Regex
+		}
+		exact = match.Exact
+	}
+
+	matcher, err := compilePattern(pattern, regex, exact)
+	if err != nil {
+		return nil, fmt.Errorf("route %s: %w", path, err)
+	}
+
+	return &Route{
+		Path:    path,
+		Pattern: pattern,
+		Config:  config,
+		matcher: matcher,
+	}, nil
+}
+
+// Match checks every condition of the route against r
+func (rt *Route) Match(r *http.Request) (*RouteMatch, bool) {
+	params, rest, ok := rt.matcher.match(r.URL.Path)
+	if !ok {
+		return nil, false
+	}
+
+	if match := rt.Config.Match; match != nil {
+		if len(match.Hosts) > 0 && !matchHost(match.Hosts, r.Host) {
+			return nil, false
+		}
+
+		if len(match.Methods) > 0 && !matchMethod(match.Methods, r.Method) {
+			return nil, false
+		}
+
+		for name, expected := range match.Headers {
+			values, ok := r.Header[http.CanonicalHeaderKey(name)]
+			if !ok || !matchValue(expected, values) {
+				return nil, false
+			}
+		}
+
+		if len(match.Query) > 0 {
+			query := r.URL.Query()
+			for name, expected := range match.Query {
+				values, ok := query[name]
+				if !ok || !matchValue(expected, values) {
+					return nil, false
+				}
+			}
+		}
+	}
+
+	return &RouteMatch{Route: rt, Params: params, Rest: rest}, true
+}
+
+// TargetPath is the upstream path: the route's rewrite template expanded
+// with the captured params, or the request path with the matched prefix removed
+func (m *RouteMatch) TargetPath() string {
+	template := m.Config.Rewrite
+	if template == "" {
+		if m.Rest == "" || m.Rest[0] != '/' {
+			return "/" + m.Rest
+		}
+		return m.Rest
+	}
+
+	rest := strings.TrimPrefix(m.Rest, "/")
+	hasRest := strings.Contains(template, "{*}")
+
+	target := templateParam.ReplaceAllStringFunc(template, func(token string) string {
+		name := token[1 : len(token)-1]
+		if name == "*" {
+			return rest
+		}
+		return m.Params[name]
+	})
+
+	if !hasRest && rest != "" {
+		target = strings.TrimSuffix(target, "/") + "/" + rest
+	}
+	return target
+}
+
+func (rt *Route) priority() int {
+	if rt.Config.Match == nil {
+		return 0
+	}
+	return rt.Config.Match.Priority
+}
+
+// conditions counts the non-path conditions, used to prefer the more specific route
+func (rt *Route) conditions() int {
+	match := rt.Config.Match
+	if match == nil {
+		return 0
+	}
+
+	count := len(match.Headers) + len(match.Query)
+	if len(match.Hosts) > 0 {
+		count++
+	}
+	if len(match.Methods) > 0 {
+		count++
+	}
+	return count
+}
+
+// sortRoutes orders routes by priority, then path specificity, then the
+// number of other conditions
+func sortRoutes(routes []*Route) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if a.priority() != b.priority() {
+			return a.priority() > b.priority()
+		}
+		if c := a.matcher.compare(b.matcher); c != 0 {
+			return c < 0
+		}
+		if a.conditions() != b.conditions() {
+			return a.conditions() > b.conditions()
+		}
+		return a.Path < b.Path
+	})
+}
+
+func matchHost(hosts []string, requestHost string) bool {
+	host := requestHost
+	if h, _, err := net.SplitHostPort(requestHost); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	for _, pattern := range hosts {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func matchMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchValue(expected string, values []string) bool {
+	if expected == "*" {
+		return true
+	}
+	for _, value := range values {
+		if value == expected {
+			return true
+		}
+	}
+	return false
+}
+
+// templateParam finds {name} and {*} placeholders in paths and rewrites
+var templateParam = regexp.MustCompile(`\{[A-Za-z0-9_*]+\}`)
+
+// pathPattern matches request paths segment by segment, so /user matches
+// /user and /user/1 but not /users-admin
+type pathPattern struct {
+	segments []string // literal, "{name}" or "*"
+	regex    *regexp.Regexp
+	exact    bool
+
+	rank []int // Segment kinds compared to order routes
+}
+
+func compilePattern(path, regex string, exact bool) (*pathPattern, error) {
+	if regex != "" {
+		if !strings.HasPrefix(regex, "^") {
+			regex = "^" + regex
+		}
+		compiled, err := regexp.Compile(regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route regex: %w", err)
+		}
+		return &pathPattern{regex: compiled, exact: exact, rank: regexRank(regex)}, nil
+	}
+
+	// A trailing slash on a pattern is not significant: /api/ behaves like /api
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+	segments := splitPath(path)
+	rank := make([]int, len(segments))
+	for i, segment := range segments {
+		rank[i] = segmentKind(segment)
+	}
+	return &pathPattern{segments: segments, exact: exact, rank: rank}, nil
+}
+
+// regexRank ranks a regex like a template of the whole segments in its
+// literal prefix followed by one segment for the rest of the expression,
+// so ^/users/[0-9]+ sorts with /users/{id} rather than after every template
+func regexRank(regex string) []int {
+	prefix, complete := regexLiteralPrefix(regex)
+	segments := splitPath(prefix)
+	rank := make([]int, len(segments))
+	if !complete {
+		// The last segment is cut short by the expression
+		if len(segments) == 0 {
+			return []int{segmentRegex}
+		}
+		rank[len(rank)-1] = segmentRegex
+	}
+	return rank
+}
+
+// regexLiteralPrefix returns the literal text every match starts with and
+// whether it is the whole expression
+func regexLiteralPrefix(regex string) (string, bool) {
+	re, err := syntax.Parse(regex, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	re = re.Simplify()
+
+	parts := []*syntax.Regexp{re}
+	if re.Op == syntax.OpConcat {
+		parts = re.Sub
+	}
+
+	var prefix strings.Builder
+	for _, part := range parts {
+		switch {
+		case part.Op == syntax.OpBeginText || part.Op == syntax.OpBeginLine:
+		case part.Op == syntax.OpLiteral && part.Flags&syntax.FoldCase == 0:
+			prefix.WriteString(string(part.Rune))
+		default:
+			return prefix.String(), false
+		}
+	}
+	return prefix.String(), true
+}
+
+func (p *pathPattern) match(path string) (map[string]string, string, bool) {
+	if p.regex != nil {
+		return p.matchRegex(path)
+	}
+
+	parts := splitPath(path)
+	if len(parts) < len(p.segments) {
+		return nil, "", false
+	}
+
+	var params map[string]string
+	for i, segment := range p.segments {
+		part := parts[i]
+		switch {
+		case segment == "*":
+			if part == "" {
+				return nil, "", false
+			}
+		case isParamSegment(segment):
+			if part == "" {
+				return nil, "", false
+			}
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[segment[1:len(segment)-1]] = part
+		case segment != part:
+			return nil, "", false
+		}
+	}
+
+	remaining := parts[len(p.segments):]
+	if p.exact && !(len(remaining) == 0 || (len(remaining) == 1 && remaining[0] == "")) {
+		return nil, "", false
+	}
+
+	if len(remaining) == 0 {
+		return params, "", true
+	}
+	return params, "/" + strings.Join(remaining, "/"), true
+}
+
+// Segment kinds, most specific first
+const (
+	segmentLiteral = iota
+	segmentParam
+	segmentWildcard
+	segmentRegex
+)
+
+func isParamSegment(segment string) bool {
+	return len(segment) > 2 && segment[0] == '{' && segment[len(segment)-1] == '}'
+}
+
+func segmentKind(segment string) int {
+	switch {
+	case segment == "*":
+		return segmentWildcard
+	case isParamSegment(segment):
+		return segmentParam
+	}
+	return segmentLiteral
+}
+
+// compare ranks p against q for matching order: negative when p should be
+// tried first. Patterns with more segments come first; between patterns of
+// the same length the first differing segment decides, literal before
+// {param} before wildcard before the regex part of an expression; then exact
+// before prefix matches. On a tie templates come before regexes, and longer
+// expressions before shorter ones.
+func (p *pathPattern) compare(q *pathPattern) int {
+	if c := len(q.rank) - len(p.rank); c != 0 {
+		return c
+	}
+	for i := range p.rank {
+		if c := p.rank[i] - q.rank[i]; c != 0 {
+			return c
+		}
+	}
+
+	if p.exact != q.exact {
+		if p.exact {
+			return -1
+		}
+		return 1
+	}
+
+	if (p.regex != nil) != (q.regex != nil) {
+		if p.regex == nil {
+			return -1
+		}
+		return 1
+	}
+	if p.regex != nil {
+		return len(q.regex.String()) - len(p.regex.String())
+	}
+	return 0
+}
+
+func (p *pathPattern) matchRegex(path string) (map[string]string, string, bool) {
+	loc := p.regex.FindStringSubmatchIndex(path)
+	if loc == nil {
+		return nil, "", false
+	}
+
+	end := loc[1]
+	if p.exact && end != len(path) {
+		return nil, "", false
+	}
+
+	var params map[string]string
+	for i, name := range p.regex.SubexpNames() {
+		if name == "" || loc[2*i] < 0 {
+			continue
+		}
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[name] = path[loc[2*i]:loc[2*i+1]]
+	}
+
+	return params, path[end:], true
+}
+
+// splitPath splits a path into segments without the leading slash:
+// "/" -> [], "/a/b" -> [a b], "/a/" -> [a ""]
+func splitPath(path string) []string {
+	path = strings.TrimPrefix(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
@@ -0,0 +1,194 @@
+package internals
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+func testRoute(t *testing.T, path string, match *types.MatchConfig) *Route {
+	t.Helper()
+	route, err := newRoute(path, &types.RouteConfig{Path: path, Match: match})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return route
+}
+
+func TestSortRoutes(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths map[string]*types.MatchConfig // registry path -> match rules
+		want  []string
+	}{
+		{
+			name: "literal before param",
+			paths: map[string]*types.MatchConfig{
+				"/users/{id}": nil,
+				"/users/me":   nil,
+			},
+			want: []string{"/users/me", "/users/{id}"},
+		},
+		{
+			name: "param before wildcard",
+			paths: map[string]*types.MatchConfig{
+				"/files/*":    nil,
+				"/files/{id}": nil,
+			},
+			want: []string{"/files/{id}", "/files/*"},
+		},
+		{
+			name: "more segments first",
+			paths: map[string]*types.MatchConfig{
+				"/":                  nil,
+				"/users":             nil,
+				"/users/me":          nil,
+				"/users/{id}/orders": nil,
+			},
+			want: []string{"/users/{id}/orders", "/users/me", "/users", "/"},
+		},
+		{
+			name: "first differing segment decides",
+			paths: map[string]*types.MatchConfig{
+				"/{tenant}/users": nil,
+				"/admin/{page}":   nil,
+			},
+			want: []string{"/admin/{page}", "/{tenant}/users"},
+		},
+		{
+			name: "exact before prefix",
+			paths: map[string]*types.MatchConfig{
+				"/health":       nil,
+				"/health-exact": {Path: "/health", Exact: true},
+			},
+			want: []string{"/health-exact", "/health"},
+		},
+		{
+			name: "regex ranked by its literal prefix",
+			paths: map[string]*types.MatchConfig{
+				"/numeric": {Regex: `^/users/(?P<id>[0-9]+)`},
+				"/short":   {Regex: `^/u`},
+				"/root":    {Path: "/"},
+				"/orders":  {Path: "/users/{id}/orders"},
+			},
+			want: []string{"/orders", "/numeric", "/short", "/root"},
+		},
+		{
+			name: "template before regex of the same rank",
+			paths: map[string]*types.MatchConfig{
+				"/numeric": {Regex: `^/users/[0-9]+`},
+				"/param":   {Path: "/users/{id}"},
+				"/me":      {Regex: `^/users/me`},
+			},
+			want: []string{"/me", "/param", "/numeric"},
+		},
+		{
+			name: "priority wins",
+			paths: map[string]*types.MatchConfig{
+				"/users/me":   nil,
+				"/users/{id}": {Priority: 10},
+			},
+			want: []string{"/users/{id}", "/users/me"},
+		},
+		{
+			name: "conditions break ties",
+			paths: map[string]*types.MatchConfig{
+				"/any":  {Path: "/items"},
+				"/gets": {Path: "/items", Methods: []string{"GET"}},
+			},
+			want: []string{"/gets", "/any"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var routes []*Route
+			for path, match := range tt.paths {
+				routes = append(routes, testRoute(t, path, match))
+			}
+			sortRoutes(routes)
+
+			got := make([]string, len(routes))
+			for i, route := range routes {
+				got[i] = route.Path
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteMatchParams(t *testing.T) {
+	tests := []struct {
+		name       string
+		match      *types.MatchConfig
+		path       string
+		ok         bool
+		wantParams map[string]string
+		wantRest   string
+	}{
+		{"prefix", &types.MatchConfig{Path: "/users"}, "/users/1/orders", true, nil, "/1/orders"},
+		{"segment boundary", &types.MatchConfig{Path: "/user"}, "/users", false, nil, ""},
+		{"params", &types.MatchConfig{Path: "/users/{id}/orders/{order}"}, "/users/7/orders/9", true, map[string]string{"id": "7", "order": "9"}, ""},
+		{"empty param", &types.MatchConfig{Path: "/users/{id}"}, "/users/", false, nil, ""},
+		{"wildcard", &types.MatchConfig{Path: "/files/*/meta"}, "/files/a/meta/x", true, nil, "/x"},
+		{"exact", &types.MatchConfig{Path: "/health", Exact: true}, "/health/deep", false, nil, ""},
+		{"exact trailing slash", &types.MatchConfig{Path: "/health", Exact: true}, "/health/", true, nil, "/"},
+		{"regex", &types.MatchConfig{Regex: `/v(?P<version>[0-9]+)`}, "/v2/items", true, map[string]string{"version": "2"}, "/items"},
+		{"regex anchored", &types.MatchConfig{Regex: `/v[0-9]+`}, "/api/v2", false, nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := testRoute(t, "/route", tt.match)
+			m, ok := route.Match(httptest.NewRequest("GET", tt.path, nil))
+			if ok != tt.ok {
+				t.Fatalf("Match(%s) = %v, want %v", tt.path, ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if !reflect.DeepEqual(m.Params, tt.wantParams) {
+				t.Errorf("params = %v, want %v", m.Params, tt.wantParams)
+			}
+			if m.Rest != tt.wantRest {
+				t.Errorf("rest = %q, want %q", m.Rest, tt.wantRest)
+			}
+		})
+	}
+}
+
+func TestTargetPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		rewrite string
+		path    string
+		want    string
+	}{
+		{"strip prefix", "/api", "", "/api/users/1", "/users/1"},
+		{"strip to root", "/api", "", "/api", "/"},
+		{"params", "/users/{id}", "/v2/accounts/{id}", "/users/7", "/v2/accounts/7"},
+		{"rest appended", "/users/{id}", "/accounts/{id}", "/users/7/orders", "/accounts/7/orders"},
+		{"rest placeholder", "/files", "/storage/{*}/raw", "/files/a/b", "/storage/a/b/raw"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route, err := newRoute(tt.pattern, &types.RouteConfig{Path: tt.pattern, Rewrite: tt.rewrite})
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, ok := route.Match(httptest.NewRequest("GET", tt.path, nil))
+			if !ok {
+				t.Fatalf("%s does not match %s", tt.path, tt.pattern)
+			}
+			if got := m.TargetPath(); got != tt.want {
+				t.Errorf("TargetPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
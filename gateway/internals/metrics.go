@@ -1,6 +1,9 @@
 package internals
 
 import (
+	"bufio"
+	"errors"
+	"net"
 	"net/http"
 	"strconv"
 	"time"
@@ -16,6 +19,17 @@ type MetricsCollector struct {
 	errorCount      *prometheus.CounterVec
 	cacheHits       *prometheus.CounterVec
 	activeRequests  *prometheus.GaugeVec
+	wsActive        *prometheus.GaugeVec
+	wsTotal         *prometheus.CounterVec
+	wsBytes         *prometheus.CounterVec
+	grpcCount       *prometheus.CounterVec
+	grpcDuration    *prometheus.HistogramVec
+	mirrorCount     *prometheus.CounterVec
+	mirrorDuration  *prometheus.HistogramVec
+	mirrorDropped   *prometheus.CounterVec
+	faults          *prometheus.CounterVec
+	cacheLookups    *prometheus.CounterVec
+	circuitState    *prometheus.GaugeVec
 }
 
 func NewMetricsCollector() *MetricsCollector {
@@ -56,6 +70,85 @@ func NewMetricsCollector() *MetricsCollector {
 			},
 			[]string{"service"},
 		),
+		wsActive: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "gateway_websocket_connections_active",
+				Help: "Number of open WebSocket connections",
+			},
+			[]string{"service"},
+		),
+		wsTotal: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "gateway_websocket_connections_total",
+				Help: "Total number of WebSocket connections",
+			},
+			[]string{"service"},
+		),
+		wsBytes: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "gateway_websocket_bytes_total",
+				Help: "Bytes transferred over WebSocket connections",
+			},
+			[]string{"service", "direction"},
+		),
+		grpcCount: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "gateway_grpc_requests_total",
+				Help: "Total number of gRPC calls by method and grpc-status",
+			},
+			[]string{"service", "grpc_method", "grpc_status"},
+		),
+		grpcDuration: promauto.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "gateway_grpc_request_duration_seconds",
+				Help:    "gRPC call duration in seconds",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"service", "grpc_method", "grpc_status"},
+		),
+		mirrorCount: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "gateway_mirror_requests_total",
+				Help: "Total number of mirrored requests by shadow response status",
+			},
+			[]string{"route", "service", "status"},
+		),
+		mirrorDuration: promauto.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "gateway_mirror_request_duration_seconds",
+				Help:    "Mirrored request duration in seconds",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"route", "service"},
+		),
+		mirrorDropped: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "gateway_mirror_dropped_total",
+				Help: "Total number of requests selected for mirroring but not mirrored",
+			},
+			[]string{"route", "reason"},
+		),
+		faults: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "gateway_fault_injections_total",
+				Help: "Total number of injected delays and aborts",
+			},
+			[]string{"route", "fault"},
+		),
+		cacheLookups: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "gateway_cache_lookups_total",
+				Help: "Total number of cache lookups per tier (local, redis) and result (hit, miss)",
+			},
+			[]string{"tier", "result"},
+		),
+		circuitState: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "gateway_circuit_breaker_state",
+				Help: "Circuit breaker state per service: 1 for the current state, 0 for the others",
+			},
+			[]string{"service", "state"},
+		),
 	}
 }
 
@@ -64,6 +157,27 @@ func (mc *MetricsCollector) RecordRequest(service, method string, statusCode int
 	mc.requestDuration.WithLabelValues(service, method).Observe(duration.Seconds())
 }
 
+func (mc *MetricsCollector) RecordGRPCRequest(service, method string, code int, duration time.Duration) {
+	status := strconv.Itoa(code)
+	mc.grpcCount.WithLabelValues(service, method, status).Inc()
+	mc.grpcDuration.WithLabelValues(service, method, status).Observe(duration.Seconds())
+}
+
+// RecordMirrorRequest records a shadow response; status is "error" when the
+// shadow service could not be reached
+func (mc *MetricsCollector) RecordMirrorRequest(route, service, status string, duration time.Duration) {
+	mc.mirrorCount.WithLabelValues(route, service, status).Inc()
+	mc.mirrorDuration.WithLabelValues(route, service).Observe(duration.Seconds())
+}
+
+func (mc *MetricsCollector) RecordMirrorDropped(route, reason string) {
+	mc.mirrorDropped.WithLabelValues(route, reason).Inc()
+}
+
+func (mc *MetricsCollector) RecordFault(route, fault string) {
+	mc.faults.WithLabelValues(route, fault).Inc()
+}
+
 func (mc *MetricsCollector) RecordError(service, errorType string) {
 	mc.errorCount.WithLabelValues(service, errorType).Inc()
 }
@@ -72,6 +186,27 @@ func (mc *MetricsCollector) RecordCacheHit(service string) {
 	mc.cacheHits.WithLabelValues(service).Inc()
 }
 
+// RecordCacheLookup counts a lookup in one tier of the response cache; the
+// hit ratio of a tier is hits over hits and misses
+func (mc *MetricsCollector) RecordCacheLookup(tier string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	mc.cacheLookups.WithLabelValues(tier, result).Inc()
+}
+
+// SetCircuitState marks state as the current breaker state of a service
+func (mc *MetricsCollector) SetCircuitState(service, state string) {
+	for _, s := range circuitStates {
+		value := 0.0
+		if string(s) == state {
+			value = 1
+		}
+		mc.circuitState.WithLabelValues(service, string(s)).Set(value)
+	}
+}
+
 func (mc *MetricsCollector) IncrementActive(service string) {
 	mc.activeRequests.WithLabelValues(service).Inc()
 }
@@ -80,6 +215,21 @@ func (mc *MetricsCollector) DecrementActive(service string) {
 	mc.activeRequests.WithLabelValues(service).Dec()
 }
 
+func (mc *MetricsCollector) WebSocketOpened(service string) {
+	mc.wsTotal.WithLabelValues(service).Inc()
+	mc.wsActive.WithLabelValues(service).Inc()
+}
+
+func (mc *MetricsCollector) WebSocketClosed(service string) {
+	mc.wsActive.WithLabelValues(service).Dec()
+}
+
+// RecordWebSocketBytes counts bytes sent "upstream" (client to service) or
+// "downstream" (service to client)
+func (mc *MetricsCollector) RecordWebSocketBytes(service, direction string, n int) {
+	mc.wsBytes.WithLabelValues(service, direction).Add(float64(n))
+}
+
 func (mc *MetricsCollector) Handler() http.Handler {
 	return promhttp.Handler()
 }
@@ -108,3 +258,23 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.statusCode = code
 	rw.ResponseWriter.WriteHeader(code)
 }
+
+// Hijack lets WebSocket and other Upgrade requests take over the connection
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+func (rw *responseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
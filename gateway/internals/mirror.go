@@ -0,0 +1,186 @@
+package internals
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxMirrorsInFlight bounds concurrent shadow requests; extra copies are dropped
+	maxMirrorsInFlight    = 256
+	defaultMirrorBodySize = 1 << 20
+	defaultMirrorTimeout  = 10 * time.Second
+)
+
+// mirrorTransport never shares connections with the primary traffic
+var mirrorTransport = http.DefaultTransport.(*http.Transport).Clone()
+
+// mirror copies a share of the route's requests to its shadow services in
+// the background. The body is copied as the primary upstream reads it, so
+// the primary request is never held up buffering it.
+func (g *Gateway) mirror(r *http.Request, route *RouteMatch, targetPath string) {
+	config := route.Config.Mirror
+	if config == nil || config.Percent <= 0 || rand.Float64()*100 >= config.Percent {
+		return
+	}
+
+	maxSize := config.MaxBodySize
+	if maxSize == 0 {
+		maxSize = defaultMirrorBodySize
+	}
+	hasBody := r.Body != nil && r.Body != http.NoBody
+	if hasBody && r.ContentLength > maxSize {
+		g.metrics.RecordMirrorDropped(route.Path, "body_too_large")
+		return
+	}
+
+	select {
+	case g.mirrors <- struct{}{}:
+	default:
+		g.metrics.RecordMirrorDropped(route.Path, "saturated")
+		return
+	}
+
+	var copied *mirrorBody
+	if hasBody {
+		copied = &mirrorBody{ReadCloser: r.Body, max: maxSize, done: make(chan struct{})}
+		r.Body = copied
+	}
+
+	// Copied now: r belongs to the primary request once this returns
+	method := r.Method
+	header := r.Header.Clone()
+	query := r.URL.RawQuery
+	host := r.Host
+	remoteAddr := r.RemoteAddr
+	scheme := requestScheme(r)
+	primaryDone := r.Context().Done()
+
+	go func() {
+		defer func() { <-g.mirrors }()
+
+		var body []byte
+		if copied != nil {
+			if reason := copied.wait(primaryDone); reason != "" {
+				g.metrics.RecordMirrorDropped(route.Path, reason)
+				return
+			}
+			body = copied.buf.Bytes()
+		}
+
+		timeout := config.Timeout
+		if timeout == 0 {
+			timeout = defaultMirrorTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		shadowReq := (&http.Request{Method: method, Header: header, Host: host, RemoteAddr: remoteAddr}).WithContext(ctx)
+		service, err := g.registry.GetNextService(ctx, config.Path, shadowReq)
+		if err != nil {
+			g.metrics.RecordMirrorDropped(route.Path, "no_healthy_service")
+			return
+		}
+
+		target := *service.URL
+		target.Path = targetPath
+		target.RawPath = ""
+		target.RawQuery = query
+
+		req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+		req.Header = header
+		for _, name := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"} {
+			req.Header.Del(name)
+		}
+		req.Header.Set("X-Forwarded-Host", host)
+		req.Header.Set("X-Forwarded-Proto", scheme)
+		req.Header.Set("X-Forwarded-For", remoteAddr)
+		req.Header.Set("X-Mirrored-From", route.Path)
+
+		start := time.Now()
+		resp, err := mirrorTransport.RoundTrip(req)
+		if err != nil {
+			g.metrics.RecordMirrorRequest(route.Path, service.Name, "error", time.Since(start))
+			g.log.Debug("mirror request failed", "path", route.Path, "service", service.Name, "error", err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		g.metrics.RecordMirrorRequest(route.Path, service.Name, strconv.Itoa(resp.StatusCode), time.Since(start))
+	}()
+}
+
+// mirrorBody copies a request body as the primary upstream reads it. The
+// copy is only handed to the mirror once the body has been read whole.
+type mirrorBody struct {
+	io.ReadCloser
+	max  int64
+	done chan struct{} // Closed once the copy is complete or given up
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	finished bool
+	dropped  string // Why the copy is unusable, empty when complete
+}
+
+func (b *mirrorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.finished && n > 0 {
+		if int64(b.buf.Len()+n) > b.max {
+			b.finish("body_too_large")
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.finish("")
+	}
+	return n, err
+}
+
+// Close gives up on a body the primary upstream didn't read to the end
+func (b *mirrorBody) Close() error {
+	b.mu.Lock()
+	b.finish("body_incomplete")
+	b.mu.Unlock()
+	return b.ReadCloser.Close()
+}
+
+// finish settles the copy; callers hold mu
+func (b *mirrorBody) finish(dropped string) {
+	if b.finished {
+		return
+	}
+	b.finished = true
+	b.dropped = dropped
+	if dropped != "" {
+		b.buf = bytes.Buffer{}
+	}
+	close(b.done)
+}
+
+// wait blocks until the body is copied or the primary request is over, and
+// returns why the copy can't be mirrored, if it can't
+func (b *mirrorBody) wait(primaryDone <-chan struct{}) string {
+	select {
+	case <-b.done:
+	case <-primaryDone:
+		b.mu.Lock()
+		b.finish("body_incomplete")
+		b.mu.Unlock()
+	}
+	return b.dropped
+}
@@ -0,0 +1,143 @@
+package internals
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+type mirroredRequest struct {
+	path, body, from string
+}
+
+func echo(w http.ResponseWriter, r *http.Request) {
+	io.Copy(w, r.Body)
+}
+
+// newMirrorGateway serves /api from the primary handler and mirrors it to a
+// shadow service registered under /shadow
+func newMirrorGateway(t *testing.T, config *types.MirrorConfig, handler http.HandlerFunc) (*httptest.Server, chan mirroredRequest) {
+	t.Helper()
+	primary := httptest.NewServer(handler)
+	t.Cleanup(primary.Close)
+
+	mirrored := make(chan mirroredRequest, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mirrored <- mirroredRequest{r.URL.Path, string(body), r.Header.Get("X-Mirrored-From")}
+	}))
+	t.Cleanup(shadow.Close)
+
+	g, _ := newTestGateway(t, primary.URL, true, &types.RouteConfig{Mirror: config})
+	target, _ := url.Parse(shadow.URL)
+	if err := g.registry.AddService(context.Background(), "/shadow", &types.Service{Name: "shadow", URL: target, Healthy: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.registry.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	gateway := httptest.NewServer(http.HandlerFunc(g.ProxyHandler))
+	t.Cleanup(gateway.Close)
+	return gateway, mirrored
+}
+
+func TestMirror(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   *types.MirrorConfig
+		chunked  bool // Sent without a Content-Length
+		mirrored bool
+	}{
+		{"mirrored", &types.MirrorConfig{Path: "/shadow", Percent: 100}, false, true},
+		{"mirrored chunked", &types.MirrorConfig{Path: "/shadow", Percent: 100}, true, true},
+		{"zero percent", &types.MirrorConfig{Path: "/shadow", Percent: 0}, false, false},
+		{"body too large", &types.MirrorConfig{Path: "/shadow", Percent: 100, MaxBodySize: 4}, false, false},
+		{"chunked body too large", &types.MirrorConfig{Path: "/shadow", Percent: 100, MaxBodySize: 4}, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gateway, mirrored := newMirrorGateway(t, tt.config, echo)
+
+			var sent io.Reader = strings.NewReader("hello")
+			if tt.chunked {
+				sent = io.MultiReader(sent)
+			}
+			resp, err := http.Post(gateway.URL+"/api/items", "text/plain", sent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			// The primary always gets the whole body
+			if string(body) != "hello" {
+				t.Fatalf("primary body = %q, want hello", body)
+			}
+
+			select {
+			case got := <-mirrored:
+				if !tt.mirrored {
+					t.Fatalf("unexpected mirror request %+v", got)
+				}
+				want := mirroredRequest{"/items", "hello", "/api"}
+				if got != want {
+					t.Errorf("mirrored %+v, want %+v", got, want)
+				}
+			case <-time.After(300 * time.Millisecond):
+				if tt.mirrored {
+					t.Fatal("request not mirrored")
+				}
+			}
+		})
+	}
+}
+
+// The primary upstream reads the body as the client sends it, and the mirror
+// starts from the copy once the body is complete
+func TestMirrorStreamsBody(t *testing.T) {
+	firstRead := make(chan struct{})
+	gateway, mirrored := newMirrorGateway(t, &types.MirrorConfig{Path: "/shadow", Percent: 100},
+		func(w http.ResponseWriter, r *http.Request) {
+			buf := make([]byte, 3)
+			io.ReadFull(r.Body, buf)
+			close(firstRead)
+			io.Copy(io.Discard, r.Body)
+		})
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("hel"))
+		select {
+		case <-firstRead:
+		case <-time.After(time.Second):
+			pw.CloseWithError(errors.New("primary did not read the body before it was complete"))
+			return
+		}
+		pw.Write([]byte("lo"))
+		pw.Close()
+	}()
+
+	resp, err := http.Post(gateway.URL+"/api/items", "text/plain", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	select {
+	case got := <-mirrored:
+		if got.body != "hello" {
+			t.Errorf("mirrored body = %q, want hello", got.body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request not mirrored")
+	}
+}
@@ -0,0 +1,82 @@
+package internals
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+// serveMock answers with the route's configured response. Mocks take
+// precedence over services, so they also serve maintenance pages and
+// 410 Gone for retired APIs.
+func (g *Gateway) serveMock(w http.ResponseWriter, r *http.Request, route *RouteMatch) {
+	response := mockResponseFor(r, route.Config.Mock)
+
+	for name, value := range response.Headers {
+		if response.Template {
+			value = expandTemplate(value, r, route)
+		}
+		w.Header().Set(name, value)
+	}
+
+	body := response.Body
+	if response.Template {
+		body = expandTemplate(body, r, route)
+	}
+
+	if w.Header().Get("Content-Type") == "" && body != "" {
+		w.Header().Set("Content-Type", http.DetectContentType([]byte(body)))
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("X-Mock", "true")
+
+	status := response.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write([]byte(body))
+	}
+}
+
+// mockResponseFor picks the first response whose conditions match r
+func mockResponseFor(r *http.Request, config *types.MockConfig) *types.MockResponse {
+	for i := range config.Responses {
+		mockCase := &config.Responses[i]
+		if mockMatches(r, mockCase.When) {
+			return &mockCase.MockResponse
+		}
+	}
+	return &config.MockResponse
+}
+
+func mockMatches(r *http.Request, when *types.MockMatch) bool {
+	if when == nil {
+		return true
+	}
+
+	if len(when.Methods) > 0 && !matchMethod(when.Methods, r.Method) {
+		return false
+	}
+
+	for name, expected := range when.Headers {
+		values, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok || !matchValue(expected, values) {
+			return false
+		}
+	}
+
+	if len(when.Query) > 0 {
+		query := r.URL.Query()
+		for name, expected := range when.Query {
+			values, ok := query[name]
+			if !ok || !matchValue(expected, values) {
+				return false
+			}
+		}
+	}
+	return true
+}
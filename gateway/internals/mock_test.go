@@ -0,0 +1,82 @@
+package internals
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+func TestServeMock(t *testing.T) {
+	config := &types.MockConfig{
+		MockResponse: types.MockResponse{Body: `{"status":"maintenance"}`, Status: http.StatusServiceUnavailable,
+			Headers: map[string]string{"Content-Type": "application/json"}},
+		Responses: []types.MockCase{
+			{When: &types.MockMatch{Methods: []string{"DELETE"}}, MockResponse: types.MockResponse{Status: http.StatusGone}},
+			{When: &types.MockMatch{Query: map[string]string{"debug": "*"}, Headers: map[string]string{"X-Team": "core"}},
+				MockResponse: types.MockResponse{Body: "${method} ${path.id} ${query.debug}", Template: true,
+					Headers: map[string]string{"X-User": "${header.X-User}"}}},
+			{When: &types.MockMatch{Query: map[string]string{"raw": "1"}}, MockResponse: types.MockResponse{Body: "${path.id}"}},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		header      http.Header
+		status      int
+		body        string
+		contentType string
+	}{
+		{"default", http.MethodGet, "/api/items/42", nil, http.StatusServiceUnavailable, `{"status":"maintenance"}`, "application/json"},
+		{"method", http.MethodDelete, "/api/items/42", nil, http.StatusGone, "", ""},
+		{"templated", http.MethodGet, "/api/items/42?debug=on", http.Header{"X-Team": {"core"}, "X-User": {"alice"}},
+			http.StatusOK, "GET 42 on", "text/plain; charset=utf-8"},
+		{"header mismatch", http.MethodGet, "/api/items/42?debug=on", http.Header{"X-Team": {"web"}},
+			http.StatusServiceUnavailable, `{"status":"maintenance"}`, "application/json"},
+		{"not templated", http.MethodGet, "/api/items/42?raw=1", nil, http.StatusOK, "${path.id}", "text/plain; charset=utf-8"},
+		{"head", http.MethodHead, "/api/items/42", nil, http.StatusServiceUnavailable, "", "application/json"},
+	}
+
+	g := &Gateway{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			route := &RouteMatch{Route: &Route{Config: &types.RouteConfig{Mock: config}}, Params: map[string]string{"id": "42"}}
+
+			w := httptest.NewRecorder()
+			g.serveMock(w, r, route)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if w.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.body)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if w.Header().Get("X-Mock") != "true" {
+				t.Error("X-Mock header missing")
+			}
+		})
+	}
+
+	t.Run("templated headers", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/api/items/42?debug=on", nil)
+		r.Header.Set("X-Team", "core")
+		r.Header.Set("X-User", "alice")
+		route := &RouteMatch{Route: &Route{Config: &types.RouteConfig{Mock: config}}, Params: map[string]string{"id": "42"}}
+
+		w := httptest.NewRecorder()
+		g.serveMock(w, r, route)
+		if got := w.Header().Get("X-User"); got != "alice" {
+			t.Errorf("X-User = %q, want alice", got)
+		}
+	})
+}
@@ -45,7 +45,7 @@ func (rl *RateLimiter) allowRequest(ctx context.Context, r *http.Request) bool {
 	// Get current count
 	count, err := rl.storage.Incr(ctx, key).Result()
 	if err != nil {
-		rl.log.Error("rate limit error: %v", err)
+		rl.log.Error("rate limit error", "error", err)
 		return true // Fail open
 	}
 
@@ -4,14 +4,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/chann44/ikyk/pkg/logger"
 	"github.com/chann44/ikyk/pkg/types"
+	"github.com/chann44/ikyk/pkg/utils"
 )
 
 const RegistryDB = 0
@@ -34,14 +37,17 @@ var (
 )
 
 type Registery struct {
-	log     *logger.Logger
-	storage *RedisClient
+	log       *logger.Logger
+	storage   *RedisClient
+	balancers map[string]Balancer
+	snapshot  atomic.Pointer[routeSnapshot]
 }
 
-func NewRegistery(storage *RedisClient, log *logger.Logger) *Registery {
+func NewRegistery(storage *RedisClient, log *logger.Logger, loads *LoadTracker) *Registery {
 	return &Registery{
-		log:     log,
-		storage: storage,
+		log:       log,
+		storage:   storage,
+		balancers: newBalancers(loads),
 	}
 }
 
@@ -58,6 +64,18 @@ func serviceToData(service *types.Service) *ServiceData {
 	}
 }
 
+func fieldsToService(fields map[string]string) (*types.Service, error) {
+	healthy, _ := strconv.ParseBool(fields["healthy"])
+	lastCheck, _ := time.Parse(time.RFC3339, fields["last_check"])
+
+	return dataToService(&ServiceData{
+		Name:      fields["name"],
+		URL:       fields["url"],
+		Healthy:   healthy,
+		LastCheck: lastCheck,
+	})
+}
+
 func dataToService(data *ServiceData) (*types.Service, error) {
 	parsedURL, err := url.Parse(data.URL)
 	if err != nil {
@@ -102,7 +120,8 @@ func (r *Registery) AddService(ctx context.Context, path string, service *types.
 		return fmt.Errorf("failed to add service: %w", err)
 	}
 
-	r.log.Info("service %s added to path %s", service.Name, path)
+	r.log.Info("service added", "service", service.Name, "path", path)
+	r.publishChange(ctx, "service_added", path)
 	return nil
 }
 
@@ -127,14 +146,24 @@ func (r *Registery) RemoveService(ctx context.Context, path, serviceName string)
 		if err != nil {
 			return fmt.Errorf("failed to cleanup path: %w", err)
 		}
-		r.log.Info("path %s removed (no services left)", path)
+		r.log.Info("path removed (no services left)", "path", path)
 	}
 
-	r.log.Info("service %s removed from path %s", serviceName, path)
+	r.log.Info("service removed", "service", serviceName, "path", path)
+	r.publishChange(ctx, "service_removed", path)
 	return nil
 }
 
+// GetServices returns the services registered for path, served from the
+// in-memory route table once it has been loaded
 func (r *Registery) GetServices(ctx context.Context, path string) ([]*types.Service, error) {
+	if snapshot := r.snapshot.Load(); snapshot != nil {
+		return snapshot.services[path], nil
+	}
+	return r.fetchServices(ctx, path)
+}
+
+func (r *Registery) fetchServices(ctx context.Context, path string) ([]*types.Service, error) {
 	servicesKey := redisKey("registry:path", path, "services")
 	serviceNames, err := r.storage.SMembers(ctx, servicesKey).Result()
 	if err != nil {
@@ -150,23 +179,13 @@ func (r *Registery) GetServices(ctx context.Context, path string) ([]*types.Serv
 		serviceKey := redisKey("registry:path", path, "service", name)
 		fields, err := r.storage.HGetAll(ctx, serviceKey).Result()
 		if err != nil {
-			r.log.Error("failed to get service %s: %v", name, err)
+			r.log.Error("failed to get service", "service", name, "error", err)
 			continue
 		}
 
-		healthy, _ := strconv.ParseBool(fields["healthy"])
-		lastCheck, _ := time.Parse(time.RFC3339, fields["last_check"])
-
-		serviceData := &ServiceData{
-			Name:      fields["name"],
-			URL:       fields["url"],
-			Healthy:   healthy,
-			LastCheck: lastCheck,
-		}
-
-		service, err := dataToService(serviceData)
+		service, err := fieldsToService(fields)
 		if err != nil {
-			r.log.Error("failed to parse service %s: %v", name, err)
+			r.log.Error("failed to parse service", "service", name, "error", err)
 			continue
 		}
 
@@ -176,62 +195,97 @@ func (r *Registery) GetServices(ctx context.Context, path string) ([]*types.Serv
 	return services, nil
 }
 
-func (r *Registery) GetNextService(ctx context.Context, path string) (*types.Service, error) {
-	servicesKey := redisKey("registry:path", path, "services")
-	serviceNames, err := r.storage.SMembers(ctx, servicesKey).Result()
+// GetNextService picks a healthy service for path using the balancer
+// strategy configured for the route (round-robin by default)
+func (r *Registery) GetNextService(ctx context.Context, path string, req *http.Request) (*types.Service, error) {
+	services, err := r.GetServices(ctx, path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get service names: %w", err)
+		return nil, err
 	}
 
-	if len(serviceNames) == 0 {
+	if len(services) == 0 {
 		return nil, ErrNoServicesForPath
 	}
 
-	indexKey := redisKey("registry:path", path, "index")
-	maxAttempts := len(serviceNames) + 1
-
-	for attempts := 0; attempts < maxAttempts; attempts++ {
-		index, err := r.storage.Incr(ctx, indexKey).Result()
-		if err != nil {
-			return nil, fmt.Errorf("failed to increment index: %w", err)
+	healthy := make([]*types.Service, 0, len(services))
+	for _, service := range services {
+		if service.Healthy {
+			healthy = append(healthy, service)
 		}
+	}
 
-		position := int(index-1) % len(serviceNames)
-		serviceName := serviceNames[position]
+	if len(healthy) == 0 {
+		return nil, ErrAllServicesUnhealthy
+	}
 
-		serviceKey := redisKey("registry:path", path, "service", serviceName)
-		fields, err := r.storage.HGetAll(ctx, serviceKey).Result()
-		if err != nil {
-			r.log.Error("failed to get service %s: %v", serviceName, err)
-			continue
-		}
+	config, err := r.GetRouteConfig(ctx, path)
+	if err != nil {
+		r.log.Error("failed to get route config", "path", path, "error", err)
+		config = &types.RouteConfig{Path: path}
+	}
 
-		healthy, _ := strconv.ParseBool(fields["healthy"])
-		if !healthy {
-			continue
+	return r.balancerFor(config.Balancer).Pick(req, path, healthy, config.Balancer), nil
+}
+
+// GetService returns the named service registered under path
+func (r *Registery) GetService(ctx context.Context, path, serviceName string) (*types.Service, error) {
+	services, err := r.GetServices(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, service := range services {
+		if service.Name == serviceName {
+			return service, nil
 		}
+	}
+	return nil, ErrServiceNotFound
+}
 
-		lastCheck, _ := time.Parse(time.RFC3339, fields["last_check"])
-		serviceData := &ServiceData{
-			Name:      fields["name"],
-			URL:       fields["url"],
-			Healthy:   healthy,
-			LastCheck: lastCheck,
+func (r *Registery) balancerFor(config *types.BalancerConfig) Balancer {
+	if config != nil {
+		if balancer, ok := r.balancers[config.Strategy]; ok {
+			return balancer
 		}
+	}
+	return r.balancers[StrategyRoundRobin]
+}
 
-		service, err := dataToService(serviceData)
-		if err != nil {
-			r.log.Error("failed to parse service %s: %v", serviceName, err)
-			continue
+// GetRouteConfig returns the policies stored for path; a route without
+// stored policies gets an empty config. The result is shared and must not
+// be modified.
+func (r *Registery) GetRouteConfig(ctx context.Context, path string) (*types.RouteConfig, error) {
+	if snapshot := r.snapshot.Load(); snapshot != nil {
+		if config, ok := snapshot.configs[path]; ok {
+			return config, nil
 		}
+		return &types.RouteConfig{Path: path}, nil
+	}
+	return r.fetchRouteConfig(ctx, path)
+}
+
+func (r *Registery) fetchRouteConfig(ctx context.Context, path string) (*types.RouteConfig, error) {
+	fields, err := r.storage.HGetAll(ctx, redisKey("registry:path", path, "config")).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get route config: %w", err)
+	}
 
-		return service, nil
+	config := &types.RouteConfig{}
+	if err := utils.FromHashFields(fields, config); err != nil {
+		return nil, fmt.Errorf("invalid route config: %w", err)
 	}
+	config.Path = path
 
-	return nil, ErrAllServicesUnhealthy
+	return config, nil
 }
 
+// ListAllPaths returns the sorted registered paths. The result is shared and
+// must not be modified.
 func (r *Registery) ListAllPaths(ctx context.Context) ([]string, error) {
+	if snapshot := r.snapshot.Load(); snapshot != nil {
+		return snapshot.paths, nil
+	}
+
 	paths, err := r.storage.SMembers(ctx, "registry:paths").Result()
 	if err != nil {
 		return nil, fmt.Errorf("failed to list paths: %w", err)
@@ -257,6 +311,9 @@ func (r *Registery) UpdateServiceHealth(ctx context.Context, path, serviceName s
 		return fmt.Errorf("failed to update service health: %w", err)
 	}
 
-	r.log.Info("service %s health updated: healthy=%v", serviceName, healthy)
+	r.log.Info("service health updated", "service", serviceName, "healthy", healthy)
+	if r.healthChanged(path, serviceName, healthy) {
+		r.publishChange(ctx, "health_updated", path)
+	}
 	return nil
 }
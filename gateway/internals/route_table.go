@@ -0,0 +1,315 @@
+package internals
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/chann44/ikyk/pkg/types"
+	"github.com/chann44/ikyk/pkg/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+// RegistryEventsChannel carries types.RegistryEvent messages published by the
+// management API and the gateway whenever the registry changes
+const RegistryEventsChannel = "registry:events"
+
+const (
+	registryResyncInterval = 60 * time.Second
+	registryReloadDebounce = 100 * time.Millisecond
+)
+
+// routeSnapshot is an immutable copy of the registry used on the hot path
+type routeSnapshot struct {
+	paths    []string
+	routes   []*Route
+	services map[string][]*types.Service
+	configs  map[string]*types.RouteConfig
+	breakers map[string]*types.CircuitBreakerConfig // By service name
+	loadedAt time.Time
+}
+
+// Reload rebuilds the in-memory route table from Redis
+func (r *Registery) Reload(ctx context.Context) error {
+	pipe := r.storage.Pipeline()
+	pathsCmd := pipe.SMembers(ctx, "registry:paths")
+	routesCmd := pipe.SMembers(ctx, "registry:routes")
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to list routes: %w", err)
+	}
+
+	paths := pathsCmd.Val()
+	sort.Strings(paths)
+
+	registered := make(map[string]bool, len(paths))
+	routes := make(map[string]struct{}, len(paths))
+	for _, path := range paths {
+		registered[path] = true
+		routes[path] = struct{}{}
+	}
+	for _, path := range routesCmd.Val() {
+		routes[path] = struct{}{}
+	}
+
+	// Service names, configs and descriptor sets for every route in one round-trip
+	namesCmds := make(map[string]*redis.StringSliceCmd, len(routes))
+	configCmds := make(map[string]*redis.MapStringStringCmd, len(routes))
+	descriptorCmds := make(map[string]*redis.StringCmd, len(routes))
+	pipe = r.storage.Pipeline()
+	for path := range routes {
+		namesCmds[path] = pipe.SMembers(ctx, redisKey("registry:path", path, "services"))
+		configCmds[path] = pipe.HGetAll(ctx, redisKey("registry:path", path, "config"))
+		descriptorCmds[path] = pipe.Get(ctx, redisKey("registry:path", path, "descriptors"))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return fmt.Errorf("failed to load routes: %w", err)
+	}
+
+	// Service hashes and breaker policies in a second round-trip
+	serviceCmds := make(map[string][]*redis.MapStringStringCmd, len(routes))
+	breakerCmds := make(map[string]*redis.StringCmd)
+	pipe = r.storage.Pipeline()
+	for path, namesCmd := range namesCmds {
+		for _, name := range namesCmd.Val() {
+			cmd := pipe.HGetAll(ctx, redisKey("registry:path", path, "service", name))
+			serviceCmds[path] = append(serviceCmds[path], cmd)
+			if breakerCmds[name] == nil {
+				breakerCmds[name] = pipe.Get(ctx, redisKey("registry:service", name, "circuit"))
+			}
+		}
+	}
+	if len(serviceCmds) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return fmt.Errorf("failed to load services: %w", err)
+		}
+	}
+
+	snapshot := &routeSnapshot{
+		paths:    paths,
+		services: make(map[string][]*types.Service, len(routes)),
+		configs:  make(map[string]*types.RouteConfig, len(routes)),
+		breakers: make(map[string]*types.CircuitBreakerConfig, len(breakerCmds)),
+		loadedAt: time.Now(),
+	}
+
+	for name, cmd := range breakerCmds {
+		if config := parseBreakerConfig(cmd.Val()); config != nil {
+			snapshot.breakers[name] = config
+		} else if cmd.Val() != "" {
+			r.log.Error("invalid circuit breaker config", "service", name)
+		}
+	}
+
+	for path, configCmd := range configCmds {
+		config := &types.RouteConfig{}
+		if err := utils.FromHashFields(configCmd.Val(), config); err != nil {
+			r.log.Error("invalid route config", "path", path, "error", err)
+			config = &types.RouteConfig{}
+		}
+		config.Path = path
+		snapshot.configs[path] = config
+	}
+
+	for path, cmds := range serviceCmds {
+		services := make([]*types.Service, 0, len(cmds))
+		for _, cmd := range cmds {
+			fields := cmd.Val()
+			if len(fields) == 0 {
+				continue
+			}
+			service, err := fieldsToService(fields)
+			if err != nil {
+				r.log.Error("failed to parse service", "path", path, "error", err)
+				continue
+			}
+			services = append(services, service)
+		}
+		// Keep a stable order so round-robin positions survive reloads
+		sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+		snapshot.services[path] = services
+	}
+
+	for path := range routes {
+		if !registered[path] && !servesWithoutServices(snapshot.configs[path]) {
+			continue
+		}
+		route, err := newRoute(path, snapshot.configs[path])
+		if err != nil {
+			r.log.Error("skipping route", "path", path, "error", err)
+			continue
+		}
+		route.transcoder = r.loadTranscoder(path, []byte(descriptorCmds[path].Val()))
+		snapshot.routes = append(snapshot.routes, route)
+	}
+	sortRoutes(snapshot.routes)
+
+	r.snapshot.Store(snapshot)
+	return nil
+}
+
+// Routes returns the routable paths in match order. The result is shared
+// and must not be modified.
+func (r *Registery) Routes(ctx context.Context) ([]*Route, error) {
+	if snapshot := r.snapshot.Load(); snapshot != nil {
+		return snapshot.routes, nil
+	}
+
+	paths, err := r.ListAllPaths(ctx)
+	if err != nil {
+		return nil, err
+	}
+	configured, err := r.storage.SMembers(ctx, "registry:routes").Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %w", err)
+	}
+
+	registered := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		registered[path] = true
+	}
+	for _, path := range configured {
+		if !registered[path] {
+			paths = append(paths, path)
+		}
+	}
+
+	routes := make([]*Route, 0, len(paths))
+	for _, path := range paths {
+		config, err := r.fetchRouteConfig(ctx, path)
+		if err != nil {
+			r.log.Error("failed to get route config", "path", path, "error", err)
+			config = nil
+		}
+		if !registered[path] && !servesWithoutServices(config) {
+			continue
+		}
+		route, err := newRoute(path, config)
+		if err != nil {
+			r.log.Error("skipping route", "path", path, "error", err)
+			continue
+		}
+		descriptors, _ := r.storage.Get(ctx, redisKey("registry:path", path, "descriptors")).Bytes()
+		route.transcoder = r.loadTranscoder(path, descriptors)
+		routes = append(routes, route)
+	}
+	sortRoutes(routes)
+	return routes, nil
+}
+
+// Watch keeps the route table in sync: it reloads when a registry event is
+// published and does a full resync periodically in case events were missed
+func (r *Registery) Watch(ctx context.Context) {
+	pubsub := r.storage.Subscribe(ctx, RegistryEventsChannel)
+	defer pubsub.Close()
+
+	events := pubsub.Channel()
+	ticker := time.NewTicker(registryResyncInterval)
+	defer ticker.Stop()
+
+	r.log.Info("route table watcher started")
+
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+			// Coalesce bursts (e.g. a health check round) into one reload
+			time.Sleep(registryReloadDebounce)
+		drain:
+			for {
+				select {
+				case <-events:
+				default:
+					break drain
+				}
+			}
+			r.reload(ctx)
+		case <-ticker.C:
+			r.reload(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// CircuitBreakerConfig returns the breaker policy stored for a service, or
+// nil when it uses the gateway's defaults
+func (r *Registery) CircuitBreakerConfig(ctx context.Context, name string) *types.CircuitBreakerConfig {
+	if snapshot := r.snapshot.Load(); snapshot != nil {
+		return snapshot.breakers[name]
+	}
+
+	data, err := r.storage.Get(ctx, redisKey("registry:service", name, "circuit")).Result()
+	if err != nil {
+		return nil
+	}
+	return parseBreakerConfig(data)
+}
+
+func parseBreakerConfig(data string) *types.CircuitBreakerConfig {
+	if data == "" {
+		return nil
+	}
+	config := &types.CircuitBreakerConfig{}
+	if err := json.Unmarshal([]byte(data), config); err != nil {
+		return nil
+	}
+	return config
+}
+
+// servesWithoutServices reports whether a route answers on its own, without
+// registered services (aggregation and mocks)
+func servesWithoutServices(config *types.RouteConfig) bool {
+	return config != nil && (config.Aggregate != nil || config.Mock != nil)
+}
+
+// loadTranscoder compiles the route's descriptor set, if one was uploaded
+func (r *Registery) loadTranscoder(path string, descriptors []byte) *transcoder {
+	if len(descriptors) == 0 {
+		return nil
+	}
+
+	t, err := newTranscoder(descriptors)
+	if err != nil {
+		r.log.Error("invalid descriptor set, transcoding disabled", "path", path, "error", err)
+		return nil
+	}
+	return t
+}
+
+func (r *Registery) reload(ctx context.Context) {
+	if err := r.Reload(ctx); err != nil {
+		r.log.Error("failed to reload route table", "error", err)
+	}
+}
+
+// publishChange notifies every gateway replica that the registry changed
+func (r *Registery) publishChange(ctx context.Context, eventType, path string) {
+	event, _ := json.Marshal(types.RegistryEvent{
+		Type: eventType,
+		Path: path,
+		At:   time.Now(),
+	})
+
+	if err := r.storage.Publish(ctx, RegistryEventsChannel, event).Err(); err != nil {
+		r.log.Error("failed to publish registry event", "error", err)
+	}
+}
+
+// healthChanged reports whether healthy differs from what the route table holds
+func (r *Registery) healthChanged(path, serviceName string, healthy bool) bool {
+	snapshot := r.snapshot.Load()
+	if snapshot == nil {
+		return true
+	}
+
+	for _, service := range snapshot.services[path] {
+		if service.Name == serviceName {
+			return service.Healthy != healthy
+		}
+	}
+	return true
+}
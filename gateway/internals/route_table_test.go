@@ -0,0 +1,155 @@
+package internals
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+func addTestService(t *testing.T, r *Registery, path, name string, healthy bool) {
+	t.Helper()
+	target, _ := url.Parse("http://" + name + ":8080")
+	if err := r.AddService(context.Background(), path, &types.Service{Name: name, URL: target, Healthy: healthy}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func serviceNamesOf(services []*types.Service) []string {
+	names := make([]string, len(services))
+	for i, service := range services {
+		names[i] = service.Name
+	}
+	return names
+}
+
+func TestReloadServesFromSnapshot(t *testing.T) {
+	ctx := context.Background()
+	client, mr := newTestRedis(t)
+	r := NewRegistery(client, newTestLogger(), NewLoadTracker())
+	addTestService(t, r, "/api", "b", true)
+	addTestService(t, r, "/api", "a", false)
+
+	if err := r.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Served from memory until the next reload
+	mr.Del("registry:path:/api:service:a")
+
+	services, err := r.GetServices(ctx, "/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := serviceNamesOf(services); len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		t.Errorf("GetServices() = %v, want [a b]", names)
+	}
+	if services[0].Healthy || !services[1].Healthy {
+		t.Errorf("health = %v, %v, want false, true", services[0].Healthy, services[1].Healthy)
+	}
+
+	paths, _ := r.ListAllPaths(ctx)
+	if len(paths) != 1 || paths[0] != "/api" {
+		t.Errorf("ListAllPaths() = %v, want [/api]", paths)
+	}
+	if config, _ := r.GetRouteConfig(ctx, "/unknown"); config.Path != "/unknown" {
+		t.Errorf("GetRouteConfig() path = %q, want /unknown", config.Path)
+	}
+
+	if err := r.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	services, _ = r.GetServices(ctx, "/api")
+	if names := serviceNamesOf(services); len(names) != 1 || names[0] != "b" {
+		t.Errorf("GetServices() after reload = %v, want [b]", names)
+	}
+}
+
+func TestWatchReloadsOnRegistryEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, _ := newTestRedis(t)
+	r := NewRegistery(client, newTestLogger(), NewLoadTracker())
+	if err := r.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		r.Watch(ctx)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	addTestService(t, r, "/api", "a", true)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		services, _ := r.GetServices(ctx, "/api")
+		if len(services) == 1 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("route table not reloaded after a registry event")
+		}
+		// The watcher may not have subscribed before the first event
+		r.publishChange(ctx, "service_added", "/api")
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestUpdateServiceHealthPublishesChanges(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestRedis(t)
+	r := NewRegistery(client, newTestLogger(), NewLoadTracker())
+	addTestService(t, r, "/api", "a", true)
+	if err := r.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	sub := client.Subscribe(ctx, RegistryEventsChannel)
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+	events := sub.Channel()
+
+	tests := []struct {
+		name      string
+		healthy   bool
+		wantEvent bool
+	}{
+		{"unchanged", true, false},
+		{"changed", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := r.UpdateServiceHealth(ctx, "/api", "a", tt.healthy, time.Now()); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case msg := <-events:
+				if !tt.wantEvent {
+					t.Fatalf("unexpected event %s", msg.Payload)
+				}
+				var event types.RegistryEvent
+				if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil || event.Type != "health_updated" || event.Path != "/api" {
+					t.Errorf("event = %s, want a health_updated event for /api", msg.Payload)
+				}
+			case <-time.After(200 * time.Millisecond):
+				if tt.wantEvent {
+					t.Error("no event for a health change")
+				}
+			}
+		})
+	}
+
+	if err := r.UpdateServiceHealth(ctx, "/api", "missing", true, time.Now()); err != ErrServiceNotFound {
+		t.Errorf("UpdateServiceHealth() error = %v, want %v", err, ErrServiceNotFound)
+	}
+}
@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/chann44/ikyk/pkg/logger"
+	"github.com/chann44/ikyk/pkg/types"
 )
 
 func SetupGateway(log *logger.Logger) http.Handler {
@@ -31,20 +33,45 @@ func SetupGateway(log *logger.Logger) http.Handler {
 	// Initialize Redis client
 	redisClient, err := NewRedisClient(redisAddr, RegistryPassowrd, RegistryDB)
 	if err != nil {
-		log.Error("failed to create redis client: %v", err)
+		log.Error("failed to create redis client", "error", err)
 		panic(fmt.Sprintf("Cannot start without Redis connection: %v", err))
 	}
 
 	// Initialize components
-	registry := NewRegistery(redisClient, log)
+	loads := NewLoadTracker()
+	registry := NewRegistery(redisClient, log, loads)
+
+	// Load the in-memory route table and keep it in sync with Redis
+	if err := registry.Reload(context.Background()); err != nil {
+		log.Error("failed to load route table, reading routes from redis", "error", err)
+	}
+	go registry.Watch(context.Background())
 	metrics := NewMetricsCollector()
 
-	cache := NewCacheManager(redisClient, log, 5*time.Minute)
-	circuitBreaker := NewCircuitBreaker(redisClient, log, 5, 2, 60*time.Second)
+	// CACHE_LRU_BYTES enables an in-process tier in front of Redis;
+	// CACHE_COMPRESS gzips the bodies stored in Redis
+	localCacheBytes, _ := strconv.ParseInt(os.Getenv("CACHE_LRU_BYTES"), 10, 64)
+	compressCache, _ := strconv.ParseBool(os.Getenv("CACHE_COMPRESS"))
+	cache := NewCacheManager(redisClient, log, metrics, 5*time.Minute, localCacheBytes, compressCache)
+	go cache.Watch(context.Background())
+	circuitBreaker := NewCircuitBreaker(redisClient, log, registry, metrics, types.CircuitBreakerConfig{
+		SuccessThreshold:          2,
+		PermittedHalfOpenCalls:    1,
+		Timeout:                   60 * time.Second,
+		WindowType:                "count",
+		WindowSize:                100,
+		MinimumCalls:              10,
+		FailureRateThreshold:      50,
+		SlowCallDurationThreshold: 60 * time.Second,
+		SlowCallRateThreshold:     100,
+	})
+	go circuitBreaker.Watch(context.Background())
 	authManager := NewAuthManager(redisClient, log)
 	rateLimiter := NewRateLimiter(redisClient, log, 100, 10)
 
-	gateway := NewGateway(log, registry, metrics, cache, circuitBreaker)
+	affinity := NewSessionAffinity(os.Getenv("AFFINITY_SECRET"), log)
+
+	gateway := NewGateway(log, registry, metrics, cache, circuitBreaker, loads, affinity)
 
 	// Start health checker
 	healthChecker := NewHealthChecker(registry, log)
@@ -61,16 +88,16 @@ func SetupGateway(log *logger.Logger) http.Handler {
 
 	// Proxy all other requests through middleware chain:
 	// Metrics -> Rate Limit -> Auth -> Proxy
-	r.HandleFunc("/*", func(w http.ResponseWriter, r *http.Request) {
-		handler := http.HandlerFunc(gateway.ProxyHandler)
+	var handler http.Handler = http.HandlerFunc(gateway.ProxyHandler)
 
-		// Apply middleware in reverse order
-		handler = authManager.Middleware(handler).(http.HandlerFunc)
-		handler = rateLimiter.Middleware(handler).(http.HandlerFunc)
-		handler = metrics.Middleware(handler).(http.HandlerFunc)
+	// Apply middleware in reverse order
+	handler = authManager.Middleware(handler)
+	handler = rateLimiter.Middleware(handler)
+	handler = metrics.Middleware(handler)
 
-		handler.ServeHTTP(w, r)
-	})
+	// Aggregate routes send their calls through the same chain
+	gateway.SetHandler(handler)
+	r.Handle("/*", handler)
 
 	return r
 }
@@ -16,6 +16,8 @@ type ServerConfig struct {
 	Name        string
 	Port        string
 	Environment string
+	TLSCertFile string // Serve HTTPS (HTTP/1.1 and HTTP/2) when set with TLSKeyFile
+	TLSKeyFile  string
 }
 
 type GatewaySetupFunc func(log *logger.Logger) http.Handler
@@ -30,14 +32,27 @@ func StartServer(config ServerConfig, setupRouter GatewaySetupFunc) {
 
 	router := setupRouter(log)
 
+	// HTTP/2 is needed for gRPC; plaintext listeners accept it as h2c
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+
 	server := &http.Server{
-		Addr:    ":" + config.Port,
-		Handler: router,
+		Addr:      ":" + config.Port,
+		Handler:   router,
+		Protocols: protocols,
 	}
 
 	go func() {
 		log.Info(fmt.Sprintf("%s starting on :%s", config.Name, config.Port))
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if config.TLSCertFile != "" && config.TLSKeyFile != "" {
+			err = server.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Error(fmt.Sprintf("Server failed to start: %v", err))
 		}
 	}()
@@ -0,0 +1,87 @@
+package internals
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+// defaultRefreshTimeout bounds background refreshes on routes without a timeout
+const defaultRefreshTimeout = 30 * time.Second
+
+// cacheRefreshKey marks the background requests that refresh stale entries
+type cacheRefreshKey struct{}
+
+// serveFromCache answers r from the cache when the entry is fresh, or stale
+// within its stale-while-revalidate window, in which case it is refreshed in
+// the background
+func (g *Gateway) serveFromCache(w http.ResponseWriter, r *http.Request, route *RouteMatch, cached *types.CachedResponse, fresh bool) bool {
+	if cached == nil {
+		return false
+	}
+
+	if fresh {
+		g.metrics.RecordCacheHit(route.Path)
+		g.serveCachedResponse(w, r, route, cached, "HIT")
+		return true
+	}
+
+	// Clients asking for a validated response don't get stale ones
+	if !staleWithin(cached, cached.StaleWhileRevalidate) || parseCacheControl(r.Header).has("no-cache") {
+		return false
+	}
+
+	g.metrics.RecordCacheHit(route.Path)
+	g.serveCachedResponse(w, r, route, cached, "STALE")
+	g.refreshCache(r, route)
+	return true
+}
+
+// serveStale stands in for a failed upstream with a stale entry still
+// within its stale-if-error window
+func (g *Gateway) serveStale(w http.ResponseWriter, r *http.Request, route *RouteMatch, stale *types.CachedResponse) bool {
+	if stale == nil || !staleWithin(stale, stale.StaleIfError) {
+		return false
+	}
+
+	g.log.Warn("serving stale response", "path", r.URL.Path, "age", cachedAge(stale).String())
+	g.serveCachedResponse(w, r, route, stale, "STALE")
+	return true
+}
+
+// refreshCache fetches r again in the background, detached from the client,
+// so the next requests find a fresh entry
+func (g *Gateway) refreshCache(r *http.Request, route *RouteMatch) {
+	timeout := route.Config.Timeout
+	if timeout == 0 {
+		timeout = defaultRefreshTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithValue(context.WithoutCancel(r.Context()), cacheRefreshKey{}, true), timeout)
+	req := r.Clone(ctx)
+	req.Body = http.NoBody
+
+	go func() {
+		defer cancel()
+		g.refresh(req)
+	}()
+}
+
+// refresh runs a background refresh. Nothing above it recovers, so a panic
+// is logged here instead of taking the gateway down; the coalescing lock
+// ProxyHandler took is released by its deferred release as the panic unwinds.
+func (g *Gateway) refresh(req *http.Request) {
+	defer func() {
+		if p := recover(); p != nil {
+			g.log.Error("cache refresh panicked", "path", req.URL.Path, "panic", p)
+		}
+	}()
+	g.ProxyHandler(newBufferedResponse(), req)
+}
+
+// staleWithin reports whether cached expired less than window ago
+func staleWithin(cached *types.CachedResponse, window time.Duration) bool {
+	return cached != nil && window > 0 && time.Now().Before(cached.Expires.Add(window))
+}
@@ -0,0 +1,123 @@
+package internals
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+func TestStaleWithin(t *testing.T) {
+	expired := &types.CachedResponse{Expires: time.Now().Add(-time.Minute)}
+
+	tests := []struct {
+		name   string
+		cached *types.CachedResponse
+		window time.Duration
+		want   bool
+	}{
+		{"no entry", nil, time.Hour, false},
+		{"no window", expired, 0, false},
+		{"within window", expired, time.Hour, true},
+		{"past window", expired, 30 * time.Second, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := staleWithin(tt.cached, tt.window); got != tt.want {
+				t.Errorf("staleWithin() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeStaleWithoutEntry(t *testing.T) {
+	g, _ := newTestGateway(t, "http://127.0.0.1:1", true, &types.RouteConfig{})
+	r := httptest.NewRequest(http.MethodGet, "/api/items", nil)
+	w := httptest.NewRecorder()
+
+	if g.serveStale(w, r, &RouteMatch{}, nil) {
+		t.Fatal("serveStale() = true without a cached entry")
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("serveStale() wrote %q", w.Body.String())
+	}
+}
+
+// Failures on requests without a cached entry must surface as gateway errors
+// and still reach the circuit breaker
+func TestProxyHandlerFailuresWithoutStaleEntry(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+
+	cached := &types.CacheConfig{Enabled: true}
+
+	tests := []struct {
+		name         string
+		upstream     string
+		healthy      bool
+		method       string
+		config       *types.RouteConfig
+		forceOpen    bool
+		wantStatus   int
+		wantFailures string
+	}{
+		{"no healthy service", failing.URL, false, http.MethodGet, &types.RouteConfig{Cache: cached}, false, http.StatusServiceUnavailable, ""},
+		{"breaker open", failing.URL, true, http.MethodGet, &types.RouteConfig{Cache: cached}, true, http.StatusServiceUnavailable, ""},
+		{"upstream 5xx on a write", failing.URL, true, http.MethodPost, &types.RouteConfig{}, false, http.StatusInternalServerError, "1"},
+		{"upstream 5xx on a cache miss", failing.URL, true, http.MethodGet, &types.RouteConfig{Cache: cached}, false, http.StatusInternalServerError, "1"},
+		{"upstream down", "http://127.0.0.1:1", true, http.MethodGet, &types.RouteConfig{}, false, http.StatusBadGateway, "1"},
+		{"upstream timeout", slow.URL, true, http.MethodGet, &types.RouteConfig{Timeout: 50 * time.Millisecond}, false, http.StatusGatewayTimeout, "1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, mr := newTestGateway(t, tt.upstream, tt.healthy, tt.config)
+			if tt.forceOpen {
+				mr.HSet("circuit:svc:breaker", "state", string(StateForcedOpen))
+			}
+
+			w := httptest.NewRecorder()
+			g.ProxyHandler(w, httptest.NewRequest(tt.method, "/api/items", nil))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantFailures != "" && mr.HGet("circuit:svc:calls:totals", "failures") != tt.wantFailures {
+				t.Errorf("breaker failures = %q, want %q", mr.HGet("circuit:svc:calls:totals", "failures"), tt.wantFailures)
+			}
+		})
+	}
+}
+
+func TestRefreshRecoversAndReleasesLock(t *testing.T) {
+	g, mr := newTestGateway(t, "http://127.0.0.1:1", true, &types.RouteConfig{Cache: &types.CacheConfig{Enabled: true}})
+	g.circuitBreaker = nil // Panics once the refresh has taken the coalescing lock
+
+	r := httptest.NewRequest(http.MethodGet, "/api/items", nil)
+	r = r.WithContext(context.WithValue(r.Context(), cacheRefreshKey{}, true))
+	g.refresh(r)
+
+	for _, key := range mr.Keys() {
+		if strings.HasPrefix(key, "cache:lock:") {
+			t.Errorf("lock %s still held after a panicking refresh", key)
+		}
+	}
+	if len(g.cache.flights) != 0 {
+		t.Errorf("%d coalesced fetches still in flight", len(g.cache.flights))
+	}
+}
@@ -0,0 +1,53 @@
+package internals
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// isStreamingResponse reports whether resp is an open-ended stream (SSE or
+// NDJSON) that has to be relayed as it arrives rather than buffered
+func isStreamingResponse(resp *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "text/event-stream", "application/x-ndjson":
+		return true
+	}
+	return false
+}
+
+// idleTimeoutBody aborts a streamed body through abort once the upstream has
+// sent nothing for the idle timeout
+type idleTimeoutBody struct {
+	io.ReadCloser
+	idle  time.Duration
+	timer *time.Timer
+	once  sync.Once
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, idle time.Duration, abort func()) *idleTimeoutBody {
+	return &idleTimeoutBody{
+		ReadCloser: body,
+		idle:       idle,
+		timer:      time.AfterFunc(idle, abort),
+	}
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.idle)
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.once.Do(func() { b.timer.Stop() })
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,129 @@
+package internals
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+func TestIsStreamingResponse(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"text/event-stream", true},
+		{"text/event-stream; charset=utf-8", true},
+		{"application/x-ndjson", true},
+		{"application/json", false},
+		{"text/html", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{"Content-Type": {tt.contentType}}}
+			if got := isStreamingResponse(resp); got != tt.want {
+				t.Errorf("isStreamingResponse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// sseUpstream sends events with gap between them, then holds the stream open
+// when hold is set
+func sseUpstream(events int, gap time.Duration, hold bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < events; i++ {
+			if i > 0 {
+				time.Sleep(gap)
+			}
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+		if hold {
+			<-r.Context().Done()
+		}
+	}))
+}
+
+func TestStreamingOutlivesRouteTimeout(t *testing.T) {
+	tests := []struct {
+		name      string
+		streaming *types.StreamingConfig
+	}{
+		{"streaming route", &types.StreamingConfig{Enabled: true}},
+		{"detected stream", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := sseUpstream(4, 200*time.Millisecond, false)
+			defer upstream.Close()
+			g, mr := newTestGateway(t, upstream.URL, true, &types.RouteConfig{Timeout: 300 * time.Millisecond, Streaming: tt.streaming})
+			gateway := httptest.NewServer(http.HandlerFunc(g.ProxyHandler))
+			defer gateway.Close()
+
+			start := time.Now()
+			resp, err := http.Get(gateway.URL + "/api/events")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			reader := bufio.NewReader(resp.Body)
+			first, err := reader.ReadString('\n')
+			if err != nil || first != "data: 0\n" {
+				t.Fatalf("first event = %q, %v", first, err)
+			}
+			if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+				t.Errorf("first event took %v, want it flushed before the next one", elapsed)
+			}
+
+			var rest strings.Builder
+			reader.WriteTo(&rest)
+			if !strings.Contains(rest.String(), "data: 3") {
+				t.Errorf("stream cut short: %q", rest.String())
+			}
+			if keys := mr.Keys(); strings.Contains(strings.Join(keys, " "), "cache:") {
+				t.Errorf("stream cached: %v", keys)
+			}
+		})
+	}
+}
+
+func TestStreamingIdleTimeout(t *testing.T) {
+	upstream := sseUpstream(1, 0, true)
+	defer upstream.Close()
+	config := &types.RouteConfig{Streaming: &types.StreamingConfig{Enabled: true, IdleTimeout: 100 * time.Millisecond}}
+	g, _ := newTestGateway(t, upstream.URL, true, config)
+	gateway := httptest.NewServer(http.HandlerFunc(g.ProxyHandler))
+	defer gateway.Close()
+
+	resp, err := http.Get(gateway.URL + "/api/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	done := make(chan string)
+	go func() {
+		var body strings.Builder
+		bufio.NewReader(resp.Body).WriteTo(&body)
+		done <- body.String()
+	}()
+
+	select {
+	case body := <-done:
+		if !strings.Contains(body, "data: 0") {
+			t.Errorf("body = %q, want the event sent before going idle", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle stream not closed")
+	}
+}
@@ -0,0 +1,630 @@
+package internals
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chann44/ikyk/pkg/types"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// maxTranscodeBody bounds JSON request bodies and gRPC responses held in memory
+const maxTranscodeBody = 4 << 20
+
+var (
+	errUnknownField = errors.New("unknown field")
+	errBodyTooLarge = fmt.Errorf("body exceeds %d bytes", maxTranscodeBody)
+)
+
+// transcoder maps REST/JSON calls onto the unary gRPC methods of a route's
+// FileDescriptorSet, using their google.api.http annotations
+type transcoder struct {
+	bindings []*httpBinding
+}
+
+// httpBinding is one HttpRule (or additional binding) of a method
+type httpBinding struct {
+	method       protoreflect.MethodDescriptor
+	httpMethod   string
+	path         *regexp.Regexp
+	fields       []string // Field path bound by each capture group of path
+	body         string
+	responseBody string
+}
+
+// newTranscoder compiles the annotated methods of a serialized
+// FileDescriptorSet. Streaming methods are not transcoded.
+func newTranscoder(descriptorSet []byte) (*transcoder, error) {
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(descriptorSet, &set); err != nil {
+		return nil, fmt.Errorf("invalid descriptor set: %w", err)
+	}
+
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set: %w", err)
+	}
+
+	t := &transcoder{}
+	files.RangeFiles(func(file protoreflect.FileDescriptor) bool {
+		services := file.Services()
+		for i := 0; i < services.Len(); i++ {
+			methods := services.Get(i).Methods()
+			for j := 0; j < methods.Len(); j++ {
+				method := methods.Get(j)
+				if method.IsStreamingClient() || method.IsStreamingServer() {
+					continue
+				}
+
+				rule, ok := proto.GetExtension(method.Options(), annotations.E_Http).(*annotations.HttpRule)
+				if !ok || rule == nil {
+					continue
+				}
+
+				for _, r := range append([]*annotations.HttpRule{rule}, rule.GetAdditionalBindings()...) {
+					binding, bindErr := newHTTPBinding(method, r)
+					if bindErr != nil {
+						err = fmt.Errorf("%s: %w", method.FullName(), bindErr)
+						return false
+					}
+					if binding != nil {
+						t.bindings = append(t.bindings, binding)
+					}
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func newHTTPBinding(method protoreflect.MethodDescriptor, rule *annotations.HttpRule) (*httpBinding, error) {
+	var httpMethod, template string
+	switch pattern := rule.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		httpMethod, template = http.MethodGet, pattern.Get
+	case *annotations.HttpRule_Put:
+		httpMethod, template = http.MethodPut, pattern.Put
+	case *annotations.HttpRule_Post:
+		httpMethod, template = http.MethodPost, pattern.Post
+	case *annotations.HttpRule_Delete:
+		httpMethod, template = http.MethodDelete, pattern.Delete
+	case *annotations.HttpRule_Patch:
+		httpMethod, template = http.MethodPatch, pattern.Patch
+	case *annotations.HttpRule_Custom:
+		httpMethod, template = strings.ToUpper(pattern.Custom.GetKind()), pattern.Custom.GetPath()
+	default:
+		return nil, nil
+	}
+
+	path, fields, err := compileHTTPTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+
+	return &httpBinding{
+		method:       method,
+		httpMethod:   httpMethod,
+		path:         path,
+		fields:       fields,
+		body:         rule.GetBody(),
+		responseBody: rule.GetResponseBody(),
+	}, nil
+}
+
+// compileHTTPTemplate turns an HttpRule path template such as
+// "/v1/{name=accounts/*}/transactions:batchGet" into a regexp, returning the
+// field path bound by each capture group
+func compileHTTPTemplate(template string) (*regexp.Regexp, []string, error) {
+	if !strings.HasPrefix(template, "/") {
+		return nil, nil, fmt.Errorf("http template %q must start with /", template)
+	}
+
+	path, verb := template, ""
+	if i := strings.LastIndex(template, ":"); i > strings.LastIndex(template, "/") && i > strings.LastIndex(template, "}") {
+		path, verb = template[:i], template[i:]
+	}
+
+	var pattern strings.Builder
+	var fields []string
+	pattern.WriteString("^")
+	for path != "" {
+		if path[0] == '{' {
+			end := strings.IndexByte(path, '}')
+			if end < 0 {
+				return nil, nil, fmt.Errorf("http template %q has an unterminated variable", template)
+			}
+			field, segments, ok := strings.Cut(path[1:end], "=")
+			if !ok {
+				segments = "*"
+			}
+			fields = append(fields, field)
+			pattern.WriteString("(" + templateSegments(segments) + ")")
+			path = path[end+1:]
+			continue
+		}
+
+		end := strings.IndexByte(path, '{')
+		if end < 0 {
+			end = len(path)
+		}
+		pattern.WriteString(templateSegments(path[:end]))
+		path = path[end:]
+	}
+	pattern.WriteString(regexp.QuoteMeta(verb) + "$")
+
+	compiled, err := regexp.Compile(pattern.String())
+	if err != nil {
+		return nil, nil, fmt.Errorf("http template %q: %w", template, err)
+	}
+	return compiled, fields, nil
+}
+
+func templateSegments(segments string) string {
+	parts := strings.Split(segments, "/")
+	for i, part := range parts {
+		switch part {
+		case "*":
+			parts[i] = "[^/]+"
+		case "**":
+			parts[i] = ".+"
+		default:
+			parts[i] = regexp.QuoteMeta(part)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// match finds the binding for r and the path variables it captured
+func (t *transcoder) match(r *http.Request) (*httpBinding, map[string]string, bool) {
+	for _, binding := range t.bindings {
+		if binding.httpMethod != r.Method {
+			continue
+		}
+		groups := binding.path.FindStringSubmatch(r.URL.Path)
+		if groups == nil {
+			continue
+		}
+
+		vars := make(map[string]string, len(binding.fields))
+		for i, field := range binding.fields {
+			vars[field] = groups[i+1]
+		}
+		return binding, vars, true
+	}
+	return nil, nil, false
+}
+
+// fullMethod is the gRPC path of the binding's method, /package.Service/Method
+func (b *httpBinding) fullMethod() string {
+	return "/" + string(b.method.Parent().FullName()) + "/" + string(b.method.Name())
+}
+
+// requestMessage builds the gRPC request from the JSON body, the path
+// variables and, unless the whole body is bound, the query string
+func (b *httpBinding) requestMessage(r *http.Request, vars map[string]string) (proto.Message, error) {
+	msg := dynamicpb.NewMessage(b.method.Input())
+
+	if b.body != "" {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxTranscodeBody+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(body) > maxTranscodeBody {
+			return nil, errBodyTooLarge
+		}
+
+		if len(bytes.TrimSpace(body)) > 0 {
+			if b.body == "*" {
+				if err := protojson.Unmarshal(body, msg); err != nil {
+					return nil, err
+				}
+			} else if err := setJSONField(msg, b.body, body); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for field, value := range vars {
+		if err := setField(msg, field, []string{value}); err != nil {
+			return nil, fmt.Errorf("path parameter %s: %w", field, err)
+		}
+	}
+
+	if b.body != "*" {
+		for name, values := range r.URL.Query() {
+			if _, bound := vars[name]; bound || name == b.body {
+				continue
+			}
+			// Parameters that are not request fields (e.g. api_key) are ignored
+			if err := setField(msg, name, values); err != nil && !errors.Is(err, errUnknownField) {
+				return nil, fmt.Errorf("query parameter %s: %w", name, err)
+			}
+		}
+	}
+
+	return msg, nil
+}
+
+// responseJSON renders the gRPC response, or its response_body field, as JSON
+func (b *httpBinding) responseJSON(payload []byte) ([]byte, error) {
+	msg := dynamicpb.NewMessage(b.method.Output())
+	if err := proto.Unmarshal(payload, msg); err != nil {
+		return nil, err
+	}
+
+	data, err := protojson.Marshal(msg)
+	if err != nil || b.responseBody == "" {
+		return data, err
+	}
+
+	fd := lookupField(msg.Descriptor(), b.responseBody)
+	if fd == nil {
+		return nil, fmt.Errorf("response_body %s: %w", b.responseBody, errUnknownField)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	if value, ok := fields[fd.JSONName()]; ok {
+		return value, nil
+	}
+	return []byte("null"), nil
+}
+
+// setJSONField decodes value as the JSON of the named top-level field
+func setJSONField(msg *dynamicpb.Message, name string, value []byte) error {
+	fd := lookupField(msg.Descriptor(), name)
+	if fd == nil {
+		return fmt.Errorf("body %s: %w", name, errUnknownField)
+	}
+
+	wrapped, err := json.Marshal(map[string]json.RawMessage{fd.JSONName(): value})
+	if err != nil {
+		return err
+	}
+
+	field := dynamicpb.NewMessage(msg.Descriptor())
+	if err := protojson.Unmarshal(wrapped, field); err != nil {
+		return err
+	}
+	proto.Merge(msg, field)
+	return nil
+}
+
+// setField sets a dotted field path such as "account.id" from string values
+func setField(msg protoreflect.Message, path string, values []string) error {
+	names := strings.Split(path, ".")
+	for _, name := range names[:len(names)-1] {
+		fd := lookupField(msg.Descriptor(), name)
+		if fd == nil {
+			return errUnknownField
+		}
+		if fd.Kind() != protoreflect.MessageKind || fd.IsList() || fd.IsMap() {
+			return fmt.Errorf("%s is not a message", name)
+		}
+		msg = msg.Mutable(fd).Message()
+	}
+
+	fd := lookupField(msg.Descriptor(), names[len(names)-1])
+	if fd == nil {
+		return errUnknownField
+	}
+	if fd.IsMap() {
+		return errors.New("map fields cannot be set from the URL")
+	}
+
+	if fd.IsList() {
+		list := msg.Mutable(fd).List()
+		for _, value := range values {
+			v, err := parseFieldValue(fd, value)
+			if err != nil {
+				return err
+			}
+			list.Append(v)
+		}
+		return nil
+	}
+
+	if len(values) == 0 {
+		return nil
+	}
+	if fd.Kind() == protoreflect.MessageKind {
+		// Well-known types such as Timestamp and wrappers have a string JSON form
+		quoted, _ := json.Marshal(values[0])
+		return protojson.Unmarshal(quoted, msg.Mutable(fd).Message().Interface())
+	}
+
+	v, err := parseFieldValue(fd, values[0])
+	if err != nil {
+		return err
+	}
+	msg.Set(fd, v)
+	return nil
+}
+
+func lookupField(md protoreflect.MessageDescriptor, name string) protoreflect.FieldDescriptor {
+	fields := md.Fields()
+	if fd := fields.ByName(protoreflect.Name(name)); fd != nil {
+		return fd
+	}
+	return fields.ByJSONName(name)
+}
+
+func parseFieldValue(fd protoreflect.FieldDescriptor, value string) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(value), nil
+	case protoreflect.BoolKind:
+		v, err := strconv.ParseBool(value)
+		return protoreflect.ValueOfBool(v), err
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		v, err := strconv.ParseInt(value, 10, 32)
+		return protoreflect.ValueOfInt32(int32(v)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		v, err := strconv.ParseInt(value, 10, 64)
+		return protoreflect.ValueOfInt64(v), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		v, err := strconv.ParseUint(value, 10, 32)
+		return protoreflect.ValueOfUint32(uint32(v)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		v, err := strconv.ParseUint(value, 10, 64)
+		return protoreflect.ValueOfUint64(v), err
+	case protoreflect.FloatKind:
+		v, err := strconv.ParseFloat(value, 32)
+		return protoreflect.ValueOfFloat32(float32(v)), err
+	case protoreflect.DoubleKind:
+		v, err := strconv.ParseFloat(value, 64)
+		return protoreflect.ValueOfFloat64(v), err
+	case protoreflect.BytesKind:
+		v, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			v, err = base64.URLEncoding.DecodeString(value)
+		}
+		return protoreflect.ValueOfBytes(v), err
+	case protoreflect.EnumKind:
+		if enum := fd.Enum().Values().ByName(protoreflect.Name(value)); enum != nil {
+			return protoreflect.ValueOfEnum(enum.Number()), nil
+		}
+		v, err := strconv.ParseInt(value, 10, 32)
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(v)), err
+	}
+	return protoreflect.Value{}, fmt.Errorf("unsupported field type %s", fd.Kind())
+}
+
+// transcode serves a REST/JSON request by calling binding's gRPC method on service
+func (g *Gateway) transcode(w http.ResponseWriter, r *http.Request, route *RouteMatch, binding *httpBinding, vars map[string]string, service *types.Service) {
+	start := time.Now()
+	method := strings.TrimPrefix(binding.fullMethod(), "/")
+	transformResponseHeaders(w.Header(), r, route)
+
+	msg, err := binding.requestMessage(r, vars)
+	if errors.Is(err, errBodyTooLarge) {
+		g.circuitBreaker.Release(service.Name)
+		writeTranscodeStatus(w, http.StatusRequestEntityTooLarge, grpcResourceExhausted, "request "+err.Error())
+		return
+	}
+	if err != nil {
+		g.circuitBreaker.Release(service.Name)
+		writeTranscodeError(w, 3, err.Error()) // INVALID_ARGUMENT
+		return
+	}
+
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		g.circuitBreaker.Release(service.Name)
+		writeTranscodeError(w, grpcInternal, err.Error())
+		return
+	}
+
+	ctx := r.Context()
+	if route.Config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, route.Config.Timeout)
+		defer cancel()
+	}
+
+	// Length-prefixed message: compression flag, big-endian size, payload
+	frame := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(payload)))
+	copy(frame[5:], payload)
+
+	target := *service.URL
+	target.Path = binding.fullMethod()
+	target.RawPath = ""
+	target.RawQuery = ""
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.String(), bytes.NewReader(frame))
+	if err != nil {
+		g.circuitBreaker.Release(service.Name)
+		writeTranscodeError(w, grpcInternal, err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Proto", requestScheme(r))
+	req.Header.Set("X-Forwarded-For", r.RemoteAddr)
+	if route.Config.Timeout > 0 {
+		req.Header.Set("Grpc-Timeout", strconv.FormatInt(route.Config.Timeout.Milliseconds(), 10)+"m")
+	}
+	for name, values := range r.Header {
+		switch {
+		case name == "Authorization", name == "X-Request-Id":
+			req.Header[name] = values
+		case strings.HasPrefix(name, "Grpc-Metadata-"):
+			req.Header[strings.TrimPrefix(name, "Grpc-Metadata-")] = values
+		}
+	}
+	transformRequestHeaders(req.Header, r, route)
+
+	g.log.Info("transcoding request", "service", service.Name, "path", r.URL.Path, "method", method)
+
+	g.loads.Begin(service.Name)
+	resp, err := grpcTransport.RoundTrip(req)
+	if err != nil {
+		g.loads.End(service.Name, time.Since(start))
+		if errors.Is(err, context.Canceled) {
+			// The client went away; the service's health is unknown
+			g.circuitBreaker.Release(service.Name)
+			w.WriteHeader(statusClientClosedRequest)
+			return
+		}
+		code := grpcUnavailable
+		if errors.Is(err, context.DeadlineExceeded) {
+			code = grpcDeadlineExceeded
+		}
+		g.log.Error("transcoding error", "service", service.Name, "method", method, "error", err)
+		g.metrics.RecordError(service.Name, "proxy_error")
+		g.metrics.RecordGRPCRequest(service.Name, method, code, time.Since(start))
+		g.circuitBreaker.RecordFailure(service.Name, time.Since(start))
+		writeTranscodeError(w, code, "upstream unavailable")
+		return
+	}
+	defer resp.Body.Close()
+
+	// One byte over the largest message tells a full response from a cut one
+	body, readErr := io.ReadAll(io.LimitReader(resp.Body, maxTranscodeBody+5+1))
+	g.loads.End(service.Name, time.Since(start))
+
+	// The service answered, but the response can't be held: its status is
+	// in trailers that were never read, so the call says nothing about it
+	if len(body) > maxTranscodeBody+5 {
+		g.log.Error("transcoded response too large", "service", service.Name, "method", method, "max", maxTranscodeBody)
+		g.metrics.RecordError(service.Name, "response_too_large")
+		g.metrics.RecordRequest(service.Name, r.Method, http.StatusBadGateway, time.Since(start))
+		g.circuitBreaker.Release(service.Name)
+		writeTranscodeStatus(w, http.StatusBadGateway, grpcResourceExhausted, "response "+errBodyTooLarge.Error())
+		return
+	}
+
+	code := grpcStatus(resp)
+	message, _ := url.PathUnescape(resp.Trailer.Get("Grpc-Message"))
+	if message == "" {
+		message, _ = url.PathUnescape(resp.Header.Get("Grpc-Message"))
+	}
+	if resp.StatusCode != http.StatusOK {
+		code, message = grpcStatusFromHTTP(resp.StatusCode), resp.Status
+	} else if readErr != nil {
+		code, message = grpcUnavailable, readErr.Error()
+	}
+
+	g.metrics.RecordGRPCRequest(service.Name, method, code, time.Since(start))
+	if grpcFailure(code) {
+		g.circuitBreaker.RecordFailure(service.Name, time.Since(start))
+	} else {
+		g.circuitBreaker.RecordSuccess(service.Name, time.Since(start))
+	}
+
+	if code != 0 {
+		g.metrics.RecordRequest(service.Name, r.Method, httpStatusFromGRPC(code), time.Since(start))
+		writeTranscodeError(w, code, message)
+		return
+	}
+
+	out, err := grpcMessage(body)
+	if err == nil {
+		out, err = binding.responseJSON(out)
+	}
+	if config := route.Config.Body; err == nil && config != nil && config.Response != nil {
+		if int64(len(out)) <= maxTransformBody(config) {
+			out, err = transformJSON(out, config.Response)
+		} else if hidesFields(config.Response) {
+			err = fmt.Errorf("%w: larger than %d bytes", errBodyNotTransformed, maxTransformBody(config))
+		}
+	}
+	if err != nil {
+		g.log.Error("failed to transcode response", "service", service.Name, "method", method, "error", err)
+		g.metrics.RecordRequest(service.Name, r.Method, http.StatusBadGateway, time.Since(start))
+		writeTranscodeError(w, grpcInternal, "invalid upstream response")
+		return
+	}
+
+	g.metrics.RecordRequest(service.Name, r.Method, http.StatusOK, time.Since(start))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+// grpcMessage returns the payload of the single message in a unary response
+func grpcMessage(body []byte) ([]byte, error) {
+	if len(body) < 5 {
+		return nil, errors.New("missing response message")
+	}
+	if body[0] != 0 {
+		return nil, errors.New("compressed responses are not supported")
+	}
+	size := binary.BigEndian.Uint32(body[1:5])
+	if uint64(len(body)-5) < uint64(size) {
+		return nil, errors.New("truncated response message")
+	}
+	return body[5 : 5+size], nil
+}
+
+// writeTranscodeError renders a gRPC status as a JSON error with the matching HTTP status
+func writeTranscodeError(w http.ResponseWriter, code int, message string) {
+	writeTranscodeStatus(w, httpStatusFromGRPC(code), code, message)
+}
+
+// writeTranscodeStatus renders a gRPC status as a JSON error with the given
+// HTTP status, for errors of the gateway's own
+func writeTranscodeStatus(w http.ResponseWriter, status, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":    code,
+		"message": message,
+	})
+}
+
+// httpStatusFromGRPC follows the mapping in google/rpc/code.proto
+func httpStatusFromGRPC(code int) int {
+	switch code {
+	case 0:
+		return http.StatusOK
+	case grpcCancelled:
+		return statusClientClosedRequest
+	case 3, 9, 11: // INVALID_ARGUMENT, FAILED_PRECONDITION, OUT_OF_RANGE
+		return http.StatusBadRequest
+	case grpcDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case 5: // NOT_FOUND
+		return http.StatusNotFound
+	case 6, 10: // ALREADY_EXISTS, ABORTED
+		return http.StatusConflict
+	case 7: // PERMISSION_DENIED
+		return http.StatusForbidden
+	case grpcResourceExhausted:
+		return http.StatusTooManyRequests
+	case 12: // UNIMPLEMENTED
+		return http.StatusNotImplemented
+	case grpcUnavailable:
+		return http.StatusServiceUnavailable
+	case 16: // UNAUTHENTICATED
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
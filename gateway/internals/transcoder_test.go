@@ -0,0 +1,417 @@
+package internals
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/chann44/ikyk/pkg/types"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// testDescriptorSet describes an items.v1.Items service:
+//
+//	GetItem     GET    /v1/items/{id}, also /v1/shelves/{shelf}/items/{id}
+//	CreateItem  POST   /v1/shelves/{shelf}/items, body "item"
+//	UpdateItem  PATCH  /v1/items/{id}, body "*"
+//	ListItems   GET    /v1/{parent=shelves/*}/items:search, response_body "items"
+//	WatchItems  GET    /v1/items:watch, server streaming
+func testDescriptorSet(t *testing.T) []byte {
+	t.Helper()
+
+	field := func(name string, number int32, kind descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		fd := &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(number),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:   kind.Enum(),
+		}
+		if typeName != "" {
+			fd.TypeName = proto.String(typeName)
+		}
+		return fd
+	}
+	message := func(name string, fields ...*descriptorpb.FieldDescriptorProto) *descriptorpb.DescriptorProto {
+		return &descriptorpb.DescriptorProto{Name: proto.String(name), Field: fields}
+	}
+	method := func(name, input, output string, rule *annotations.HttpRule) *descriptorpb.MethodDescriptorProto {
+		options := &descriptorpb.MethodOptions{}
+		proto.SetExtension(options, annotations.E_Http, rule)
+		return &descriptorpb.MethodDescriptorProto{
+			Name:       proto.String(name),
+			InputType:  proto.String(".items.v1." + input),
+			OutputType: proto.String(".items.v1." + output),
+			Options:    options,
+		}
+	}
+
+	items := field("items", 1, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".items.v1.Item")
+	items.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	watch := method("WatchItems", "GetItemRequest", "Item", &annotations.HttpRule{Pattern: &annotations.HttpRule_Get{Get: "/v1/items:watch"}})
+	watch.ServerStreaming = proto.Bool(true)
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("items.proto"),
+		Package: proto.String("items.v1"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			message("Item",
+				field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+				field("title", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+				field("stock_count", 3, descriptorpb.FieldDescriptorProto_TYPE_INT32, "")),
+			message("GetItemRequest",
+				field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+				field("shelf", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64, ""),
+				field("verbose", 3, descriptorpb.FieldDescriptorProto_TYPE_BOOL, "")),
+			message("CreateItemRequest",
+				field("shelf", 1, descriptorpb.FieldDescriptorProto_TYPE_INT64, ""),
+				field("item", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".items.v1.Item")),
+			message("ListItemsRequest",
+				field("parent", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, "")),
+			message("ListItemsResponse", items,
+				field("next_page_token", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING, "")),
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Items"),
+			Method: []*descriptorpb.MethodDescriptorProto{
+				method("GetItem", "GetItemRequest", "Item", &annotations.HttpRule{
+					Pattern: &annotations.HttpRule_Get{Get: "/v1/items/{id}"},
+					AdditionalBindings: []*annotations.HttpRule{
+						{Pattern: &annotations.HttpRule_Get{Get: "/v1/shelves/{shelf}/items/{id}"}},
+					},
+				}),
+				method("CreateItem", "CreateItemRequest", "Item", &annotations.HttpRule{
+					Pattern: &annotations.HttpRule_Post{Post: "/v1/shelves/{shelf}/items"},
+					Body:    "item",
+				}),
+				method("UpdateItem", "Item", "Item", &annotations.HttpRule{
+					Pattern: &annotations.HttpRule_Patch{Patch: "/v1/items/{id}"},
+					Body:    "*",
+				}),
+				method("ListItems", "ListItemsRequest", "ListItemsResponse", &annotations.HttpRule{
+					Pattern:      &annotations.HttpRule_Get{Get: "/v1/{parent=shelves/*}/items:search"},
+					ResponseBody: "items",
+				}),
+				watch,
+			},
+		}},
+	}
+
+	data, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func newTestTranscoder(t *testing.T) *transcoder {
+	t.Helper()
+	tc, err := newTranscoder(testDescriptorSet(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tc
+}
+
+// assertJSON compares JSON documents, ignoring protojson's unstable spacing
+func assertJSON(t *testing.T, got []byte, want string) {
+	t.Helper()
+	var gotValue, wantValue interface{}
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		t.Fatalf("invalid JSON %s: %v", got, err)
+	}
+	json.Unmarshal([]byte(want), &wantValue)
+	if !reflect.DeepEqual(gotValue, wantValue) {
+		t.Errorf("JSON = %s, want %s", got, want)
+	}
+}
+
+func TestCompileHTTPTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		path     string
+		want     map[string]string // nil: no match
+	}{
+		{"/v1/items/{id}", "/v1/items/42", map[string]string{"id": "42"}},
+		{"/v1/items/{id}", "/v1/items/42/parts", nil},
+		{"/v1/items/{id}", "/v1/items/", nil},
+		{"/v1/{name=shelves/*/books/*}", "/v1/shelves/1/books/2", map[string]string{"name": "shelves/1/books/2"}},
+		{"/v1/{name=shelves/*/books/*}", "/v1/shelves/1", nil},
+		{"/v1/{path=files/**}", "/v1/files/a/b/c", map[string]string{"path": "files/a/b/c"}},
+		{"/v1/items:batchGet", "/v1/items:batchGet", map[string]string{}},
+		{"/v1/items:batchGet", "/v1/items", nil},
+		{"/v1/items/{id}:cancel", "/v1/items/7:cancel", map[string]string{"id": "7"}},
+		{"/v1/{item.id}", "/v1/9", map[string]string{"item.id": "9"}},
+		{"/v1.2/items", "/v1x2/items", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.template+" "+tt.path, func(t *testing.T) {
+			pattern, fields, err := compileHTTPTemplate(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			groups := pattern.FindStringSubmatch(tt.path)
+			if tt.want == nil {
+				if groups != nil {
+					t.Errorf("matched %v, want no match", groups)
+				}
+				return
+			}
+			if groups == nil {
+				t.Fatal("no match")
+			}
+			got := make(map[string]string, len(fields))
+			for i, field := range fields {
+				got[field] = groups[i+1]
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("vars = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileHTTPTemplateErrors(t *testing.T) {
+	for _, template := range []string{"v1/items", "/v1/items/{id"} {
+		if _, _, err := compileHTTPTemplate(template); err == nil {
+			t.Errorf("compileHTTPTemplate(%q): want error", template)
+		}
+	}
+}
+
+func TestTranscoderMatch(t *testing.T) {
+	tc := newTestTranscoder(t)
+
+	tests := []struct {
+		method     string
+		path       string
+		wantMethod string // "": no binding
+		wantVars   map[string]string
+	}{
+		{http.MethodGet, "/v1/items/42", "/items.v1.Items/GetItem", map[string]string{"id": "42"}},
+		{http.MethodGet, "/v1/shelves/3/items/42", "/items.v1.Items/GetItem", map[string]string{"shelf": "3", "id": "42"}},
+		{http.MethodPost, "/v1/shelves/3/items", "/items.v1.Items/CreateItem", map[string]string{"shelf": "3"}},
+		{http.MethodPatch, "/v1/items/42", "/items.v1.Items/UpdateItem", map[string]string{"id": "42"}},
+		{http.MethodGet, "/v1/shelves/3/items:search", "/items.v1.Items/ListItems", map[string]string{"parent": "shelves/3"}},
+		{http.MethodDelete, "/v1/items/42", "", nil},
+		{http.MethodGet, "/v1/items:watch", "", nil}, // Streaming methods are not transcoded
+		{http.MethodGet, "/v2/items/42", "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			binding, vars, ok := tc.match(httptest.NewRequest(tt.method, tt.path, nil))
+			if tt.wantMethod == "" {
+				if ok {
+					t.Errorf("bound to %s, want no binding", binding.fullMethod())
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("no binding")
+			}
+			if got := binding.fullMethod(); got != tt.wantMethod {
+				t.Errorf("method = %s, want %s", got, tt.wantMethod)
+			}
+			if !reflect.DeepEqual(vars, tt.wantVars) {
+				t.Errorf("vars = %v, want %v", vars, tt.wantVars)
+			}
+		})
+	}
+}
+
+func TestRequestMessage(t *testing.T) {
+	tc := newTestTranscoder(t)
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{"path and query", http.MethodGet, "/v1/shelves/3/items/42?verbose=true&api_key=x", "", `{"id":"42","shelf":"3","verbose":true}`, false},
+		{"field body", http.MethodPost, "/v1/shelves/3/items?title=ignored", `{"title":"Lamp","stockCount":2}`,
+			`{"shelf":"3","item":{"title":"Lamp","stockCount":2}}`, false},
+		{"whole body", http.MethodPatch, "/v1/items/42?title=ignored", `{"title":"Lamp","stock_count":5}`,
+			`{"id":"42","title":"Lamp","stockCount":5}`, false},
+		{"path wins over body", http.MethodPatch, "/v1/items/42", `{"id":"7"}`, `{"id":"42"}`, false},
+		{"empty body", http.MethodPatch, "/v1/items/42", "", `{"id":"42"}`, false},
+		{"invalid path value", http.MethodGet, "/v1/shelves/x/items/42", "", "", true},
+		{"invalid query value", http.MethodGet, "/v1/items/42?verbose=maybe", "", "", true},
+		{"invalid body", http.MethodPatch, "/v1/items/42", `{"title":`, "", true},
+		{"unknown body field", http.MethodPatch, "/v1/items/42", `{"color":"red"}`, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			binding, vars, ok := tc.match(r)
+			if !ok {
+				t.Fatal("no binding")
+			}
+
+			msg, err := binding.requestMessage(r, vars)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("requestMessage() = %v, want error", msg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := protojson.Marshal(msg)
+			assertJSON(t, got, tt.want)
+		})
+	}
+}
+
+func TestResponseJSON(t *testing.T) {
+	tc := newTestTranscoder(t)
+
+	tests := []struct {
+		target string
+		reply  string
+		want   string
+	}{
+		{"/v1/items/42", `{"id":"42","title":"Lamp"}`, `{"id":"42","title":"Lamp"}`},
+		{"/v1/shelves/3/items:search", `{"items":[{"id":"1"}],"nextPageToken":"n"}`, `[{"id":"1"}]`},
+		{"/v1/shelves/3/items:search", `{}`, `null`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			binding, _, ok := tc.match(httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if !ok {
+				t.Fatal("no binding")
+			}
+
+			reply := dynamicpb.NewMessage(binding.method.Output())
+			if err := protojson.Unmarshal([]byte(tt.reply), reply); err != nil {
+				t.Fatal(err)
+			}
+			payload, _ := proto.Marshal(reply)
+
+			got, err := binding.responseJSON(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertJSON(t, got, tt.want)
+		})
+	}
+}
+
+func TestHTTPStatusFromGRPC(t *testing.T) {
+	tests := []struct {
+		code int
+		want int
+	}{
+		{0, http.StatusOK},
+		{grpcCancelled, statusClientClosedRequest},
+		{2, http.StatusInternalServerError}, // UNKNOWN
+		{3, http.StatusBadRequest},
+		{grpcDeadlineExceeded, http.StatusGatewayTimeout},
+		{5, http.StatusNotFound},
+		{6, http.StatusConflict},
+		{7, http.StatusForbidden},
+		{grpcResourceExhausted, http.StatusTooManyRequests},
+		{9, http.StatusBadRequest},
+		{10, http.StatusConflict},
+		{11, http.StatusBadRequest},
+		{12, http.StatusNotImplemented},
+		{grpcInternal, http.StatusInternalServerError},
+		{grpcUnavailable, http.StatusServiceUnavailable},
+		{15, http.StatusInternalServerError}, // DATA_LOSS
+		{16, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		if got := httpStatusFromGRPC(tt.code); got != tt.want {
+			t.Errorf("httpStatusFromGRPC(%d) = %d, want %d", tt.code, got, tt.want)
+		}
+	}
+}
+
+// grpcFrame length-prefixes a message the way unary calls carry it
+func grpcFrame(payload []byte) []byte {
+	frame := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(payload)))
+	copy(frame[5:], payload)
+	return frame
+}
+
+func TestTranscode(t *testing.T) {
+	huge := make([]byte, maxTranscodeBody+1)
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		reply      []byte
+		grpcStatus string
+		wantStatus int
+		wantCalled bool
+		wantProbes string // Half-open probes left once the call is over; "" when the breaker moved on
+	}{
+		{"ok", http.MethodGet, "/v1/items/42", "", []byte{}, "0", http.StatusOK, true, ""},
+		{"not found", http.MethodGet, "/v1/items/42", "", nil, "5", http.StatusNotFound, true, ""},
+		{"invalid argument", http.MethodGet, "/v1/items/42?verbose=maybe", "", nil, "0", http.StatusBadRequest, false, "0"},
+		{"request too large", http.MethodPatch, "/v1/items/42", `{"title":"` + strings.Repeat("x", maxTranscodeBody) + `"}`, nil, "0", http.StatusRequestEntityTooLarge, false, "0"},
+		{"response too large", http.MethodGet, "/v1/items/42", "", huge, "0", http.StatusBadGateway, true, "0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var called atomic.Bool
+			upstream := newH2CServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called.Store(true)
+				io.Copy(io.Discard, r.Body)
+				w.Header().Set("Content-Type", "application/grpc")
+				w.Header().Set("Trailer", "Grpc-Status")
+				if tt.reply != nil {
+					w.Write(grpcFrame(tt.reply))
+				}
+				w.Header().Set("Grpc-Status", tt.grpcStatus)
+			}))
+			defer upstream.Close()
+
+			g, mr := newTestGatewayAt(t, "/v1", upstream.URL, true, &types.RouteConfig{})
+			mr.Set(redisKey("registry:path", "/v1", "descriptors"), string(testDescriptorSet(t)))
+			if err := g.registry.Reload(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			setBreaker(mr, StateHalfOpen, 0)
+
+			w := httptest.NewRecorder()
+			g.ProxyHandler(w, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if called.Load() != tt.wantCalled {
+				t.Errorf("upstream called = %v, want %v", called.Load(), tt.wantCalled)
+			}
+			if tt.wantProbes != "" {
+				if probes := mr.HGet("circuit:svc:breaker", "probes"); probes != tt.wantProbes {
+					t.Errorf("probes = %q, want %q", probes, tt.wantProbes)
+				}
+			}
+		})
+	}
+}
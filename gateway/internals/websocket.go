@@ -0,0 +1,222 @@
+package internals
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+// isUpgradeRequest reports whether r asks to switch protocols (e.g. WebSocket)
+func isUpgradeRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// connectionLimiter counts long-lived connections per route
+type connectionLimiter struct {
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+func newConnectionLimiter() *connectionLimiter {
+	return &connectionLimiter{conns: make(map[string]int)}
+}
+
+// acquire takes a slot for route, max <= 0 meaning unlimited
+func (cl *connectionLimiter) acquire(route string, max int) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if max > 0 && cl.conns[route] >= max {
+		return false
+	}
+	cl.conns[route]++
+	return true
+}
+
+func (cl *connectionLimiter) release(route string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	cl.conns[route]--
+	if cl.conns[route] <= 0 {
+		delete(cl.conns, route)
+	}
+}
+
+// proxyUpgrade proxies an Upgrade handshake and, once the service switches
+// protocols, the bidirectional stream that follows. Handshakes rejected here
+// never reach the service, so they free their circuit breaker probe slot.
+func (g *Gateway) proxyUpgrade(w http.ResponseWriter, r *http.Request, route *RouteMatch, service *types.Service, targetPath string) {
+	config := route.Config.WebSocket
+	if config == nil || !config.Enabled {
+		g.circuitBreaker.Release(service.Name)
+		http.Error(w, "Upgrade not enabled for this route", http.StatusBadRequest)
+		return
+	}
+
+	if !allowedOrigin(config.AllowedOrigins, r.Header.Get("Origin")) {
+		g.log.Warn("websocket origin rejected", "path", r.URL.Path, "origin", r.Header.Get("Origin"))
+		g.circuitBreaker.Release(service.Name)
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	if !g.upgrades.acquire(route.Path, config.MaxConnections) {
+		g.log.Warn("websocket connection limit reached", "path", route.Path, "max", config.MaxConnections)
+		g.metrics.RecordError(service.Name, "websocket_limit")
+		g.circuitBreaker.Release(service.Name)
+		http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+		return
+	}
+	defer g.upgrades.release(route.Path)
+
+	var upstream *idleConn
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableKeepAlives = true
+	transport.ForceAttemptHTTP2 = false // Upgrades need HTTP/1.1
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		upstream = newIdleConn(conn, config.IdleTimeout, func(n int) {
+			g.metrics.RecordWebSocketBytes(service.Name, "downstream", n)
+		}, func(n int) {
+			g.metrics.RecordWebSocketBytes(service.Name, "upstream", n)
+		})
+		return upstream, nil
+	}
+
+	var opened bool
+	proxy := newReverseProxy(r, route, service, targetPath)
+	proxy.Transport = transport
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// Handshakes don't count towards the slow-call rate
+		if resp.StatusCode >= 500 {
+			g.circuitBreaker.RecordFailure(service.Name, 0)
+		} else {
+			g.circuitBreaker.RecordSuccess(service.Name, 0)
+		}
+		transformResponseHeaders(resp.Header, r, route)
+
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			// The idle clock starts once the stream is open
+			upstream.touch()
+			opened = true
+			g.metrics.WebSocketOpened(service.Name)
+			g.log.Info("websocket connected", "service", service.Name, "path", r.URL.Path)
+		}
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if errors.Is(err, context.Canceled) {
+			g.circuitBreaker.Release(service.Name)
+			w.WriteHeader(statusClientClosedRequest)
+			return
+		}
+		g.log.Error("websocket proxy error", "service", service.Name, "error", err)
+		g.metrics.RecordError(service.Name, "proxy_error")
+		g.circuitBreaker.RecordFailure(service.Name, 0)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+	}
+
+	start := time.Now()
+	proxy.ServeHTTP(w, r)
+
+	if opened {
+		g.metrics.WebSocketClosed(service.Name)
+		g.log.Info("websocket closed", "service", service.Name, "path", r.URL.Path, "duration", time.Since(start).String())
+	}
+}
+
+func allowedOrigin(allowed []string, origin string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, candidate := range allowed {
+		if candidate == "*" || strings.EqualFold(candidate, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// idleConn closes a proxied upgrade once no bytes have moved in either
+// direction for the idle timeout, and reports bytes read and written
+type idleConn struct {
+	net.Conn
+	idle         time.Duration
+	lastActivity atomic.Int64
+	onRead       func(int)
+	onWrite      func(int)
+}
+
+func newIdleConn(conn net.Conn, idle time.Duration, onRead, onWrite func(int)) *idleConn {
+	c := &idleConn{
+		Conn:    conn,
+		idle:    idle,
+		onRead:  onRead,
+		onWrite: onWrite,
+	}
+	c.touch()
+	return c
+}
+
+func (c *idleConn) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (c *idleConn) last() time.Time {
+	return time.Unix(0, c.lastActivity.Load())
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	for {
+		if c.idle > 0 {
+			c.Conn.SetReadDeadline(c.last().Add(c.idle))
+		}
+
+		n, err := c.Conn.Read(p)
+		if n > 0 {
+			c.touch()
+			c.onRead(n)
+		}
+
+		// The deadline fired but the client kept writing; keep waiting
+		var netErr net.Error
+		if err != nil && c.idle > 0 && errors.As(err, &netErr) && netErr.Timeout() && time.Since(c.last()) < c.idle {
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	c.touch()
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.onWrite(n)
+	}
+	return n, err
+}
@@ -0,0 +1,158 @@
+package internals
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chann44/ikyk/pkg/types"
+)
+
+// echoUpgrade switches protocols and echoes everything back
+func echoUpgrade(w http.ResponseWriter, r *http.Request) {
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	buf.Flush()
+	io.Copy(conn, buf.Reader)
+}
+
+func upgradeRequest(origin string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/api/ws", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	return r
+}
+
+func TestIsUpgradeRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		connection string
+		upgrade    string
+		want       bool
+	}{
+		{"upgrade", "Upgrade", "websocket", true},
+		{"token list", "keep-alive, upgrade", "websocket", true},
+		{"no upgrade header", "Upgrade", "", false},
+		{"no connection token", "keep-alive", "websocket", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Connection", tt.connection)
+			if tt.upgrade != "" {
+				r.Header.Set("Upgrade", tt.upgrade)
+			}
+			if got := isUpgradeRequest(r); got != tt.want {
+				t.Errorf("isUpgradeRequest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyUpgradeRejects(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(echoUpgrade))
+	defer upstream.Close()
+
+	tests := []struct {
+		name       string
+		config     *types.WebSocketConfig
+		origin     string
+		held       int
+		wantStatus int
+	}{
+		{"not enabled", nil, "", 0, http.StatusBadRequest},
+		{"origin not allowed", &types.WebSocketConfig{Enabled: true, AllowedOrigins: []string{"https://app.example.com"}}, "https://evil.example.com", 0, http.StatusForbidden},
+		{"connection limit", &types.WebSocketConfig{Enabled: true, MaxConnections: 1}, "", 1, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, mr := newTestGateway(t, upstream.URL, true, &types.RouteConfig{WebSocket: tt.config})
+			for i := 0; i < tt.held; i++ {
+				g.upgrades.acquire("/api", 0)
+			}
+			setBreaker(mr, StateHalfOpen, 0)
+
+			w := httptest.NewRecorder()
+			g.ProxyHandler(w, upgradeRequest(tt.origin))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+
+			// The rejected handshake never reached the service
+			if probes := mr.HGet("circuit:svc:breaker", "probes"); probes != "0" {
+				t.Errorf("probes = %q, want the slot released", probes)
+			}
+		})
+	}
+}
+
+func TestProxyUpgradeStreamsUntilIdle(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(echoUpgrade))
+	defer upstream.Close()
+
+	config := &types.WebSocketConfig{Enabled: true, IdleTimeout: 200 * time.Millisecond, AllowedOrigins: []string{"https://app.example.com"}}
+	g, _ := newTestGateway(t, upstream.URL, true, &types.RouteConfig{WebSocket: config})
+	gateway := httptest.NewServer(http.HandlerFunc(g.ProxyHandler))
+	defer gateway.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(gateway.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprint(conn, "GET /api/ws HTTP/1.1\r\nHost: gateway\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nOrigin: https://app.example.com\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+
+	for _, message := range []string{"ping", "pong"} {
+		conn.Write([]byte(message))
+		echoed := make([]byte, len(message))
+		if _, err := io.ReadFull(reader, echoed); err != nil || string(echoed) != message {
+			t.Fatalf("echo = %q, %v, want %q", echoed, err, message)
+		}
+	}
+
+	start := time.Now()
+	if _, err := reader.ReadByte(); err == nil {
+		t.Fatal("read data from an idle connection")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("idle connection closed after %v, want about 200ms", elapsed)
+	}
+
+	// The slot is released once the handler returns, just after the close
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		g.upgrades.mu.Lock()
+		held := g.upgrades.conns["/api"]
+		g.upgrades.mu.Unlock()
+		if held == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connection slots still held", held)
+		}
+	}
+}
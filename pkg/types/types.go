@@ -1,6 +1,7 @@
 package types
 
 import (
+	"encoding/json"
 	"net/url"
 	"sync"
 	"time"
@@ -22,6 +23,32 @@ type ServiceData struct {
 	Path      string    `json:"path"`
 }
 
+// RegistryEvent is published on the registry events channel whenever
+// services or route policies change
+type RegistryEvent struct {
+	Type    string    `json:"type"` // "service_added", "service_removed", "health_updated", "route_updated", "route_deleted", "circuit_breaker_updated"
+	Path    string    `json:"path"`
+	Service string    `json:"service,omitempty"` // For service-wide changes
+	At      time.Time `json:"at"`
+}
+
+// CircuitEvent is published on the circuit events channel whenever a
+// service's circuit breaker changes state
+type CircuitEvent struct {
+	Service string    `json:"service"`
+	From    string    `json:"from"`
+	To      string    `json:"to"` // "closed", "open", "half-open", "forced-open" or "forced-closed"
+	Reason  string    `json:"reason,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// CacheInvalidation is published when cached responses change or are
+// purged, so gateways drop their in-process copies
+type CacheInvalidation struct {
+	Origin string   `json:"origin,omitempty"` // Gateway that made the change; empty for the management API
+	Keys   []string `json:"keys"`
+}
+
 // AuthConfig stores authentication configuration for a service
 type AuthConfig struct {
 	ServiceName string            `json:"service_name"`
@@ -43,12 +70,29 @@ type HealthConfig struct {
 	UnhealthyCount int           `json:"unhealthy_count"` // Consecutive failures
 }
 
-// CacheConfig defines caching rules
+// CacheConfig defines caching rules for a route. Upstream Cache-Control
+// and Expires headers still take precedence over TTL.
 type CacheConfig struct {
-	Enabled    bool          `json:"enabled"`
-	TTL        time.Duration `json:"ttl"`
-	Methods    []string      `json:"methods"`     // Default: ["GET"]
-	PathPrefix string        `json:"path_prefix"`
+	Enabled     bool            `json:"enabled"`                 // false bypasses the cache for the route
+	TTL         time.Duration   `json:"ttl"`                     // Lifetime when the upstream sets none; default: the gateway's
+	Methods     []string        `json:"methods"`                 // GET and/or HEAD served from the cache. Default: ["GET", "HEAD"]
+	PathPrefix  string          `json:"path_prefix"`             // Only cache request paths under this prefix
+	Key         *CacheKeyConfig `json:"key,omitempty"`           // Extra cache key components
+	MaxBodySize int64           `json:"max_body_size,omitempty"` // Larger responses are not stored; default 8 MiB
+
+	// Defaults for responses without the stale-while-revalidate and
+	// stale-if-error Cache-Control extensions
+	StaleWhileRevalidate time.Duration `json:"stale_while_revalidate,omitempty"` // Serve stale while refreshing in the background
+	StaleIfError         time.Duration `json:"stale_if_error,omitempty"`         // Serve stale when the upstream fails or its breaker is open
+}
+
+// CacheKeyConfig selects what, besides host and path, tells cached
+// responses apart
+type CacheKeyConfig struct {
+	Headers     []string `json:"headers,omitempty"`      // Request headers added to the key
+	Query       []string `json:"query,omitempty"`        // Only these query params are keyed; default all
+	IgnoreQuery []string `json:"ignore_query,omitempty"` // Query params left out of the key, e.g. utm_source
+	Consumer    bool     `json:"consumer,omitempty"`     // One entry per API key consumer; allows caching their authenticated responses
 }
 
 // RateLimitConfig defines rate limiting rules
@@ -59,18 +103,209 @@ type RateLimitConfig struct {
 	Path           string `json:"path"`
 }
 
-// CircuitBreakerConfig defines circuit breaker parameters
+// CircuitBreakerConfig defines circuit breaker parameters, stored per
+// service. Services without one use the gateway's defaults; a stored config
+// with Enabled false turns the breaker off for the service. Unset fields,
+// including Enabled, fall back to the defaults.
+//
+// The breaker records calls in a sliding window of the last WindowSize calls
+// ("count") or seconds ("time") and opens once the window holds MinimumCalls
+// and either the failure rate or the slow-call rate reaches its threshold.
+// After Timeout it turns half-open, letting PermittedHalfOpenCalls probes
+// through at a time; SuccessThreshold successes close it, a failure reopens it.
 type CircuitBreakerConfig struct {
-	Enabled          bool          `json:"enabled"`
-	FailureThreshold int           `json:"failure_threshold"` // Default: 5
-	SuccessThreshold int           `json:"success_threshold"` // Default: 2
-	Timeout          time.Duration `json:"timeout"`           // Default: 60s
+	Enabled                   *bool         `json:"enabled,omitempty"`            // Default: true
+	SuccessThreshold          int           `json:"success_threshold"`            // Successes in half-open before closing. Default: 2
+	PermittedHalfOpenCalls    int           `json:"permitted_half_open_calls"`    // Probes in flight while half-open. Default: 1
+	Timeout                   time.Duration `json:"timeout"`                      // Time spent open. Default: 60s
+	WindowType                string        `json:"window_type"`                  // "count" or "time". Default: "count"
+	WindowSize                int           `json:"window_size"`                  // Calls, or seconds for time windows. Default: 100
+	MinimumCalls              int           `json:"minimum_calls"`                // Default: 10
+	FailureRateThreshold      float64       `json:"failure_rate_threshold"`       // Percent. Default: 50
+	SlowCallDurationThreshold time.Duration `json:"slow_call_duration_threshold"` // Default: 60s
+	SlowCallRateThreshold     float64       `json:"slow_call_rate_threshold"`     // Percent. Default: 100
 }
 
 // CachedResponse stores a cached HTTP response
 type CachedResponse struct {
-	StatusCode int         `json:"status_code"`
+	StatusCode int                 `json:"status_code"`
 	Headers    map[string][]string `json:"headers"`
-	Body       []byte      `json:"body"`
-	CachedAt   time.Time   `json:"cached_at"`
+	Body       []byte              `json:"body"`
+	CachedAt   time.Time           `json:"cached_at"`
+	InitialAge time.Duration       `json:"initial_age,omitempty"` // Age the response already had when it was stored
+	Expires    time.Time           `json:"expires"`               // End of freshness
+	Shared     bool                `json:"shared,omitempty"`      // May be served to requests with Authorization
+
+	StaleWhileRevalidate time.Duration `json:"stale_while_revalidate,omitempty"` // Past Expires
+	StaleIfError         time.Duration `json:"stale_if_error,omitempty"`         // Past Expires
+}
+
+// RouteConfig holds per-route proxy policies, keyed by the registry path
+type RouteConfig struct {
+	Path      string           `json:"path"`
+	Match     *MatchConfig     `json:"match,omitempty"`
+	Rewrite   string           `json:"rewrite,omitempty"` // e.g. "/internal/accounts/{id}"; default strips the matched prefix
+	Timeout   time.Duration    `json:"timeout,omitempty"` // Total upstream time for non-streaming responses; 0 disables
+	Balancer  *BalancerConfig  `json:"balancer,omitempty"`
+	Affinity  *AffinityConfig  `json:"affinity,omitempty"`
+	WebSocket *WebSocketConfig `json:"websocket,omitempty"`
+	Streaming *StreamingConfig `json:"streaming,omitempty"`
+	Headers   *HeadersConfig   `json:"headers,omitempty"`
+	Body      *BodyConfig      `json:"body,omitempty"`
+	Aggregate *AggregateConfig `json:"aggregate,omitempty"`
+	Mirror    *MirrorConfig    `json:"mirror,omitempty"`
+	Fault     *FaultConfig     `json:"fault,omitempty"`
+	Mock      *MockConfig      `json:"mock,omitempty"`
+	Cache     *CacheConfig     `json:"cache,omitempty"`
+}
+
+// MatchConfig narrows which requests a route receives. Every non-empty
+// condition must match; among matching routes the highest priority wins.
+type MatchConfig struct {
+	Path     string            `json:"path,omitempty"`     // Default: the route's registry path; supports {param} and * segments
+	Regex    string            `json:"regex,omitempty"`    // Used instead of Path, anchored at the start; named groups become params
+	Exact    bool              `json:"exact,omitempty"`    // Match the whole path instead of a segment prefix
+	Hosts    []string          `json:"hosts,omitempty"`    // Exact or "*.example.com"
+	Methods  []string          `json:"methods,omitempty"`  // Any of these methods
+	Headers  map[string]string `json:"headers,omitempty"`  // "*" only requires presence
+	Query    map[string]string `json:"query,omitempty"`    // "*" only requires presence
+	Priority int               `json:"priority,omitempty"` // Higher wins, default 0
+}
+
+// BalancerConfig selects how requests are spread across a route's services
+type BalancerConfig struct {
+	Strategy string `json:"strategy"`           // "round_robin", "least_conn", "p2c_ewma", "consistent_hash"
+	HashOn   string `json:"hash_on,omitempty"`  // "header", "cookie", "ip" (consistent_hash only)
+	HashKey  string `json:"hash_key,omitempty"` // Header or cookie name to hash on
+}
+
+// AffinityConfig pins a client to one service through a signed cookie
+type AffinityConfig struct {
+	Enabled    bool          `json:"enabled"`
+	CookieName string        `json:"cookie_name,omitempty"` // Default: ikyk_affinity
+	TTL        time.Duration `json:"ttl,omitempty"`         // 0 keeps a session cookie
+}
+
+// WebSocketConfig allows HTTP Upgrade (WebSocket) proxying on a route
+type WebSocketConfig struct {
+	Enabled        bool          `json:"enabled"`
+	IdleTimeout    time.Duration `json:"idle_timeout,omitempty"`    // Close after no traffic either way; 0 disables
+	MaxConnections int           `json:"max_connections,omitempty"` // Per gateway replica; 0 is unlimited
+	AllowedOrigins []string      `json:"allowed_origins,omitempty"` // Empty allows any Origin
+}
+
+// StreamingConfig marks a route as long-lived streaming (SSE, chunked NDJSON):
+// responses are flushed immediately, never cached and not bound by Timeout
+type StreamingConfig struct {
+	Enabled     bool          `json:"enabled"`
+	IdleTimeout time.Duration `json:"idle_timeout,omitempty"` // Abort when the upstream sends nothing for this long; 0 disables
+}
+
+// HeadersConfig rewrites the headers of requests sent to the services and of
+// the responses sent back. Values may use the template variables
+// ${client_ip}, ${request_id}, ${consumer}, ${method}, ${path},
+// ${path.<param>}, ${query.<name>} and ${header.<name>}.
+type HeadersConfig struct {
+	Request           *HeaderRules `json:"request,omitempty"`
+	Response          *HeaderRules `json:"response,omitempty"`
+	KeepServerHeaders bool         `json:"keep_server_headers,omitempty"` // Keep Server, X-Powered-By, ... on responses
+}
+
+// HeaderRules are applied in order: rename, remove, set, add
+type HeaderRules struct {
+	Rename map[string]string `json:"rename,omitempty"` // Old name -> new name
+	Remove []string          `json:"remove,omitempty"`
+	Set    map[string]string `json:"set,omitempty"` // Replaces any existing values
+	Add    map[string]string `json:"add,omitempty"` // Appended to existing values
+}
+
+// BodyConfig transforms JSON request and response bodies. Bodies larger than
+// MaxSize, compressed or not JSON pass through untouched, except JSON
+// responses a Mask or Remove can't be applied to: those fail with a 502.
+type BodyConfig struct {
+	Request  *JSONTransform `json:"request,omitempty"`
+	Response *JSONTransform `json:"response,omitempty"`
+	MaxSize  int64          `json:"max_size,omitempty"` // Bytes; default 1 MiB
+}
+
+// JSONTransform edits fields addressed by dotted paths, where [*] selects
+// every array element: "items[*].card.number". Applied in order: rename,
+// remove, add, mask.
+type JSONTransform struct {
+	Rename map[string]string          `json:"rename,omitempty"` // Path -> new field name
+	Remove []string                   `json:"remove,omitempty"`
+	Add    map[string]json.RawMessage `json:"add,omitempty"`  // Path -> value, replacing any existing one
+	Mask   []string                   `json:"mask,omitempty"` // Strings keep their last 4 characters, other values are fully masked
+}
+
+// AggregateConfig turns a route into a composition endpoint: every call is
+// made through the gateway in parallel and the JSON responses are merged
+// under their keys. Failed calls are reported under "_errors". Aggregate
+// routes need no registered services.
+type AggregateConfig struct {
+	Calls   []AggregateCall `json:"calls"`
+	Timeout time.Duration   `json:"timeout,omitempty"` // Default per-call timeout; 0 means 5s
+}
+
+type AggregateCall struct {
+	Key     string        `json:"key"`
+	Path    string        `json:"path"`             // Gateway path, may use the route's {param}s, e.g. "/users/{id}"
+	Method  string        `json:"method,omitempty"` // Default GET
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// MirrorConfig copies a share of a route's requests to the services
+// registered under another registry path. Mirrored responses are discarded.
+type MirrorConfig struct {
+	Path        string        `json:"path"`                    // Registry path of the shadow services
+	Percent     float64       `json:"percent"`                 // 0-100
+	MaxBodySize int64         `json:"max_body_size,omitempty"` // Larger requests are not mirrored; default 1 MiB
+	Timeout     time.Duration `json:"timeout,omitempty"`       // Default 10s
+}
+
+// FaultConfig injects delays and errors into a route's traffic, after the
+// service is picked so aborts count against its circuit breaker. With
+// Headers or Consumers set, only matching requests are affected.
+type FaultConfig struct {
+	Delay     *FaultDelay       `json:"delay,omitempty"`
+	Abort     *FaultAbort       `json:"abort,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`   // e.g. {"X-Chaos": "on"}; "*" matches any value
+	Consumers []string          `json:"consumers,omitempty"` // Authenticated consumers, see the auth policy
+}
+
+type FaultDelay struct {
+	Duration time.Duration `json:"duration"`
+	Percent  float64       `json:"percent,omitempty"` // Share of matching requests, 0-100; 0 means all
+}
+
+type FaultAbort struct {
+	Status  int     `json:"status"`
+	Percent float64 `json:"percent,omitempty"` // Share of matching requests, 0-100; 0 means all
+	Body    string  `json:"body,omitempty"`
+}
+
+// MockConfig answers a route from the gateway itself, without services: the
+// first response whose When matches the request, or the default response.
+type MockConfig struct {
+	MockResponse
+	Responses []MockCase `json:"responses,omitempty"`
+}
+
+type MockResponse struct {
+	Status   int               `json:"status,omitempty"` // Default 200
+	Headers  map[string]string `json:"headers,omitempty"`
+	Body     string            `json:"body,omitempty"`
+	Template bool              `json:"template,omitempty"` // Expand template variables (see HeadersConfig) in Headers and Body
+}
+
+type MockCase struct {
+	When *MockMatch `json:"when,omitempty"`
+	MockResponse
+}
+
+// MockMatch conditions: every non-empty one must match, "*" matches any value
+type MockMatch struct {
+	Methods []string          `json:"methods,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Query   map[string]string `json:"query,omitempty"`
 }
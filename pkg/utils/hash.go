@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"encoding/json"
+)
+
+// ToHashFields flattens a struct into Redis hash fields, one JSON-encoded
+// value per top-level JSON key. Keys listed in skip are left out.
+func ToHashFields(v interface{}, skip ...string) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	for _, key := range skip {
+		delete(raw, key)
+	}
+
+	fields := make(map[string]interface{}, len(raw))
+	for key, value := range raw {
+		fields[key] = string(value)
+	}
+	return fields, nil
+}
+
+// FromHashFields rebuilds a struct from hash fields written by ToHashFields
+func FromHashFields(fields map[string]string, v interface{}) error {
+	raw := make(map[string]json.RawMessage, len(fields))
+	for key, value := range fields {
+		raw[key] = json.RawMessage(value)
+	}
+
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
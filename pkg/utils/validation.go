@@ -3,7 +3,10 @@ package utils
 import (
 	"errors"
 	"net/url"
+	"regexp"
 	"strings"
+
+	"github.com/chann44/ikyk/pkg/types"
 )
 
 // ValidateURL validates that a string is a valid URL
@@ -66,3 +69,435 @@ func ValidateAPIKey(apiKey string) error {
 
 	return nil
 }
+
+// ValidateCircuitBreakerConfig checks a service's breaker policy; zero
+// values fall back to the gateway's defaults
+func ValidateCircuitBreakerConfig(config *types.CircuitBreakerConfig) error {
+	if config.SuccessThreshold < 0 || config.PermittedHalfOpenCalls < 0 || config.MinimumCalls < 0 {
+		return errors.New("circuit breaker thresholds cannot be negative")
+	}
+	if config.Timeout < 0 || config.SlowCallDurationThreshold < 0 {
+		return errors.New("circuit breaker durations cannot be negative")
+	}
+
+	switch config.WindowType {
+	case "", "count", "time":
+	default:
+		return errors.New("invalid circuit breaker window type: " + config.WindowType)
+	}
+	if config.WindowSize < 0 {
+		return errors.New("circuit breaker window size cannot be negative")
+	}
+
+	for _, rate := range []float64{config.FailureRateThreshold, config.SlowCallRateThreshold} {
+		if rate < 0 || rate > 100 {
+			return errors.New("circuit breaker rate thresholds must be between 0 and 100")
+		}
+	}
+	return nil
+}
+
+// ValidateRouteConfig validates the policies attached to a route
+func ValidateRouteConfig(config *types.RouteConfig) error {
+	if err := ValidatePath(config.Path); err != nil {
+		return err
+	}
+
+	if config.Match != nil {
+		if err := validateMatch(config.Match); err != nil {
+			return err
+		}
+	}
+
+	if config.Rewrite != "" {
+		if err := validateRewrite(config); err != nil {
+			return err
+		}
+	}
+
+	if config.Balancer != nil {
+		if err := validateBalancer(config.Balancer); err != nil {
+			return err
+		}
+	}
+
+	if config.Affinity != nil && config.Affinity.TTL < 0 {
+		return errors.New("affinity ttl cannot be negative")
+	}
+
+	if config.Timeout < 0 {
+		return errors.New("timeout cannot be negative")
+	}
+
+	if config.Streaming != nil && config.Streaming.IdleTimeout < 0 {
+		return errors.New("streaming idle_timeout cannot be negative")
+	}
+
+	if ws := config.WebSocket; ws != nil && (ws.IdleTimeout < 0 || ws.MaxConnections < 0) {
+		return errors.New("websocket idle_timeout and max_connections cannot be negative")
+	}
+
+	if config.Aggregate != nil {
+		if err := validateAggregate(config.Aggregate); err != nil {
+			return err
+		}
+	}
+
+	if mirror := config.Mirror; mirror != nil {
+		if err := ValidatePath(mirror.Path); err != nil {
+			return errors.New("mirror " + err.Error())
+		}
+		if mirror.Path == config.Path {
+			return errors.New("mirror path must differ from the route path")
+		}
+		if mirror.Percent < 0 || mirror.Percent > 100 {
+			return errors.New("mirror percent must be between 0 and 100")
+		}
+		if mirror.MaxBodySize < 0 || mirror.Timeout < 0 {
+			return errors.New("mirror max_body_size and timeout cannot be negative")
+		}
+	}
+
+	if config.Fault != nil {
+		if err := validateFault(config.Fault); err != nil {
+			return err
+		}
+	}
+
+	if config.Mock != nil {
+		if err := validateMock(config.Mock); err != nil {
+			return err
+		}
+	}
+
+	if body := config.Body; body != nil {
+		if body.MaxSize < 0 {
+			return errors.New("body max_size cannot be negative")
+		}
+		if err := validateJSONTransform(body.Request); err != nil {
+			return errors.New("request body: " + err.Error())
+		}
+		if err := validateJSONTransform(body.Response); err != nil {
+			return errors.New("response body: " + err.Error())
+		}
+	}
+
+	if config.Cache != nil {
+		if err := validateCache(config.Cache); err != nil {
+			return err
+		}
+	}
+
+	if headers := config.Headers; headers != nil {
+		if err := validateHeaderRules(headers.Request); err != nil {
+			return errors.New("request headers: " + err.Error())
+		}
+		if err := validateHeaderRules(headers.Response); err != nil {
+			return errors.New("response headers: " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+func validateMatch(config *types.MatchConfig) error {
+	if config.Path != "" {
+		if err := ValidatePath(config.Path); err != nil {
+			return err
+		}
+	}
+
+	if config.Regex != "" {
+		if _, err := regexp.Compile(config.Regex); err != nil {
+			return errors.New("invalid match regex: " + err.Error())
+		}
+	}
+
+	for _, host := range config.Hosts {
+		if host == "" || strings.ContainsAny(host, "/ ") {
+			return errors.New("invalid match host: " + host)
+		}
+	}
+
+	for _, method := range config.Methods {
+		if method == "" || strings.ContainsAny(method, " /") {
+			return errors.New("invalid match method: " + method)
+		}
+	}
+
+	return nil
+}
+
+var templateParam = regexp.MustCompile(`\{([A-Za-z0-9_*]+)\}`)
+
+// validateRewrite checks that the rewrite template only uses params the
+// route's match can capture, plus {*} for the rest of the path
+func validateRewrite(config *types.RouteConfig) error {
+	if !strings.HasPrefix(config.Rewrite, "/") {
+		return errors.New("rewrite must start with /")
+	}
+
+	params := map[string]bool{"*": true}
+	if match := config.Match; match != nil {
+		if match.Regex != "" {
+			compiled, _ := regexp.Compile(match.Regex)
+			for _, name := range compiled.SubexpNames() {
+				params[name] = true
+			}
+		} else {
+			for _, found := range templateParam.FindAllStringSubmatch(match.Path, -1) {
+				params[found[1]] = true
+			}
+		}
+	}
+
+	for _, found := range templateParam.FindAllStringSubmatch(config.Rewrite, -1) {
+		if !params[found[1]] {
+			return errors.New("rewrite uses unknown param: " + found[1])
+		}
+	}
+
+	return nil
+}
+
+func validateBalancer(config *types.BalancerConfig) error {
+	switch config.Strategy {
+	case "", "round_robin", "least_conn", "p2c_ewma":
+		return nil
+	case "consistent_hash":
+	default:
+		return errors.New("unknown balancer strategy: " + config.Strategy)
+	}
+
+	switch config.HashOn {
+	case "ip":
+	case "header", "cookie":
+		if config.HashKey == "" {
+			return errors.New("hash_key is required when hashing on " + config.HashOn)
+		}
+	default:
+		return errors.New("hash_on must be one of header, cookie or ip")
+	}
+
+	return nil
+}
+
+var (
+	headerName     = regexp.MustCompile(`^[!#$%&'*+\-.^_|~0-9A-Za-z]+$`)
+	headerVariable = regexp.MustCompile(`\$\{([^}]*)\}`)
+)
+
+func validateHeaderRules(rules *types.HeaderRules) error {
+	if rules == nil {
+		return nil
+	}
+
+	names := append([]string{}, rules.Remove...)
+	for from, to := range rules.Rename {
+		names = append(names, from, to)
+	}
+	for name, value := range rules.Set {
+		names = append(names, name)
+		if err := validateHeaderValue(value); err != nil {
+			return err
+		}
+	}
+	for name, value := range rules.Add {
+		names = append(names, name)
+		if err := validateHeaderValue(value); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		if !headerName.MatchString(name) {
+			return errors.New("invalid header name: " + name)
+		}
+	}
+	return nil
+}
+
+func validateHeaderValue(value string) error {
+	if strings.ContainsAny(value, "\r\n") {
+		return errors.New("header values cannot contain line breaks")
+	}
+	return validateTemplate(value)
+}
+
+// validateTemplate checks the ${...} variables used in a header or mock template
+func validateTemplate(value string) error {
+	for _, found := range headerVariable.FindAllStringSubmatch(value, -1) {
+		name := found[1]
+		switch {
+		case name == "client_ip", name == "request_id", name == "consumer", name == "method", name == "path":
+			continue
+		}
+
+		prefix, param, ok := strings.Cut(name, ".")
+		if ok && param != "" && (prefix == "path" || prefix == "query" || prefix == "header") {
+			continue
+		}
+		return errors.New("unknown template variable: " + name)
+	}
+	return nil
+}
+
+// jsonPath is a dotted field path where fields may be followed by [*]; it
+// has to end with a field name
+var jsonPath = regexp.MustCompile(`^[^.\[\]]+(\[\*\])*(\.[^.\[\]]+(\[\*\])*)*$`)
+
+func validateJSONTransform(transform *types.JSONTransform) error {
+	if transform == nil {
+		return nil
+	}
+
+	paths := append(append([]string{}, transform.Remove...), transform.Mask...)
+	for path, name := range transform.Rename {
+		if name == "" || strings.ContainsAny(name, ".[]") {
+			return errors.New("invalid rename target: " + name)
+		}
+		paths = append(paths, path)
+	}
+	for path := range transform.Add {
+		paths = append(paths, path)
+	}
+
+	for _, path := range paths {
+		if !jsonPath.MatchString(path) || strings.HasSuffix(path, "[*]") {
+			return errors.New("invalid field path: " + path)
+		}
+	}
+	return nil
+}
+
+func validateAggregate(config *types.AggregateConfig) error {
+	if len(config.Calls) == 0 {
+		return errors.New("aggregate needs at least one call")
+	}
+	if config.Timeout < 0 {
+		return errors.New("aggregate timeout cannot be negative")
+	}
+
+	keys := make(map[string]bool, len(config.Calls))
+	for _, call := range config.Calls {
+		if call.Key == "" || call.Key == "_errors" {
+			return errors.New("invalid aggregate key: " + call.Key)
+		}
+		if keys[call.Key] {
+			return errors.New("duplicate aggregate key: " + call.Key)
+		}
+		keys[call.Key] = true
+
+		if err := ValidatePath(call.Path); err != nil {
+			return errors.New("aggregate call " + call.Key + ": " + err.Error())
+		}
+		if strings.ContainsAny(call.Method, " /") {
+			return errors.New("invalid aggregate method: " + call.Method)
+		}
+		if call.Timeout < 0 {
+			return errors.New("aggregate call " + call.Key + ": timeout cannot be negative")
+		}
+	}
+	return nil
+}
+
+func validateFault(config *types.FaultConfig) error {
+	if config.Delay == nil && config.Abort == nil {
+		return errors.New("fault needs a delay or an abort")
+	}
+
+	if delay := config.Delay; delay != nil {
+		if delay.Duration <= 0 {
+			return errors.New("fault delay duration must be positive")
+		}
+		if delay.Percent < 0 || delay.Percent > 100 {
+			return errors.New("fault delay percent must be between 0 and 100")
+		}
+	}
+
+	if abort := config.Abort; abort != nil {
+		if abort.Status < 200 || abort.Status > 599 {
+			return errors.New("fault abort status must be between 200 and 599")
+		}
+		if abort.Percent < 0 || abort.Percent > 100 {
+			return errors.New("fault abort percent must be between 0 and 100")
+		}
+	}
+
+	for name := range config.Headers {
+		if !headerName.MatchString(name) {
+			return errors.New("invalid fault header: " + name)
+		}
+	}
+	return nil
+}
+
+func validateMock(config *types.MockConfig) error {
+	responses := []types.MockResponse{config.MockResponse}
+	for _, mockCase := range config.Responses {
+		if when := mockCase.When; when != nil {
+			for _, method := range when.Methods {
+				if method == "" || strings.ContainsAny(method, " /") {
+					return errors.New("invalid mock method: " + method)
+				}
+			}
+		}
+		responses = append(responses, mockCase.MockResponse)
+	}
+
+	for _, response := range responses {
+		if response.Status != 0 && (response.Status < 100 || response.Status > 599) {
+			return errors.New("mock status must be between 100 and 599")
+		}
+		for name, value := range response.Headers {
+			if !headerName.MatchString(name) {
+				return errors.New("invalid mock header: " + name)
+			}
+			if strings.ContainsAny(value, "\r\n") {
+				return errors.New("header values cannot contain line breaks")
+			}
+		}
+		if response.Template {
+			for _, value := range response.Headers {
+				if err := validateTemplate(value); err != nil {
+					return err
+				}
+			}
+			if err := validateTemplate(response.Body); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateCache(config *types.CacheConfig) error {
+	if config.TTL < 0 || config.MaxBodySize < 0 {
+		return errors.New("cache ttl and max_body_size cannot be negative")
+	}
+	if config.StaleWhileRevalidate < 0 || config.StaleIfError < 0 {
+		return errors.New("cache stale_while_revalidate and stale_if_error cannot be negative")
+	}
+
+	for _, method := range config.Methods {
+		if method != "GET" && method != "HEAD" {
+			return errors.New("only GET and HEAD can be cached, got " + method)
+		}
+	}
+
+	if config.PathPrefix != "" && !strings.HasPrefix(config.PathPrefix, "/") {
+		return errors.New("cache path_prefix must start with /")
+	}
+
+	if key := config.Key; key != nil {
+		for _, name := range key.Headers {
+			if !headerName.MatchString(name) {
+				return errors.New("invalid cache key header: " + name)
+			}
+		}
+		if len(key.Query) > 0 && len(key.IgnoreQuery) > 0 {
+			return errors.New("cache key takes either query or ignore_query")
+		}
+	}
+	return nil
+}